@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidFIXMessage is returned when a FIX message can't be mapped to an Order.
+var ErrInvalidFIXMessage = errors.New("invalid FIX message")
+
+// fixSides maps the FIX Side(54) values we support to the engine's sides.
+var fixSides = map[string]string{
+	"1": "BUY",
+	"2": "SELL",
+}
+
+// ParseFIXNewOrderSingle maps a FIX 4.4 NewOrderSingle (35=D) message into an Order that can be fed directly into
+// OrderBook.Insert. Fields are separated by SOH (\x01), a "|" separator is also accepted since that's how FIX messages
+// are usually logged. The tags used are:
+//
+//	11 (ClOrdID)  -> ID, must be numeric
+//	55 (Symbol)   -> Symbol
+//	54 (Side)     -> Side, 1 is BUY and 2 is SELL
+//	44 (Price)    -> Price
+//	38 (OrderQty) -> Volume
+//
+// Every other tag (header, trailer, checksum...) is ignored.
+func ParseFIXNewOrderSingle(msg string) (*Order, error) {
+	separator := "\x01"
+	if !strings.Contains(msg, separator) {
+		separator = "|"
+	}
+
+	tags := make(map[string]string)
+	for _, field := range strings.Split(msg, separator) {
+		if field == "" {
+			continue
+		}
+		tag, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("%w: field %q is not tag=value", ErrInvalidFIXMessage, field)
+		}
+		tags[tag] = value
+	}
+
+	if tags["35"] != "D" {
+		return nil, fmt.Errorf("%w: MsgType(35) is %q, expected D", ErrInvalidFIXMessage, tags["35"])
+	}
+	for _, tag := range []string{"11", "55", "54", "44", "38"} {
+		if tags[tag] == "" {
+			return nil, fmt.Errorf("%w: missing tag %s", ErrInvalidFIXMessage, tag)
+		}
+	}
+
+	id, err := strconv.Atoi(tags["11"])
+	if err != nil {
+		return nil, fmt.Errorf("%w: ClOrdID(11) %q is not numeric", ErrInvalidFIXMessage, tags["11"])
+	}
+	side, ok := fixSides[tags["54"]]
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported Side(54) %q", ErrInvalidFIXMessage, tags["54"])
+	}
+	price, err := strconv.ParseFloat(tags["44"], 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid Price(44) %q", ErrInvalidFIXMessage, tags["44"])
+	}
+	volume, err := strconv.Atoi(tags["38"])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid OrderQty(38) %q", ErrInvalidFIXMessage, tags["38"])
+	}
+
+	return &Order{
+		ID:     id,
+		Symbol: tags["55"],
+		Side:   side,
+		Price:  price,
+		Volume: volume,
+	}, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseFIXNewOrderSingle(t *testing.T) {
+	testCases := []struct {
+		name     string
+		msg      string
+		expected *Order
+	}{
+		{
+			name:     "buy with SOH separators",
+			msg:      strings.ReplaceAll("8=FIX.4.4|9=148|35=D|34=1080|49=TESTBUY1|52=20180920-18:14:19.508|56=TESTSELL1|11=4|15=USD|21=2|38=12|40=2|44=23.45|54=1|55=FFLY|60=20180920-18:14:19.492|10=092|", "|", "\x01"),
+			expected: &Order{ID: 4, Symbol: "FFLY", Side: "BUY", Price: 23.45, Volume: 12},
+		},
+		{
+			name:     "sell with 4 decimals, pipe separated",
+			msg:      "8=FIX.4.4|9=120|35=D|49=CLIENT|56=VENUE|11=7|55=FFLY|54=2|38=5|40=2|44=2.1427|10=123|",
+			expected: &Order{ID: 7, Symbol: "FFLY", Side: "SELL", Price: 2.1427, Volume: 5},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			order, err := ParseFIXNewOrderSingle(tc.msg)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(order, tc.expected) {
+				t.Errorf("Expected %+v, got %+v", tc.expected, order)
+			}
+		})
+	}
+
+	invalid := []string{
+		"8=FIX.4.4|35=F|11=4|55=FFLY|54=1|38=12|44=23.45|", // order cancel request, not a new order
+		"8=FIX.4.4|35=D|11=4|55=FFLY|54=5|38=12|44=23.45|", // sell short isn't supported
+		"8=FIX.4.4|35=D|11=ABC|55=FFLY|54=1|38=12|44=23.45|",
+		"8=FIX.4.4|35=D|11=4|55=FFLY|54=1|44=23.45|", // missing quantity
+	}
+	for _, msg := range invalid {
+		if _, err := ParseFIXNewOrderSingle(msg); !errors.Is(err, ErrInvalidFIXMessage) {
+			t.Errorf("Expected ErrInvalidFIXMessage for %q, got %v", msg, err)
+		}
+	}
+}
+
+func TestParseFIXNewOrderSingleIntoOrderBook(t *testing.T) {
+	ob := NewOrderBook()
+	for _, msg := range []string{
+		"35=D|11=1|55=FFLY|54=1|38=10|44=23.45|",
+		"35=D|11=2|55=FFLY|54=2|38=4|44=23.4|",
+	} {
+		order, err := ParseFIXNewOrderSingle(msg)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		ob.Insert(order)
+	}
+	if expected := []string{"FFLY,23.45,4,2,1"}; !reflect.DeepEqual(ob.Trades, expected) {
+		t.Errorf("Expected trades %v, got %v", expected, ob.Trades)
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"bufio"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"os"
@@ -11,7 +13,7 @@ import (
 
 /*
  Run the matching engine for a list of input operations and returns the trades and orderbooks in a
- csv-like format. Every command starts with either "INSERT", "UPDATE" or "CANCEL" with additional
+ csv-like format. Every command starts with either "INSERT", "UPDATE", "CANCEL", "CXR" or "PRINT" with additional
  data in the columns after the command.
 
  In case of insert the line will have the format:
@@ -26,6 +28,18 @@ import (
  CANCEL,<order_id>
  e.g. CANCEL,4
 
+ In case of cancel replace the line will have the format:
+ CXR,<old_order_id>,<new_order_id>,<price>,<volume>
+ e.g. CXR,4,5,23.12,11
+ It atomically cancels the old order and inserts the new one, with the symbol and side of the old order, at the back
+ of its price level. The new order is matched like an insert.
+
+ In case of print the line will have the format:
+ PRINT,<symbol>
+ e.g. PRINT,FFLY
+ It prints the book summary of the symbol as of that point of the stream: after the trades executed so far (of every
+ symbol) and before the later ones. The final summary is printed as usual.
+
  Side will always be "BUY" or "SELL".
  A price is a string with a maximum of 4 digits behind the ".", so "2.1427" and "33.42" would be
  valid prices but "2.14275" would not be a valid price since it has more than 4 digits behind the
@@ -52,52 +66,144 @@ import (
 */
 
 func main() {
+	inputPath := flag.String("input", "", "read the operations from this file instead of stdin")
+	crlf := flag.Bool("crlf", false, "end the output lines with \\r\\n instead of \\n")
+	trailingNewline := flag.Bool("trailing-newline", true, "end the output with a line separator")
+	flag.Parse()
 
-	reader := bufio.NewReaderSize(os.Stdin, 16*1024*1024)
+	input, err := openInput(*inputPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot open input: %v\n", err)
+		os.Exit(1)
+	}
+	defer input.Close()
 
-	stdout, err := os.Create(os.Getenv("OUTPUT_PATH"))
-	checkError(err)
+	stdout, err := openOutput(os.Getenv("OUTPUT_PATH"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot open output: %v\n", err)
+		os.Exit(1)
+	}
 
 	defer stdout.Close()
 
 	writer := bufio.NewWriterSize(stdout, 16*1024*1024)
 
-	operationsCount, err := strconv.ParseInt(strings.TrimSpace(readLine(reader)), 10, 64)
-	checkError(err)
-
-	var operations []string
-
-	for i := 0; i < int(operationsCount); i++ {
-		operationsItem := readLine(reader)
-		operations = append(operations, operationsItem)
+	result, err := runMatchingEngineInput(input)
+	if errors.Is(err, ErrInvalidOperationsCount) {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	if err != nil {
+		// the operations read so far were applied, so their output is still written
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
 	}
 
-	result := runMatchingEngine(operations)
+	separator := "\n"
+	if *crlf {
+		separator = "\r\n"
+	}
+	if err := writeResults(writer, result, separator, *trailingNewline); err != nil {
+		fmt.Fprintf(os.Stderr, "cannot write output: %v\n", err)
+		os.Exit(1)
+	}
+}
 
+// writeResults writes the result lines to w separated by separator ("\n" or "\r\n"), followed by a last separator if
+// trailingNewline is set, and flushes w. An empty result writes just that trailing separator.
+func writeResults(w *bufio.Writer, result []string, separator string, trailingNewline bool) error {
 	for i, resultItem := range result {
-		fmt.Fprintf(writer, "%s", resultItem)
+		w.WriteString(resultItem)
 
 		if i != len(result)-1 {
-			fmt.Fprintf(writer, "\n")
+			w.WriteString(separator)
 		}
 	}
 
-	fmt.Fprintf(writer, "\n")
+	if trailingNewline {
+		w.WriteString(separator)
+	}
+	// bufio.Writer errors are sticky, Flush reports the first failed write
+	return w.Flush()
+}
 
-	writer.Flush()
+// openInput opens the file the operations are read from. An empty path (no -input flag) falls back to os.Stdin, which
+// is then left open by Close.
+func openInput(path string) (io.ReadCloser, error) {
+	if path == "" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(path)
 }
 
-func readLine(reader *bufio.Reader) string {
-	str, _, err := reader.ReadLine()
-	if err == io.EOF {
-		return ""
+// ErrInvalidOperationsCount is returned by runMatchingEngineInput when the first line of the input isn't a number of
+// operations.
+var ErrInvalidOperationsCount = errors.New("invalid operations count")
+
+// runMatchingEngineInput runs the matching engine over input in the program's input format: a first line with the
+// number of operations, then the operations one per line. It reports a bad first line as ErrInvalidOperationsCount,
+// and is otherwise runMatchingEngineReader.
+func runMatchingEngineInput(input io.Reader) ([]string, error) {
+	reader := bufio.NewReaderSize(input, 16*1024*1024)
+
+	firstLine, err := readLine(reader)
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading the first line: %v", ErrInvalidOperationsCount, err)
+	}
+	operationsCount, err := strconv.ParseInt(strings.TrimSpace(firstLine), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidOperationsCount, firstLine)
 	}
+	return runMatchingEngineReader(reader, int(operationsCount))
+}
+
+// openOutput opens the file the results are written to. An empty path (OUTPUT_PATH unset) falls back to os.Stdout, which
+// is then left open by Close.
+func openOutput(path string) (io.WriteCloser, error) {
+	if path == "" {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+	return os.Create(path)
+}
 
-	return strings.TrimRight(string(str), "\r\n")
+// nopWriteCloser is a writer whose Close does nothing.
+type nopWriteCloser struct {
+	io.Writer
 }
 
-func checkError(err error) {
+func (nopWriteCloser) Close() error { return nil }
+
+// runMatchingEngineReader runs the matching engine over the next operationsCount lines of reader. Unlike
+// runMatchingEngine, operations are applied one at a time as they are read, so the input is never held in memory as a
+// whole (only the book state and the trades are). The output is the same as runMatchingEngine's.
+// If the input ends (or fails) before operationsCount lines were read, reading stops there and an error wrapping
+// io.ErrUnexpectedEOF (or the read error) is returned along with the output of the operations that were applied.
+func runMatchingEngineReader(reader *bufio.Reader, operationsCount int) ([]string, error) {
+	logger := engineLogger()
+
+	obs := NewOrderBooks(WithLogger(logger))
+	var output []string // the output of the PRINT operations, see applyOperationOutput
+	for i := 0; i < operationsCount; i++ {
+		operation, err := readLine(reader)
+		if err == io.EOF {
+			return append(output, engineOutput(obs, OutputBoth)...), fmt.Errorf("input ended after %d of %d operations: %w", i, operationsCount, io.ErrUnexpectedEOF)
+		}
+		if err != nil {
+			return append(output, engineOutput(obs, OutputBoth)...), fmt.Errorf("reading operation %d of %d: %w", i+1, operationsCount, err)
+		}
+		if output, err = applyOperationOutput(obs, operation, OutputBoth, output); err != nil {
+			logger.Printf("Skipping operation %q: %v\n", operation, err)
+		}
+	}
+	return append(output, engineOutput(obs, OutputBoth)...), nil
+}
+
+// readLine reads the next line without its line ending. It returns io.EOF once the input is exhausted, and any other
+// read error as is; a last line without a trailing newline is still returned.
+func readLine(reader *bufio.Reader) (string, error) {
+	str, _, err := reader.ReadLine()
 	if err != nil {
-		panic(err)
+		return "", err
 	}
+
+	return strings.TrimRight(string(str), "\r\n"), nil
 }
@@ -1,157 +1,704 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
+// runMatchingEngineCases are the end to end cases of TestRunMatchingEngine, also seeding FuzzRunMatchingEngine.
+var runMatchingEngineCases = []struct {
+	name     string
+	input    []string
+	expected []string
+}{
+
+	{
+		name: "test case 10",
+		input: []string{
+			"INSERT,1,FFLY,BUY,47,5",
+			"INSERT,2,FFLY,BUY,47,6",
+			"INSERT,3,FFLY,SELL,47,9",
+			"UPDATE,2,47,-1", // volumes are absolute, a negative one is discarded: order 2 keeps 2
+		},
+		expected: []string{
+			"FFLY,47,5,3,1",
+			"FFLY,47,4,3,2",
+			"===FFLY===",
+			"BUY,47,2",
+		},
+	},
+
+	{
+		name: "Test Case 5",
+		input: []string{
+			"INSERT,1,FFLY,BUY,45.95,5",
+			"INSERT,2,FFLY,BUY,45.95,6",
+			"INSERT,3,FFLY,BUY,45.95,12",
+			"INSERT,4,FFLY,SELL,46,8",
+			"UPDATE,2,46,3",
+			"INSERT,5,FFLY,SELL,45.95,1",
+			"UPDATE,1,45.95,3",
+			"INSERT,6,FFLY,SELL,45.95,1",
+			"UPDATE,1,45.95,5",
+			"INSERT,7,FFLY,SELL,45.95,1",
+		},
+		expected: []string{
+			"FFLY,46,3,2,4",
+			"FFLY,45.95,1,5,1",
+			"FFLY,45.95,1,6,1",
+			"FFLY,45.95,1,7,3",
+			"===FFLY===",
+			"SELL,46,5",
+			"BUY,45.95,16",
+		},
+	},
+
+	{name: "Test Case 4",
+		input: []string{
+			"INSERT,1,FFLY,BUY,14.235,5",
+			"INSERT,2,FFLY,BUY,14.235,6",
+			"INSERT,3,FFLY,BUY,14.235,12",
+			"INSERT,4,FFLY,BUY,14.234,5",
+			"INSERT,5,FFLY,BUY,14.23,3",
+			"INSERT,6,FFLY,SELL,14.237,8",
+			"INSERT,7,FFLY,SELL,14.24,9",
+			"CANCEL,1",
+			"INSERT,8,FFLY,SELL,14.234,25",
+		}, expected: []string{
+			"FFLY,14.235,6,8,2",
+			"FFLY,14.235,12,8,3",
+			"FFLY,14.234,5,8,4",
+			"===FFLY===",
+			"SELL,14.24,9",
+			"SELL,14.237,8",
+			"SELL,14.234,2",
+			"BUY,14.23,3"}},
+
+	{
+		name: "Test Case 1",
+		input: []string{
+			"INSERT,1,FFLY,BUY,0.3854,5",
+			"INSERT,2,ETH,BUY,412,31",
+			"INSERT,3,ETH,BUY,410.5,27",
+			"INSERT,4,DOT,SELL,21,8",
+			"INSERT,11,FFLY,SELL,0.3854,4",
+			"INSERT,13,FFLY,SELL,0.3853,6",
+		},
+		expected: []string{
+			"FFLY,0.3854,4,11,1",
+			"FFLY,0.3854,1,13,1",
+			"===DOT===",
+			"SELL,21,8",
+			"===ETH===",
+			"BUY,412,31",
+			"BUY,410.5,27",
+			"===FFLY===",
+			"SELL,0.3853,5",
+		},
+	},
+	{
+		name: "Test case 2",
+		input: []string{
+			"INSERT,1,FFLY,BUY,12.2,5",
+			"INSERT,2,FFLY,SELL,12.3,5",
+			"INSERT,3,FFLY,SELL,12.3,5",
+			"CANCEL,2",
+		},
+		expected: []string{
+			"===FFLY===",
+			"SELL,12.3,5",
+			"BUY,12.2,5",
+		},
+	},
+	{name: "Test case 6",
+		input: []string{
+			/*
+				[INSERT,1,FFLY,SELL,12.2,5 INSERT,2,FFLY,SELL,12.1,8, INSERT,3,FFLY,BUY,12.5,10]
+			*/
+			"INSERT,1,FFLY,SELL,12.2,5",
+			"INSERT,2,FFLY,SELL,12.1,8",
+			"INSERT,3,FFLY,BUY,12.5,10",
+		},
+
+		expected: []string{
+			"FFLY,12.1,8,3,2",
+			"FFLY,12.2,2,3,1",
+			"===FFLY===",
+			"SELL,12.2,3",
+		},
+	},
+
+	{
+		name: "malformed lines are skipped",
+		input: []string{
+			"INSERT,1,FFLY,BUY",         // truncated
+			"",                          // empty line
+			"INSERT,2,FFLY,BUY,47,5,",   // extra comma
+			"INSERT,3,FFLY,BUY,47,abc",  // non numeric volume
+			"UPDATE,4,47",               // truncated update
+			"CANCEL",                    // missing order id
+			"CANCEL,99",                 // unknown order
+			"INSERT,5,FFLY,BUY,47,5",    // valid
+			"INSERT,6,FFLY,SELL,47,3",   // valid, matches order 5
+			"UNKNOWN,1,2,3",             // unknown command
+			"INSERT,7,FFLY,SELL,48,1,,", // extra commas
+		},
+		expected: []string{
+			"FFLY,47,3,6,5",
+			"===FFLY===",
+			"BUY,47,2",
+		},
+	},
+
+	{
+		name: "exhausted level is omitted from summary",
+		input: []string{
+			"INSERT,1,FFLY,SELL,48,3",
+			"INSERT,2,FFLY,SELL,48,2",
+			"INSERT,3,FFLY,SELL,49,1",
+			"INSERT,4,FFLY,BUY,48,5", // takes the whole 48 level, no SELL,48,0 line
+			"INSERT,5,FFLY,BUY,47,2",
+			"INSERT,6,FFLY,SELL,47,2", // exhausts the only buy level
+		},
+		expected: []string{
+			"FFLY,48,3,4,1",
+			"FFLY,48,2,4,2",
+			"FFLY,47,2,6,5",
+			"===FFLY===",
+			"SELL,49,1",
+		},
+	},
+
+	{
+		name: "test case 11",
+		input: []string{
+			"INSERT,1,FFLY,BUY,47,5",
+			"INSERT,2,FFLY,BUY,47,6",
+			"INSERT,3,FFLY,SELL,47,9", // this should be zero
+			"UPDATE,1,45,2",           // one is gone, no-op
+			"UPDATE,5,45,2",           // five is no-existent, no-op
+		},
+		expected: []string{
+			"FFLY,47,5,3,1",
+			"FFLY,47,4,3,2",
+			"===FFLY===",
+			"BUY,47,2",
+		},
+	},
+
+	{
+		name: "cancel replace goes to the back of the level",
+		input: []string{
+			"INSERT,1,FFLY,BUY,47,5",
+			"INSERT,2,FFLY,BUY,47,5",
+			"CXR,1,3,47,5",  // same level, but behind order 2 now
+			"CXR,9,10,47,5", // unknown order, skipped
+			"CXR,2,x,47,5",  // malformed, skipped
+			"INSERT,4,FFLY,SELL,47,6",
+		},
+		expected: []string{
+			"FFLY,47,5,4,2",
+			"FFLY,47,1,4,3",
+			"===FFLY===",
+			"BUY,47,4",
+		},
+	},
+
+	{
+		name: "cancel replace crossing the book",
+		input: []string{
+			"INSERT,1,FFLY,SELL,48,3",
+			"INSERT,2,FFLY,BUY,46,5",
+			"CXR,2,3,48,4", // replaced order keeps the BUY side and trades right away
+		},
+		expected: []string{
+			"FFLY,48,3,3,1",
+			"===FFLY===",
+			"BUY,48,1",
+		},
+	},
+
+	{
+		name: "print shows the book mid stream",
+		input: []string{
+			"INSERT,1,FFLY,SELL,48,3",
+			"INSERT,2,FFLY,BUY,46,2",
+			"PRINT,FFLY",
+			"INSERT,3,FFLY,BUY,48,3", // takes the whole 48 level after the print
+			"PRINT,GOOG",             // no such book, skipped
+		},
+		expected: []string{
+			"===FFLY===",
+			"SELL,48,3",
+			"BUY,46,2",
+			"FFLY,48,3,3,1",
+			"===FFLY===",
+			"BUY,46,2",
+		},
+	},
+
+	{
+		name: "print comes out where it was issued among symbols",
+		input: []string{
+			"INSERT,1,GOOG,SELL,10,2",
+			"INSERT,2,GOOG,BUY,10,1",
+			"INSERT,3,FFLY,SELL,48,3",
+			"PRINT,FFLY",
+			"INSERT,4,AAPL,SELL,5,1",
+			"INSERT,5,AAPL,BUY,5,1",
+		},
+		expected: []string{
+			"GOOG,10,1,2,1",
+			"===FFLY===",
+			"SELL,48,3",
+			"AAPL,5,1,5,4",
+			"===AAPL===",
+			"===FFLY===",
+			"SELL,48,3",
+			"===GOOG===",
+			"SELL,10,1",
+		},
+	},
+
+	{
+		name: "padded and mixed case fields",
+		input: []string{
+			"INSERT, 1, FFLY, sell, 48, 3",
+			" insert,2,FFLY,Buy,47,2 ",
+			"Insert,3,FFLY,HOLD,47,2", // still an invalid side
+			"update, 2, 48, 4",
+			"INSERT ,4 ,FFLY ,sell ,47 ,1",
+			"cancel , 9",
+		},
+		expected: []string{
+			"FFLY,48,3,2,1",
+			"FFLY,48,1,4,2",
+			"===FFLY===",
+		},
+	},
+}
+
 func TestRunMatchingEngine(t *testing.T) {
+	for _, tc := range runMatchingEngineCases {
+		t.Run(tc.name, func(t *testing.T) {
+			output := runMatchingEngine(tc.input)
+			if !reflect.DeepEqual(output, tc.expected) {
+				t.Errorf("Expected %v, but got %v", tc.expected, output)
+			}
+		})
+	}
+}
+
+func TestRunMatchingEngineStream(t *testing.T) {
+	input := []string{
+		"INSERT,1,FFLY,BUY,12.2,5",
+		"INSERT,2,ETH,SELL,410,3",
+		"INSERT,3,FFLY,SELL,12.2,2",
+		"INSERT,4,ETH,BUY,411,1",
+		"INSERT,5,FFLY,SELL,12.1,1",
+	}
+	var buf bytes.Buffer
+	if err := RunMatchingEngineStream(input, &buf); err != nil {
+		t.Fatalf("RunMatchingEngineStream returned an error: %v", err)
+	}
+
+	// trades are written in the order they happened, regardless of their symbol
+	expected := []string{
+		"FFLY,12.2,2,3,1",
+		"ETH,411,1,4,2", // the engine trades at the higher of the two prices, see matchOrders
+		"FFLY,12.2,1,5,1",
+		"===ETH===",
+		"SELL,410,2",
+		"===FFLY===",
+		"BUY,12.2,2",
+	}
+	output := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if !reflect.DeepEqual(output, expected) {
+		t.Errorf("Expected %v, but got %v", expected, output)
+	}
+}
+
+// largeOperations generates n operations over a handful of symbols, mixing resting orders and crossing ones.
+func largeOperations(n int) []string {
+	symbols := []string{"DOT", "ETH", "FFLY"}
+	operations := make([]string, 0, n)
+	for i := 1; i <= n; i++ {
+		side := "BUY"
+		if i%2 == 0 {
+			side = "SELL"
+		}
+		price := 100 + float64(i%50)/10
+		operations = append(operations, fmt.Sprintf("INSERT,%d,%s,%s,%s,%d", i, symbols[i%len(symbols)], side, formatFloat(price), 1+i%20))
+	}
+	return operations
+}
+
+func BenchmarkRunMatchingEngine(b *testing.B) {
+	operations := largeOperations(20000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		runMatchingEngine(operations)
+	}
+}
+
+func BenchmarkRunMatchingEngineStream(b *testing.B) {
+	operations := largeOperations(20000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := RunMatchingEngineStream(operations, io.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestRunMatchingEngineOutputModes(t *testing.T) {
+	input := []string{
+		"INSERT,1,FFLY,BUY,0.3854,5",
+		"INSERT,2,ETH,BUY,412,31",
+		"INSERT,11,FFLY,SELL,0.3854,4",
+		"INSERT,13,FFLY,SELL,0.3853,6",
+	}
+	trades := []string{
+		"FFLY,0.3854,4,11,1",
+		"FFLY,0.3854,1,13,1",
+	}
+	book := []string{
+		"===ETH===",
+		"BUY,412,31",
+		"===FFLY===",
+		"SELL,0.3853,5",
+	}
 
 	testCases := []struct {
 		name     string
-		input    []string
+		mode     OutputMode
 		expected []string
 	}{
-
-		{
-			name: "test case 10",
-			input: []string{
-				"INSERT,1,FFLY,BUY,47,5",
-				"INSERT,2,FFLY,BUY,47,6",
-				"INSERT,3,FFLY,SELL,47,9",
-				"UPDATE,2,47,-1",
-			},
-			expected: []string{
-				"FFLY,47,5,3,1",
-				"FFLY,47,4,3,2",
-				"===FFLY===",
-				"BUY,47,2",
-			},
-		},
-
-		{
-			name: "Test Case 5",
-			input: []string{
-				"INSERT,1,FFLY,BUY,45.95,5",
-				"INSERT,2,FFLY,BUY,45.95,6",
-				"INSERT,3,FFLY,BUY,45.95,12",
-				"INSERT,4,FFLY,SELL,46,8",
-				"UPDATE,2,46,3",
-				"INSERT,5,FFLY,SELL,45.95,1",
-				"UPDATE,1,45.95,3",
-				"INSERT,6,FFLY,SELL,45.95,1",
-				"UPDATE,1,45.95,5",
-				"INSERT,7,FFLY,SELL,45.95,1",
-			},
-			expected: []string{
-				"FFLY,46,3,2,4",
-				"FFLY,45.95,1,5,1",
-				"FFLY,45.95,1,6,1",
-				"FFLY,45.95,1,7,3",
-				"===FFLY===",
-				"SELL,46,5",
-				"BUY,45.95,16",
-			},
-		},
-
-		{name: "Test Case 4",
-			input: []string{
-				"INSERT,1,FFLY,BUY,14.235,5",
-				"INSERT,2,FFLY,BUY,14.235,6",
-				"INSERT,3,FFLY,BUY,14.235,12",
-				"INSERT,4,FFLY,BUY,14.234,5",
-				"INSERT,5,FFLY,BUY,14.23,3",
-				"INSERT,6,FFLY,SELL,14.237,8",
-				"INSERT,7,FFLY,SELL,14.24,9",
-				"CANCEL,1",
-				"INSERT,8,FFLY,SELL,14.234,25",
-			}, expected: []string{
-				"FFLY,14.235,6,8,2",
-				"FFLY,14.235,12,8,3",
-				"FFLY,14.234,5,8,4",
-				"===FFLY===",
-				"SELL,14.24,9",
-				"SELL,14.237,8",
-				"SELL,14.234,2",
-				"BUY,14.23,3"}},
-
-		{
-			name: "Test Case 1",
-			input: []string{
-				"INSERT,1,FFLY,BUY,0.3854,5",
-				"INSERT,2,ETH,BUY,412,31",
-				"INSERT,3,ETH,BUY,410.5,27",
-				"INSERT,4,DOT,SELL,21,8",
-				"INSERT,11,FFLY,SELL,0.3854,4",
-				"INSERT,13,FFLY,SELL,0.3853,6",
-			},
-			expected: []string{
-				"FFLY,0.3854,4,11,1",
-				"FFLY,0.3854,1,13,1",
-				"===DOT===",
-				"SELL,21,8",
-				"===ETH===",
-				"BUY,412,31",
-				"BUY,410.5,27",
-				"===FFLY===",
-				"SELL,0.3853,5",
-			},
-		},
-		{
-			name: "Test case 2",
-			input: []string{
-				"INSERT,1,FFLY,BUY,12.2,5",
-				"INSERT,2,FFLY,SELL,12.3,5",
-				"INSERT,3,FFLY,SELL,12.3,5",
-				"CANCEL,2",
-			},
-			expected: []string{
-				"===FFLY===",
-				"SELL,12.3,5",
-				"BUY,12.2,5",
-			},
-		},
-		{name: "Test case 6",
-			input: []string{
-				/*
-					[INSERT,1,FFLY,SELL,12.2,5 INSERT,2,FFLY,SELL,12.1,8, INSERT,3,FFLY,BUY,12.5,10]
-				*/
-				"INSERT,1,FFLY,SELL,12.2,5",
-				"INSERT,2,FFLY,SELL,12.1,8",
-				"INSERT,3,FFLY,BUY,12.5,10",
-			},
-
-			expected: []string{
-				"FFLY,12.1,8,3,2",
-				"FFLY,12.2,2,3,1",
-				"===FFLY===",
-				"SELL,12.2,3",
-			},
-		},
-
-		{
-			name: "test case 11",
-			input: []string{
-				"INSERT,1,FFLY,BUY,47,5",
-				"INSERT,2,FFLY,BUY,47,6",
-				"INSERT,3,FFLY,SELL,47,9", // this should be zero
-				"UPDATE,1,45,2",           // one is gone, no-op
-				"UPDATE,5,45,2",           // five is no-existent, no-op
-			},
-			expected: []string{
-				"FFLY,47,5,3,1",
-				"FFLY,47,4,3,2",
-				"===FFLY===",
-				"BUY,47,2",
-			},
-		},
+		{"both", OutputBoth, append(append([]string{}, trades...), book...)},
+		{"trades only", OutputTradesOnly, trades},
+		{"book only", OutputBookOnly, book},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			output := runMatchingEngine(tc.input)
+			output := runMatchingEngineMode(input, tc.mode)
 			if !reflect.DeepEqual(output, tc.expected) {
 				t.Errorf("Expected %v, but got %v", tc.expected, output)
 			}
 		})
 	}
 }
+
+func TestRunMatchingEngineReader(t *testing.T) {
+	input := []string{
+		"INSERT,1,FFLY,BUY,14.235,5",
+		"INSERT,2,FFLY,BUY,14.235,6",
+		"INSERT,3,FFLY,BUY,14.235,12",
+		"INSERT,4,FFLY,BUY,14.234,5",
+		"INSERT,5,FFLY,BUY,14.23,3",
+		"INSERT,6,FFLY,SELL,14.237,8",
+		"INSERT,7,FFLY,SELL,14.24,9",
+		"CANCEL,1",
+		"INSERT,8,FFLY,SELL,14.234,25",
+		"INSERT,9,ETH,BUY,412,31",
+	}
+	reader := bufio.NewReader(strings.NewReader(strings.Join(input, "\n") + "\n"))
+
+	output, err := runMatchingEngineReader(reader, len(input))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := runMatchingEngine(input); !reflect.DeepEqual(output, expected) {
+		t.Errorf("Expected %v, but got %v", expected, output)
+	}
+}
+
+func TestRunMatchingEngineReaderTruncatedInput(t *testing.T) {
+	input := []string{
+		"INSERT,1,FFLY,BUY,47,5",
+		"INSERT,2,FFLY,SELL,47,3",
+		"INSERT,3,FFLY,SELL,48,1",
+	}
+	// no trailing newline: the last line must still be applied
+	reader := bufio.NewReader(strings.NewReader(strings.Join(input, "\n")))
+
+	output, err := runMatchingEngineReader(reader, 10)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected io.ErrUnexpectedEOF, got %v", err)
+	}
+	if expected := runMatchingEngine(input); !reflect.DeepEqual(output, expected) {
+		t.Errorf("Expected the output of the lines read %v, but got %v", expected, output)
+	}
+}
+
+func BenchmarkMainBuffered(b *testing.B) {
+	input := strings.Join(largeOperations(20000), "\n") + "\n"
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reader := bufio.NewReader(strings.NewReader(input))
+		var operations []string
+		for j := 0; j < 20000; j++ {
+			operation, _ := readLine(reader)
+			operations = append(operations, operation)
+		}
+		runMatchingEngine(operations)
+	}
+}
+
+func BenchmarkMainStreaming(b *testing.B) {
+	input := strings.Join(largeOperations(20000), "\n") + "\n"
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		runMatchingEngineReader(bufio.NewReader(strings.NewReader(input)), 20000)
+	}
+}
+
+func TestRunMatchingEngineSameIDAcrossSymbols(t *testing.T) {
+	// IDs are only unique per symbol: order 1 exists in both ETH and FFLY
+	input := []string{
+		"INSERT,1,FFLY,BUY,10,5",
+		"INSERT,1,ETH,BUY,400,5",
+		"INSERT,2,DOT,SELL,21,8",
+		"UPDATE,1,11,6",
+		"CANCEL,1",
+	}
+	// both operations resolve to the alphabetically first symbol holding the ID: the update moves ETH to 11 and the
+	// cancel removes it, FFLY is untouched
+	expected := []string{
+		"===DOT===",
+		"SELL,21,8",
+		"===ETH===",
+		"===FFLY===",
+		"BUY,10,5",
+	}
+	for i := 0; i < 50; i++ {
+		if output := runMatchingEngine(input); !reflect.DeepEqual(output, expected) {
+			t.Fatalf("Run %d: expected %v, but got %v", i, expected, output)
+		}
+	}
+}
+
+func TestRunMatchingEngineCtx(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ops := make(chan string)
+	out := make(chan Trade, 10)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- RunMatchingEngineCtx(ctx, ops, out)
+	}()
+
+	ops <- "INSERT,1,FFLY,BUY,10,5"
+	ops <- "INSERT,2,FFLY,SELL,10,3"
+	if trade := <-out; trade != (Trade{ID: 1, Symbol: "FFLY", Price: 10, Volume: 3, TakerID: 2, MakerID: 1, AggressorSide: "SELL"}) {
+		t.Errorf("Unexpected trade %+v", trade)
+	}
+
+	cancel()
+	select {
+	case err := <-errs:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("RunMatchingEngineCtx didn't stop after cancellation")
+	}
+
+	// nothing reads ops anymore
+	select {
+	case ops <- "INSERT,3,FFLY,SELL,10,2":
+		t.Error("Expected no operation to be processed after cancellation")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestRunMatchingEngineCtxClosedInput(t *testing.T) {
+	ops := make(chan string, 3)
+	out := make(chan Trade, 10)
+	ops <- "INSERT,1,FFLY,BUY,10,5"
+	ops <- "INSERT,2,FFLY,SELL,9,2"
+	ops <- "INSERT,3,FFLY,SELL,10,2"
+	close(ops)
+
+	if err := RunMatchingEngineCtx(context.Background(), ops, out); err != nil {
+		t.Fatalf("Expected nil error once ops is closed, got %v", err)
+	}
+	close(out)
+	var trades []string
+	for trade := range out {
+		trades = append(trades, trade.String())
+	}
+	if expected := []string{"FFLY,10,2,2,1", "FFLY,10,2,3,1"}; !reflect.DeepEqual(trades, expected) {
+		t.Errorf("Expected trades %v, got %v", expected, trades)
+	}
+}
+
+func TestOpenOutput(t *testing.T) {
+	w, err := openOutput("")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if stdout, ok := w.(nopWriteCloser); !ok || stdout.Writer != os.Stdout {
+		t.Errorf("Expected an unset OUTPUT_PATH to fall back to os.Stdout, got %T", w)
+	}
+	if err := w.Close(); err != nil {
+		t.Errorf("Closing the stdout fallback must be a no-op, got %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "output.txt")
+	w, err = openOutput(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	io.WriteString(w, "FFLY,10,1,2,1\n")
+	w.Close()
+	if content, _ := os.ReadFile(path); string(content) != "FFLY,10,1,2,1\n" {
+		t.Errorf("Expected the output to be written to %s, got %q", path, content)
+	}
+
+	if _, err := openOutput(filepath.Join(t.TempDir(), "missing", "output.txt")); err == nil {
+		t.Errorf("Expected an error for a path in a missing directory")
+	}
+}
+
+// FuzzRunMatchingEngine feeds the engine newline separated operation lines, seeded with the TestRunMatchingEngine cases
+// and mutated into both valid and malformed operations. Whatever the input, the engine must not panic and its output
+// must be well formed: trade lines first, then per symbol summaries whose books aren't crossed, any PRINT summary
+// coming between trade lines.
+func FuzzRunMatchingEngine(f *testing.F) {
+	for _, tc := range runMatchingEngineCases {
+		f.Add(strings.Join(tc.input, "\n"))
+	}
+	f.Add(strings.Join(largeOperations(40), "\n"))
+	f.Add("INSERT,1,FFLY,BUY,47\nUPDATE,1\nCANCEL\nINSERT,x,FFLY,SELL,47,5\nDELETE,1")
+	// prices that aren't positive and finite must never rest, or they would leave the book crossed
+	f.Add("INSERT,1,FFLY,BUY,NaN,5\nINSERT,2,FFLY,BUY,Inf,5\nINSERT,3,FFLY,SELL,-3,5\nINSERT,4,FFLY,SELL,0,5\nINSERT,5,FFLY,BUY,10,5")
+	f.Add("INSERT,1,FFLY,SELL,10,5\nUPDATE,1,NaN,5\nUPDATE,1,-Inf,5\nCXR,1,2,-3,5\nINSERT,3,FFLY,BUY,0.0,5")
+
+	f.Fuzz(func(t *testing.T, input string) {
+		output := runMatchingEngine(strings.Split(input, "\n"))
+
+		summaries := false
+		bestBuy, bestSell := math.Inf(-1), math.Inf(1)
+		checkCrossed := func() {
+			if bestBuy >= bestSell {
+				t.Fatalf("crossed book (best bid %v, best ask %v) in %q", bestBuy, bestSell, output)
+			}
+			bestBuy, bestSell = math.Inf(-1), math.Inf(1)
+		}
+		for _, line := range output {
+			if strings.HasPrefix(line, "===") && strings.HasSuffix(line, "===") && !strings.Contains(line, ",") {
+				checkCrossed()
+				summaries = true
+				continue
+			}
+			fields := strings.Split(line, ",")
+			if summaries && len(fields) == 5 {
+				// the trades following a PRINT summary
+				checkCrossed()
+				summaries = false
+			}
+			if !summaries {
+				if len(fields) != 5 {
+					t.Fatalf("malformed trade line %q", line)
+				}
+				if volume, err := strconv.Atoi(fields[2]); err != nil || volume <= 0 {
+					t.Fatalf("invalid trade volume in %q", line)
+				}
+				continue
+			}
+
+			if len(fields) != 3 || (fields[0] != "BUY" && fields[0] != "SELL") {
+				t.Fatalf("malformed summary line %q", line)
+			}
+			price, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				t.Fatalf("invalid price in %q", line)
+			}
+			if volume, err := strconv.Atoi(fields[2]); err != nil || volume <= 0 {
+				t.Fatalf("invalid level volume in %q", line)
+			}
+			if fields[0] == "BUY" {
+				bestBuy = math.Max(bestBuy, price)
+			} else {
+				bestSell = math.Min(bestSell, price)
+			}
+		}
+		checkCrossed()
+	})
+}
+
+func TestRunMatchingEngineInputFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "operations.csv")
+	content := "3\nINSERT,1,FFLY,BUY,45,5\nINSERT,2,FFLY,SELL,45,2\nINSERT,3,FFLY,SELL,46,1\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	input, err := openInput(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer input.Close()
+	output, err := runMatchingEngineInput(input)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []string{"FFLY,45,2,2,1", "===FFLY===", "SELL,46,1", "BUY,45,3"}
+	if !reflect.DeepEqual(output, expected) {
+		t.Errorf("Expected %v, got %v", expected, output)
+	}
+
+	if _, err := openInput(filepath.Join(t.TempDir(), "missing.csv")); err == nil {
+		t.Errorf("Expected an error for a missing input file")
+	}
+	for _, bad := range []string{"", "three\nINSERT,1,FFLY,BUY,45,5\n"} {
+		if _, err := runMatchingEngineInput(strings.NewReader(bad)); !errors.Is(err, ErrInvalidOperationsCount) {
+			t.Errorf("Expected ErrInvalidOperationsCount for %q, got %v", bad, err)
+		}
+	}
+}
+
+func TestWriteResults(t *testing.T) {
+	result := []string{"FFLY,47,3,6,5", "===FFLY===", "BUY,47,2"}
+	tests := []struct {
+		name            string
+		result          []string
+		separator       string
+		trailingNewline bool
+		expected        string
+	}{
+		{"lf with trailing newline", result, "\n", true, "FFLY,47,3,6,5\n===FFLY===\nBUY,47,2\n"},
+		{"lf without trailing newline", result, "\n", false, "FFLY,47,3,6,5\n===FFLY===\nBUY,47,2"},
+		{"crlf with trailing newline", result, "\r\n", true, "FFLY,47,3,6,5\r\n===FFLY===\r\nBUY,47,2\r\n"},
+		{"crlf without trailing newline", result, "\r\n", false, "FFLY,47,3,6,5\r\n===FFLY===\r\nBUY,47,2"},
+		{"empty result", nil, "\n", true, "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeResults(bufio.NewWriter(&buf), tt.result, tt.separator, tt.trailingNewline); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if buf.String() != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, buf.String())
+			}
+		})
+	}
+}
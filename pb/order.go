@@ -0,0 +1,49 @@
+// Package pb holds the wire types of the order book's gRPC API. They mirror the messages of order.proto:
+//
+//	enum Side {
+//	  SIDE_UNSPECIFIED = 0;
+//	  SIDE_BUY = 1;
+//	  SIDE_SELL = 2;
+//	}
+//
+//	message Order {
+//	  int64 id = 1;
+//	  string symbol = 2;
+//	  Side side = 3;
+//	  int64 price = 4;  // price in units of 1/PriceScale
+//	  int64 volume = 5;
+//	}
+//
+// They are hand-written to keep the module free of the protobuf runtime; the field names and types follow what
+// protoc-gen-go generates, so services can switch to the generated code without touching the adapters.
+package pb
+
+// PriceScale is the number of price units per currency unit: prices travel as integers to avoid float rounding on the
+// wire, and 4 decimals is the finest price the engine accepts.
+const PriceScale = 10000
+
+// Side is the side of an order.
+type Side int32
+
+const (
+	Side_SIDE_UNSPECIFIED Side = 0
+	Side_SIDE_BUY         Side = 1
+	Side_SIDE_SELL        Side = 2
+)
+
+// Order is a limit order as sent over the wire.
+type Order struct {
+	Id     int64
+	Symbol string
+	Side   Side
+	Price  int64 // scaled by PriceScale, e.g. 23.45 is 234500
+	Volume int64
+}
+
+// GetSide returns the side of o, SIDE_UNSPECIFIED for a nil order.
+func (o *Order) GetSide() Side {
+	if o == nil {
+		return Side_SIDE_UNSPECIFIED
+	}
+	return o.Side
+}
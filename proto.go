@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/adonese/bluefin/pb"
+)
+
+// ErrInvalidProtoOrder is returned when a pb.Order can't be mapped to an Order.
+var ErrInvalidProtoOrder = errors.New("invalid proto order")
+
+// protoSides maps the wire sides to the engine's sides. SIDE_UNSPECIFIED, like any unknown value, is rejected.
+var protoSides = map[pb.Side]string{
+	pb.Side_SIDE_BUY:  "BUY",
+	pb.Side_SIDE_SELL: "SELL",
+}
+
+// OrderFromProto maps a gRPC order into an Order that can be fed directly into OrderBook.Insert, skipping the CSV
+// layer. The scaled integer price is converted back to a float price, IDs and volumes must fit an int.
+func OrderFromProto(p *pb.Order) (*Order, error) {
+	if p == nil {
+		return nil, fmt.Errorf("%w: nil order", ErrInvalidProtoOrder)
+	}
+	side, ok := protoSides[p.GetSide()]
+	if !ok {
+		return nil, fmt.Errorf("%w: %w: %d", ErrInvalidProtoOrder, ErrInvalidSide, p.GetSide())
+	}
+	if p.Id != int64(int(p.Id)) || p.Volume != int64(int(p.Volume)) {
+		return nil, fmt.Errorf("%w: id %d or volume %d overflows an int", ErrInvalidProtoOrder, p.Id, p.Volume)
+	}
+	return &Order{
+		ID:     int(p.Id),
+		Symbol: p.Symbol,
+		Side:   side,
+		Price:  float64(p.Price) / pb.PriceScale,
+		Volume: int(p.Volume),
+	}, nil
+}
+
+// ToProto maps the order into its gRPC form, scaling the price to an integer number of 1/pb.PriceScale units.
+func (o *Order) ToProto() *pb.Order {
+	var side pb.Side
+	switch o.Side {
+	case "BUY":
+		side = pb.Side_SIDE_BUY
+	case "SELL":
+		side = pb.Side_SIDE_SELL
+	}
+	return &pb.Order{
+		Id:     int64(o.ID),
+		Symbol: o.Symbol,
+		Side:   side,
+		Price:  int64(math.Round(o.Price * pb.PriceScale)),
+		Volume: int64(o.Volume),
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/adonese/bluefin/pb"
+)
+
+func TestOrderProtoRoundTrip(t *testing.T) {
+	testCases := []struct {
+		name  string
+		order *Order
+		proto *pb.Order
+	}{
+		{
+			name:  "buy",
+			order: &Order{ID: 4, Symbol: "FFLY", Side: "BUY", Price: 23.45, Volume: 12},
+			proto: &pb.Order{Id: 4, Symbol: "FFLY", Side: pb.Side_SIDE_BUY, Price: 234500, Volume: 12},
+		},
+		{
+			name:  "sell",
+			order: &Order{ID: 7, Symbol: "ETH", Side: "SELL", Price: 2.1427, Volume: 3},
+			proto: &pb.Order{Id: 7, Symbol: "ETH", Side: pb.Side_SIDE_SELL, Price: 21427, Volume: 3},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			proto := tc.order.ToProto()
+			if !reflect.DeepEqual(proto, tc.proto) {
+				t.Errorf("Expected %+v, got %+v", tc.proto, proto)
+			}
+			order, err := OrderFromProto(proto)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(order, tc.order) {
+				t.Errorf("Expected the round trip to give %+v, got %+v", tc.order, order)
+			}
+		})
+	}
+}
+
+func TestOrderFromProtoRejectsUnknownSides(t *testing.T) {
+	for _, side := range []pb.Side{pb.Side_SIDE_UNSPECIFIED, 3, -1} {
+		_, err := OrderFromProto(&pb.Order{Id: 1, Symbol: "FFLY", Side: side, Price: 10000, Volume: 1})
+		if !errors.Is(err, ErrInvalidProtoOrder) || !errors.Is(err, ErrInvalidSide) {
+			t.Errorf("Expected side %d to be rejected, got %v", side, err)
+		}
+	}
+	if _, err := OrderFromProto(nil); !errors.Is(err, ErrInvalidProtoOrder) {
+		t.Errorf("Expected a nil order to be rejected, got %v", err)
+	}
+}
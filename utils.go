@@ -21,7 +21,7 @@ Subtleties and Nuances
 Order Updates: An order update that changes the price or volume requires removing and re-inserting the order in the heap to maintain the correct order. When volume decreases, that is considered as if a trade has occured, so it won't affect an item's place in the heap.
 Timestamps: When making an update that requires a `reinsertion`, we use a timestamp to trigger a correct reorder in the respective heap `.Less` method.
 A VERY IMPORTANT NOTE: while, we always matches buyers / sellers with with the price and time priority, when we have a buy order with exactly two qualified sell orders: in that case, we match with the minimum of sell order's price (priority by time) and the buy order's price.
-ANOTHER NOTE: we discard negative updates.
+ANOTHER NOTE: we discard negative updates. An UPDATE volume is always the new absolute volume, never a delta: a zero or negative one is rejected (ErrVolumeOutOfRange) and leaves the order untouched, e.g. UPDATE,2,47,-1 neither reduces nor cancels order 2. Reducing an order by some volume is the explicit Reduce.
 
 Implementation Notes
 Concurrency Considerations: The current implementation is not a concurrent code, but it is still fast enough to pass the tests' time requirements.
@@ -30,24 +30,38 @@ Error Handling: Robust error handling is implemented to manage scenarios such as
 Unit Testing: The code is thoroughly tested with a variety of scenarios to ensure correctness and robustness.
 
 Future Enhancements
-Performance Optimization: maintain the order's index in the heap to avoid linear search in the heap for reinsertion.
+Performance Optimization: orders carry their HeapIndex, which volume updates use to re-sift with heap.Fix; cancels and reprices could use it too, to avoid the linear search in the heap.
 The code alogn with the tests can be found in this repo: https://github.com/adonese/hft
 */
 package main
 
 import (
 	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"hash/fnv"
 	"io"
 	"log"
+	"log/slog"
+	"maps"
+	"math"
+	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"text/tabwriter"
 	"time"
 )
 
 // insertOrderIntoHeap inserts a new order into the respective heap based on its side (BUY or SELL).
 func (ob *OrderBook) insertOrderIntoHeap(order *Order) {
+	order.tieBreak = ob.tieBreak
+	order.tolerance = ob.priceTolerance()
 	// Determine which heap to insert the order into based on the order's side
 	if order.Side == "BUY" {
 
@@ -69,48 +83,51 @@ func (ob *OrderBook) insertOrderIntoHeap(order *Order) {
 // - maintaining heap indices in the order struct
 // - using our order map to find the order's index in the heap
 // But doing that will require more book keeping in heap.Swap for respective heaps (buyers, sellers)
+//
+// Every heap entry carrying the order's ID is removed, not only the first one. Insert rejects the IDs of live orders,
+// but books built around it (e.g. heaps filled by hand) may still hold a stale entry next to the one in the Orders map,
+// and leaving it behind would let it be matched.
 func (ob *OrderBook) removeOrderFromHeap(order *Order) {
-	var found bool
-	var index int
+	var removed int
 
-	// Determine which heap the order is in based on the order's side and find the order's index
+	// Determine which heap the order is in based on the order's side and remove its entries
 	if order.Side == "BUY" {
-		for i, o := range *ob.BuyOrders {
-			if o.ID == order.ID {
-				index = i
-				found = true
-				break
-			}
-		}
-		if found {
-			// Remove the order from the BuyOrders heap
-			heap.Remove(ob.BuyOrders, index) // Use heap.Remove for correct heap manipulation
-			ob.log.Printf("Removed order ID %d from BuyOrders heap.\n", order.ID)
+		removed = removeByID(ob.BuyOrders, func(i int) *Order { return (*ob.BuyOrders)[i] }, order.ID)
+		if removed > 0 {
+			ob.log.Printf("Removed order ID %d from BuyOrders heap (%d entries).\n", order.ID, removed)
 		}
 	} else if order.Side == "SELL" {
-		for i, o := range *ob.SellOrders {
-			if o.ID == order.ID {
-				index = i
-				found = true
-				break
-			}
-		}
-		if found {
-			// Remove the order from the SellOrders heap
-			heap.Remove(ob.SellOrders, index) // Use heap.Remove for correct heap manipulation
-			ob.log.Printf("Removed order ID %d from SellOrders heap.\n", order.ID)
+		removed = removeByID(ob.SellOrders, func(i int) *Order { return (*ob.SellOrders)[i] }, order.ID)
+		if removed > 0 {
+			ob.log.Printf("Removed order ID %d from SellOrders heap (%d entries).\n", order.ID, removed)
 		}
 	}
 
-	if !found {
+	if removed == 0 {
 		ob.log.Printf("Order ID %d not found in heap, cannot remove.\n", order.ID)
 	}
 }
 
+// removeByID removes every entry of h whose order has the given ID and returns how many were removed. heap.Remove can
+// move any element to any index, so the scan restarts from the top after each removal.
+func removeByID(h heap.Interface, at func(int) *Order, orderID int) int {
+	removed := 0
+	for i := 0; i < h.Len(); {
+		if at(i).ID != orderID {
+			i++
+			continue
+		}
+		heap.Remove(h, i) // Use heap.Remove for correct heap manipulation
+		removed++
+		i = 0
+	}
+	return removed
+}
+
 // OrderSummary generates an output the matches the expected output format for this exercise.
 type OrderSummary struct {
 	Price  float64
-	Volume int
+	Volume int64 // aggregated volume of the level, int64 so large levels can't overflow
 }
 
 type PriorityQueue []*Order
@@ -125,62 +142,165 @@ type MaxHeap []*Order
 
 // Less sorts buyers orders based on highest price and earliest inserted
 func (pq MaxHeap) Less(i, j int) bool {
+	return bidBefore(pq[i], pq[j])
+}
+
+// Less sorts sellers orders based on lowest price and earliest inserted
+func (pq MinHeap) Less(i, j int) bool {
+	return askBefore(pq[i], pq[j])
+}
+
+// bidBefore reports whether buy order a has priority over buy order b.
+func bidBefore(a, b *Order) bool {
 	// Higher price has higher priority
-	if pq[i].Price == pq[j].Price {
+	if sameLevel(a, b) {
+		// Larger volume has higher priority, if the book breaks ties by volume
+		if a.tieBreak == VolumeFirst && a.Volume != b.Volume {
+			return a.Volume > b.Volume
+		}
 		// Earlier timestamp has higher priority
-		return pq[i].Inserted.Before(pq[j].Inserted)
+		return arrivedBefore(a, b)
 	}
-	return pq[i].Price > pq[j].Price
+	return a.Price > b.Price
 }
 
-// Less sorts sellers orders based on lowest price and earliest inserted
-func (pq MinHeap) Less(i, j int) bool {
+// askBefore reports whether sell order a has priority over sell order b.
+func askBefore(a, b *Order) bool {
 	// Lower price has higher priority
-	if pq[i].Price == pq[j].Price {
+	if sameLevel(a, b) {
+		// Larger volume has higher priority, if the book breaks ties by volume
+		if a.tieBreak == VolumeFirst && a.Volume != b.Volume {
+			return a.Volume > b.Volume
+		}
 		// Earlier Inserted has higher priority
-		return pq[i].Inserted.Before(pq[j].Inserted)
+		return arrivedBefore(a, b)
+	}
+	return a.Price < b.Price
+}
+
+// arrivedBefore reports whether order a has time priority over order b: the earlier Inserted, and for equal timestamps
+// (consecutive inserts can share one on a coarse clock) the earlier arrival, so the maker picked among equal orders is
+// always the same.
+func arrivedBefore(a, b *Order) bool {
+	if !a.Inserted.Equal(b.Inserted) {
+		return a.Inserted.Before(b.Inserted)
+	}
+	return a.arrival < b.arrival
+}
+
+// sameLevel reports whether two resting orders are at the same price level, within the larger of their tolerances.
+func sameLevel(a, b *Order) bool {
+	return math.Abs(a.Price-b.Price) <= max(a.tolerance, b.tolerance)
+}
+
+// crosses reports whether a bid at buyPrice and an ask at sellPrice can trade, within the book's price tolerance.
+func (ob *OrderBook) crosses(buyPrice, sellPrice float64) bool {
+	return sellPrice <= buyPrice+ob.priceTolerance()
+}
+
+// priceTolerance is how far apart two prices may be and still be the same price for matching: half a tick, so float
+// noise (23.45 vs 23.4500000001) never prevents a cross or splits a price level, while prices a tick apart stay
+// distinct. Without a tick size it falls back to priceEpsilon.
+func (ob *OrderBook) priceTolerance() float64 {
+	if ob.TickSize > 0 {
+		return ob.TickSize / 2
+	}
+	return priceEpsilon
+}
+
+// restingQueue is a throwaway heap over a copy of one side of the book, used to walk resting orders in priority order
+// without touching the book's own heaps.
+type restingQueue struct {
+	orders []*Order
+	before func(a, b *Order) bool
+}
+
+// newRestingQueue copies the given side (BUY or SELL) of the book. The copy of a valid heap is a valid heap, so no
+// heap.Init is needed. Unknown sides give an empty queue.
+func (ob *OrderBook) newRestingQueue(side string) *restingQueue {
+	switch side {
+	case "BUY":
+		return &restingQueue{orders: append([]*Order(nil), *ob.BuyOrders...), before: bidBefore}
+	case "SELL":
+		return &restingQueue{orders: append([]*Order(nil), *ob.SellOrders...), before: askBefore}
 	}
-	return pq[i].Price < pq[j].Price
+	return &restingQueue{before: bidBefore}
+}
+
+func (q *restingQueue) Len() int           { return len(q.orders) }
+func (q *restingQueue) Less(i, j int) bool { return q.before(q.orders[i], q.orders[j]) }
+func (q *restingQueue) Swap(i, j int)      { q.orders[i], q.orders[j] = q.orders[j], q.orders[i] }
+func (q *restingQueue) Push(x any)         { q.orders = append(q.orders, x.(*Order)) }
+
+func (q *restingQueue) Pop() any {
+	n := len(q.orders)
+	x := q.orders[n-1]
+	q.orders = q.orders[:n-1]
+	return x
 }
 
 func (h MinHeap) Len() int { return len(h) }
 
 func (h MinHeap) Swap(i, j int) {
 	h[i], h[j] = h[j], h[i]
-
+	h[i].HeapIndex = i
+	h[j].HeapIndex = j
 }
 
 func (h *MinHeap) Push(x any) {
-	*h = append(*h, x.(*Order))
+	order := x.(*Order)
+	order.HeapIndex = len(*h)
+	*h = append(*h, order)
 }
 
 func (h *MinHeap) Pop() any {
 	old := *h
 	n := len(old)
 	x := old[n-1]
+	x.HeapIndex = -1
 	*h = old[0 : n-1]
 	return x
 }
 
+// Peek returns the best (lowest priced, then earliest) sell order without removing it, or false on an empty heap.
+func (h MinHeap) Peek() (*Order, bool) {
+	if len(h) == 0 {
+		return nil, false
+	}
+	return h[0], true
+}
+
 func (h MaxHeap) Len() int { return len(h) }
 
 func (h MaxHeap) Swap(i, j int) {
 	h[i], h[j] = h[j], h[i]
-
+	h[i].HeapIndex = i
+	h[j].HeapIndex = j
 }
 
 func (h *MaxHeap) Push(x any) {
-	*h = append(*h, x.(*Order))
+	order := x.(*Order)
+	order.HeapIndex = len(*h)
+	*h = append(*h, order)
 }
 
 func (h *MaxHeap) Pop() any {
 	old := *h
 	n := len(old)
 	x := old[n-1]
+	x.HeapIndex = -1
 	*h = old[0 : n-1]
 	return x
 }
 
+// Peek returns the best (highest priced, then earliest) buy order without removing it, or false on an empty heap.
+func (h MaxHeap) Peek() (*Order, bool) {
+	if len(h) == 0 {
+		return nil, false
+	}
+	return h[0], true
+}
+
 func (o *Order) String() string {
 	return fmt.Sprintf("ID=%d, Symbol=%s, Side=%s, Price=%.2f, Volume=%d, Cancelled=%v",
 		o.ID, o.Symbol, o.Side, o.Price, o.Volume, o.Cancelled)
@@ -224,7 +344,215 @@ type Order struct {
 	Price     float64
 	Volume    int
 	Inserted  time.Time // we are using timestamp to determine the priority of the order, in case of a tie
-	Cancelled bool
+	ExpiresAt time.Time // good-till-date expiry, the zero value means the order never expires
+	// TimeInForce tells how long the order may rest, the zero value behaves as GTC.
+	TimeInForce TimeInForce
+	Hidden      bool // dark order: matches normally but is never shown in the book summary
+	// DisplayPrice, when set, is the price the order is shown at in the visible book (summary, Depth, level diffs)
+	// instead of Price. Matching always uses Price. It must be a valid price, no better than Price (at or below it for
+	// a bid, at or above it for an ask) and within the book's PriceBand of Price.
+	DisplayPrice *float64
+	// Peak makes the order an iceberg: at most Peak of its volume is displayed (and matched) at a time, the rest
+	// waits in Reserve and refills Volume each time it is exhausted. 0 makes a plain order.
+	Peak          int
+	Reserve       int
+	ReservePolicy ReservePolicy // what a refill does to the order's time priority
+	// Peg makes the order follow a reference price of the book, plus PegOffset, instead of resting at a fixed Price.
+	Peg       PegType
+	PegOffset float64
+	// MinFill is the least volume the order must be able to trade for it to trade at all, between FOK (all of it) and
+	// the default (any of it). It is checked each time the order initiates matching (insert, update): if the crossing
+	// volume falls short, the order doesn't trade and rests, or is cancelled if it is IOC. A crossing order resting
+	// this way leaves the book crossed, and the next matching of the book may trade it regardless of its MinFill.
+	MinFill int
+	// ReduceOnly marks an order that must not add to its owner's position: it behaves like IOC, its remainder is
+	// cancelled (Expired) after matching, unless the book's position checker (see WithPositionChecker) lets it rest.
+	ReduceOnly bool
+	// TopOfBookOnly marks a quote that only wants to rest at the top of the book: after matching, its remainder is
+	// cancelled (Expired) unless it becomes the new best bid (ask) on its own, strictly better than every other order
+	// of its side, or the side was empty. Joining the current best price isn't enough. It is only checked on insertion.
+	TopOfBookOnly bool
+	Account       string // trader owning the order, used by the self trade checks; empty for anonymous orders
+	Cancelled     bool
+	// CancelReason records why the order left the book, it stays empty while the order is live. It is set once: the
+	// first removal wins and later cancels don't overwrite it.
+	CancelReason CancelReason
+
+	// HeapIndex is the order's position in its side's heap, kept up to date by MinHeap and MaxHeap (-1 once popped).
+	// It lets a changed order be re-sifted in place with heap.Fix instead of searched for.
+	HeapIndex int
+
+	tieBreak  TieBreak // tie break of the book the order rests in, set when it enters a heap
+	tolerance float64  // price tolerance of the book the order rests in, see priceTolerance
+	arrival   int64    // arrival sequence number, stamped with Inserted, breaks ties between equal Inserted
+}
+
+// TimeInForce tells how long an order may rest on the book.
+type TimeInForce string
+
+const (
+	GTC TimeInForce = "GTC" // good till cancelled: rests until filled or cancelled, the default
+	DAY TimeInForce = "DAY" // rests until the end of the trading session, see EndSession
+	IOC TimeInForce = "IOC" // immediate or cancel: trades what it can on insertion, the remainder is cancelled (Expired)
+)
+
+// ReservePolicy decides what refilling an iceberg order from its reserve does to its time priority.
+type ReservePolicy int
+
+const (
+	LosePriority ReservePolicy = iota // iceberg: each refill is timestamped anew and queues behind its price level
+	KeepPriority                      // reserve order: refills keep the original timestamp, and so the order's place
+)
+
+// replenish refills the displayed volume of an exhausted iceberg order from its reserve, by up to its Peak, and
+// reports whether it did. The caller is responsible for re-sifting the order in its heap.
+func (ob *OrderBook) replenish(order *Order) bool {
+	if order.Volume > 0 || order.Reserve <= 0 || order.Peak <= 0 {
+		return false
+	}
+	order.Volume = min(order.Peak, order.Reserve)
+	order.Reserve -= order.Volume
+	if order.ReservePolicy == LosePriority {
+		ob.stamp(order)
+	}
+	ob.log.Printf("Replenished order %d with %d, %d left in reserve\n", order.ID, order.Volume, order.Reserve)
+	return true
+}
+
+// PegType is the reference price a pegged order follows.
+type PegType int
+
+const (
+	NoPeg   PegType = iota // a plain order resting at its Price
+	BestBid                // the best bid
+	BestAsk                // the best ask
+	Mid                    // the middle of the best bid and the best ask
+)
+
+// repeg moves every pegged order to its peg price (see pegPrice) through update, so a repeg is like any other price
+// update: the order loses its time priority and may trade. The exported methods changing the book run it once they are
+// done. Pegged orders don't count in the reference prices, but the trades of a repeg can move them, hence the repeated
+// passes until nothing moves (at most one per pegged order, which is enough as each pass fills some order).
+func (ob *OrderBook) repeg() {
+	for pass := 0; pass <= len(ob.pegged); pass++ {
+		live := ob.pegged[:0]
+		for _, order := range ob.pegged {
+			if order.CancelReason == "" && ob.Orders[order.ID] == order {
+				live = append(live, order)
+			}
+		}
+		clear(ob.pegged[len(live):])
+		ob.pegged = live
+
+		moved := false
+		for _, order := range ob.pegged {
+			price, ok := ob.pegPrice(order)
+			if order.CancelReason != "" || !ok || math.Abs(price-order.Price) <= ob.priceTolerance() {
+				continue
+			}
+			ob.log.Printf("Repegging order %d from %s to %s\n", order.ID, formatFloat(order.Price), formatFloat(price))
+			if _, err := ob.update(order.ID, price, order.Volume); err != nil {
+				ob.log.Printf("Could not repeg order %d: %v\n", order.ID, err)
+				continue
+			}
+			moved = true
+		}
+		if !moved {
+			return
+		}
+	}
+}
+
+// pegPrice returns the price a pegged order should rest at: its reference price plus its PegOffset, snapped to the tick
+// grid away from the other side (down for bids, up for asks). It reports false when the reference doesn't exist, e.g.
+// no bid for BestBid, in which case the order stays where it is.
+func (ob *OrderBook) pegPrice(order *Order) (float64, bool) {
+	bid, hasBid := ob.bestUnpegged("BUY")
+	ask, hasAsk := ob.bestUnpegged("SELL")
+
+	var reference float64
+	switch {
+	case order.Peg == BestBid && hasBid:
+		reference = bid
+	case order.Peg == BestAsk && hasAsk:
+		reference = ask
+	case order.Peg == Mid && hasBid && hasAsk:
+		reference = (bid + ask) / 2
+	default:
+		return 0, false
+	}
+
+	price := ob.snapToTick(reference+order.PegOffset, order.Side == "BUY")
+	return price, price > 0
+}
+
+// snapToTick moves a price off the tick grid to the closest tick below (down) or above it. Prices already on the grid,
+// up to float noise, and books without a tick size are left alone.
+func (ob *OrderBook) snapToTick(price float64, down bool) float64 {
+	if ob.TickSize <= 0 {
+		return price
+	}
+	ticks := price / ob.TickSize
+	if down {
+		ticks = math.Floor(ticks + 1e-6)
+	} else {
+		ticks = math.Ceil(ticks - 1e-6)
+	}
+	// formatting drops the float noise of the multiplication (e.g. 455 * 0.1)
+	price, _ = strconv.ParseFloat(strconv.FormatFloat(ticks*ob.TickSize, 'f', 8, 64), 64)
+	return price
+}
+
+// bestUnpegged returns the best price of the live, not pegged, orders of side.
+func (ob *OrderBook) bestUnpegged(side string) (best float64, ok bool) {
+	orders := []*Order(*ob.SellOrders)
+	if side == "BUY" {
+		orders = *ob.BuyOrders
+	}
+	for _, order := range orders {
+		if order.Cancelled || order.Peg != NoPeg {
+			continue
+		}
+		if !ok || (side == "BUY" && order.Price > best) || (side == "SELL" && order.Price < best) {
+			best, ok = order.Price, true
+		}
+	}
+	return best, ok
+}
+
+// TieBreak decides which of two resting orders at the same price is matched first.
+//
+// Note that TestComplexOrderFlowTestCase5 expects TimeFirst: order 1 (volume 3) is the maker for order 5 although
+// order 3 (volume 12) rests at the same price, and order 3 only becomes the maker of order 7 because order 1 lost its
+// time priority by increasing its volume, not because order 3 is the largest.
+type TieBreak int
+
+const (
+	TimeFirst   TieBreak = iota // earliest Inserted first: plain price-time priority, the default
+	VolumeFirst                 // larger remaining volume first, then earliest Inserted
+)
+
+// CancelReason tells why an order left the book.
+type CancelReason string
+
+const (
+	UserCancel          CancelReason = "USER_CANCEL"           // cancelled by the client
+	Expired             CancelReason = "EXPIRED"               // its good-till-date, session, immediate-or-cancel, reduce-only or top-of-book-only ran out
+	SelfTradePrevention CancelReason = "SELF_TRADE_PREVENTION" // removed to avoid trading against the same trader
+	FullyFilled         CancelReason = "FULLY_FILLED"          // its whole volume traded
+	Replaced            CancelReason = "REPLACED"              // cancelled by a Replace with a new order
+	OneCancelsOther     CancelReason = "OCO"                   // cancelled because the other leg of its OCO pair traded
+)
+
+// OrderStatus is a read-only snapshot of an order. It is a copy, so callers can inspect it without racing the book or
+// accidentally mutating a resting order.
+type OrderStatus struct {
+	Order
+}
+
+// status takes a snapshot of the order.
+func (o *Order) status() OrderStatus {
+	return OrderStatus{Order: *o}
 }
 
 func (pq PriorityQueue) Less(i, j int) bool {
@@ -241,395 +569,3553 @@ type OrderBook struct {
 	SellOrders *MinHeap
 	Orders     map[int]*Order
 	Trades     []string
-	log        log.Logger // embed a log for logging and tracing
+	Executions []Trade // typed counterpart of Trades, one entry per executed trade
+	TickSize   float64 // minimum price increment, every order price must be a multiple of it
+	MinVolume  int     // smallest accepted order volume, 0 means no lower bound
+	MaxVolume  int     // largest accepted order volume, 0 means no upper bound
+	LotSize    int     // every order volume must be a multiple of it, 0 disables the check
+	PriceBand  float64 // allowed distance from LastPrice in percent, 0 disables the band
+	LastPrice  float64 // price of the most recent trade, 0 until the first trade
+	log        Logger  // logger for tracing, the standard logger by default
+
+	// DisplayPrecision, when set, is the exact number of decimals prices are printed with in the trade and summary
+	// lines (e.g. 2 prints 46.00 and 45.95). nil keeps the natural formatting of formatFloat.
+	DisplayPrecision *int
+
+	nextTradeID   int            // ID of the next executed trade, starting at 1
+	arrivals      int64          // arrival sequence number of the last stamped order, see stamp
+	fees          FeeModel       // maker and taker fees of every trade
+	priority      PriorityPolicy // whether volume increases lose time priority
+	summaryOrder  SummaryOrder   // how the ask levels are sorted in the summary
+	tieBreak      TieBreak       // which of two orders at the same price is matched first
+	selfTrade     SelfTradeMode  // what to do with an order crossing a resting order of the same account
+	journal       io.Writer      // trade journal every trade is written to as it executes, nil disables it
+	halted        bool           // trading halt: no trade executes until Resume
+	inAuction     bool           // auction call phase: like a halt, but crossing orders are always collected
+	maxOrders     int            // most live resting orders the book holds, 0 means no limit
+	allocation    Allocation     // how an incoming order's volume is shared among the orders of a price level
+	rounding      RoundingMode   // how pro-rata shares are rounded to whole volumes
+	haltMode      HaltMode       // what happens to crossing orders during a halt
+	verboseTrades bool           // append the taker and maker residual volumes to every trade line
+	// executionPrice is the price crossing orders trade at, see WithExecutionPrice
+	executionPrice ExecutionPrice
+	// maxFills caps the fills of one matching invocation, 0 means no cap; pending is the matching paused by the cap,
+	// see WithMaxFillsPerMatch and ContinueMatching
+	maxFills int
+	pending  *pendingMatch
+	// positionCheck decides whether the remainder of a reduce-only order may rest, see WithPositionChecker
+	positionCheck func(order OrderStatus) bool
+	// bustReinstates gives the volume of a busted trade back to its maker and taker, see WithBustReinstatement
+	bustReinstates bool
+
+	// levelDiffs enables the recording of the price level changes returned by DiffSince: levels is the visible volume
+	// per level as of the last change, seq the sequence number of the last change.
+	levelDiffs   bool
+	levels       map[levelKey]int64
+	levelChanges []LevelChange
+	seq          int64
+
+	// pegged lists the pegged orders inserted so far, see repeg. Orders leaving the book are pruned on the next pass.
+	pegged []*Order
+
+	// oco links each leg of a one-cancels-other pair to the other leg, see InsertOCO.
+	oco        map[*Order]*Order
+	ocoTrigger OCOTrigger
+
+	// accounts indexes the orders inserted per Account. Orders leaving the book are pruned lazily, when the index of
+	// their account is next walked.
+	accounts map[string]map[int]*Order
+
+	// mu guards the book for callers sharing it across goroutines (e.g. the expiry sweeper). The exported methods take
+	// the lock, the unexported ones they delegate to assume it is already held.
+	mu        sync.RWMutex
+	clock     func() time.Time                               // source of the Inserted timestamps, time.Now by default
+	latency   func(op string, d time.Duration)               // latency recorder of Insert, Update and Cancel, nil when off
+	newTicker func(time.Duration) (<-chan time.Time, func()) // ticker used by StartExpiry, swapped in tests
+}
+
+// DefaultTickSize is the minimum price increment implied by the "maximum of 4 digits behind the ." rule.
+const DefaultTickSize = 0.0001
+
+var (
+	// ErrInvalidSide is returned for orders whose side is neither BUY nor SELL.
+	ErrInvalidSide = errors.New("order side must be BUY or SELL")
+	// ErrInvalidPrice is returned for orders whose price is not a positive finite number (zero, negative, NaN or ±Inf).
+	ErrInvalidPrice = errors.New("price must be positive and finite")
+	// ErrInvalidTick is returned for orders whose price is not a multiple of the book's tick size.
+	ErrInvalidTick = errors.New("price is not a multiple of the tick size")
+	// ErrVolumeOutOfRange is returned for orders whose volume is outside the book's size limits.
+	ErrVolumeOutOfRange = errors.New("volume outside the allowed size limits")
+	// ErrBookFull is returned for orders that would rest on a book already holding its maximum number of orders.
+	ErrBookFull = errors.New("book is full")
+	// ErrHalted is returned under RejectDuringHalt for orders that would cross the book while trading is halted.
+	ErrHalted = errors.New("trading is halted")
+	// ErrSelfCross is returned under RejectIncoming for orders crossing a resting order of their own account.
+	ErrSelfCross = errors.New("order crosses a resting order of the same account")
+	// ErrInvalidLot is returned for orders whose volume is not a multiple of the book's lot size.
+	ErrInvalidLot = errors.New("volume is not a multiple of the lot size")
+	// ErrCrossedBook is returned when a set of resting orders would trade against each other.
+	ErrCrossedBook = errors.New("book is crossed")
+	// ErrDuplicateOrder is returned when an order ID is already known to the book.
+	ErrDuplicateOrder = errors.New("duplicate order id")
+	// ErrOutsidePriceBand is returned for orders priced too far away from the last traded price.
+	ErrOutsidePriceBand = errors.New("price outside the allowed price band")
+	// ErrInvalidDisplayPrice is returned for orders whose DisplayPrice is not a valid price or too far from Price.
+	ErrInvalidDisplayPrice = errors.New("invalid display price")
+)
+
+// Trade is an executed match between an incoming (taker) order and a resting (maker) order.
+type Trade struct {
+	ID      int // unique per book, increasing by one for every trade
+	Symbol  string
+	Price   float64
+	Volume  int
+	TakerID int
+	MakerID int
+	// AggressorSide is the side (BUY or SELL) of the taker: BUY for a buyer initiated trade, SELL for a seller
+	// initiated one.
+	AggressorSide string
+	// Busted marks a trade cancelled after the fact by BustTrade. It stays in Executions for the record, but no longer
+	// counts in Stats.
+	Busted bool
+	// IsWash flags a wash trade: the maker and the taker belong to the same (non empty) Account. It is purely
+	// informational, preventing such trades is WithSelfTradeMode's job.
+	IsWash bool
+	// MakerFee and TakerFee are the fees charged to each side of the trade by the book's FeeModel.
+	MakerFee float64
+	TakerFee float64
+}
+
+// FeeModel computes the fee charged to one side of a trade. It is called twice per trade, for the maker and the taker.
+type FeeModel interface {
+	Fee(trade Trade, isMaker bool) float64
+}
+
+// ZeroFees is the default FeeModel, trading is free.
+type ZeroFees struct{}
+
+func (ZeroFees) Fee(Trade, bool) float64 { return 0 }
+
+// FlatFees charges a fixed rate of the traded notional (price × volume), e.g. 0.001 for 0.1%.
+type FlatFees struct {
+	MakerRate float64
+	TakerRate float64
+}
+
+func (f FlatFees) Fee(trade Trade, isMaker bool) float64 {
+	rate := f.TakerRate
+	if isMaker {
+		rate = f.MakerRate
+	}
+	return trade.Price * float64(trade.Volume) * rate
+}
+
+// String formats the trade in the expected output format: <symbol>,<price>,<volume>,<taker_order_id>,<maker_order_id>
+func (t Trade) String() string {
+	return t.format(formatFloat(t.Price))
+}
+
+// format formats the trade like String, with the price already formatted by the caller.
+func (t Trade) format(price string) string {
+	return fmt.Sprintf("%s,%s,%d,%d,%d", t.Symbol, price, t.Volume, t.TakerID, t.MakerID)
 }
+
 type OrderBookOption func(*OrderBook)
-type OrderBooks map[string]*OrderBook
 
-func NewOrderBooks() OrderBooks {
-	return make(OrderBooks)
+// OrderBooks holds one OrderBook per symbol. Books are created lazily on the first insert for their symbol, with the
+// default options the OrderBooks was created with, followed by the symbol's registered configuration if any.
+type OrderBooks struct {
+	books    map[string]*OrderBook
+	defaults []OrderBookOption       // applied to every book created on first insert of its symbol
+	symbols  map[string]SymbolConfig // registered symbols, see RegisterSymbol
+	strict   bool                    // reject inserts for symbols that were not registered
+	globalID bool                    // order IDs are unique across every symbol
+	ids      map[int]string          // symbol of every order ID inserted, maintained with globalID
+	decimals int                     // most decimals a price of an operation line may have, see WithPriceDecimals
+	// contingent holds the orders waiting for their spread trigger, by order ID, see InsertContingent
+	contingent map[int]contingentOrder
 }
 
-func WithLogger(logger log.Logger) OrderBookOption {
-	return func(ob *OrderBook) {
-		ob.log = logger
+// SymbolConfig is the per-symbol configuration registered with RegisterSymbol. Zero fields keep the OrderBooks
+// defaults.
+type SymbolConfig struct {
+	TickSize  float64 // minimum price increment, see WithTickSize
+	LotSize   int     // volumes must be a multiple of it, see WithLotSize
+	PriceBand float64 // allowed distance from the last price in percent, see WithPriceBand
+}
+
+// options turns the configuration into the options applied on top of the defaults.
+func (cfg SymbolConfig) options() []OrderBookOption {
+	var opts []OrderBookOption
+	if cfg.TickSize > 0 {
+		opts = append(opts, WithTickSize(cfg.TickSize))
+	}
+	if cfg.LotSize > 0 {
+		opts = append(opts, WithLotSize(cfg.LotSize))
+	}
+	if cfg.PriceBand > 0 {
+		opts = append(opts, WithPriceBand(cfg.PriceBand))
 	}
+	return opts
 }
 
-func NewOrderBook(options ...OrderBookOption) *OrderBook {
-	ob := &OrderBook{
-		BuyOrders:  &MaxHeap{},
-		SellOrders: &MinHeap{},
-		log:        *log.Default(),
-		Orders:     make(map[int]*Order),
-		Trades:     make([]string, 0),
+// ErrUnknownSymbol is returned in strict mode for inserts of a symbol that was not registered, and for operations
+// targeting a symbol that has no book yet.
+var ErrUnknownSymbol = errors.New("unknown symbol")
+
+// NewOrderBooks creates an empty set of order books. The options (logger, tick size, ...) are applied to every symbol
+// book created afterwards.
+func NewOrderBooks(opts ...OrderBookOption) OrderBooks {
+	return OrderBooks{
+		books:    make(map[string]*OrderBook),
+		defaults: opts,
+		symbols:  make(map[string]SymbolConfig),
+		ids:      make(map[int]string),
+		decimals: DefaultPriceDecimals,
+
+		contingent: make(map[int]contingentOrder),
 	}
+}
 
-	for _, option := range options {
-		option(ob)
+// DefaultPriceDecimals is the "maximum of 4 digits behind the ." rule of the operation lines.
+const DefaultPriceDecimals = 4
+
+// WithPriceDecimals returns the OrderBooks accepting operation lines whose prices have at most decimals digits behind
+// the ".", instead of DefaultPriceDecimals. Lines with more precise prices are rejected as malformed when parsed.
+func (obs OrderBooks) WithPriceDecimals(decimals int) OrderBooks {
+	obs.decimals = decimals
+	return obs
+}
+
+// WithGlobalUniqueIDs returns the OrderBooks in global ID mode, where an order ID can only be used once across every
+// symbol: an insert whose ID was already inserted for any symbol is rejected with ErrDuplicateOrder. By default IDs
+// are only unique per symbol. The mode must be set before the first insert, IDs inserted before aren't tracked.
+func (obs OrderBooks) WithGlobalUniqueIDs() OrderBooks {
+	obs.globalID = true
+	return obs
+}
+
+// WithStrictSymbols returns the OrderBooks in strict mode, where only registered symbols (see RegisterSymbol) can be
+// traded and inserts for any other symbol fail with ErrUnknownSymbol. By default (lenient mode) a book is created for
+// any symbol on its first insert.
+func (obs OrderBooks) WithStrictSymbols() OrderBooks {
+	obs.strict = true
+	return obs
+}
+
+// RegisterSymbol registers symbol as tradable with its own configuration. A book already created for symbol is
+// reconfigured in place; otherwise the configuration is applied when the book is created, on the first insert.
+func (obs OrderBooks) RegisterSymbol(symbol string, cfg SymbolConfig) {
+	obs.symbols[symbol] = cfg
+	if ob, exists := obs.books[symbol]; exists {
+		ob.mu.Lock()
+		defer ob.mu.Unlock()
+		for _, option := range cfg.options() {
+			option(ob)
+		}
 	}
+}
 
-	return ob
+// Book returns the order book of symbol, if any order was ever inserted for it.
+func (obs OrderBooks) Book(symbol string) (*OrderBook, bool) {
+	ob, exists := obs.books[symbol]
+	return ob, exists
 }
 
-// Insert a new order into the system. The order is inserted into the respective heap based on its side (BUY or SELL). Insert triggers a call to ob.matchOrders() to check if the new order can be matched with the existing orders immediately.
-func (ob *OrderBook) Insert(order *Order) {
-	ob.log.Printf("Inserting order: %+v\n", order)
-	// Set the Inserted field to the current time
-	order.Inserted = time.Now()
+// Logger is what the order book logs its tracing through. *log.Logger implements it, *slog.Logger can be plugged in
+// with SlogLogger.
+type Logger interface {
+	Printf(format string, v ...any)
+	Println(v ...any)
+}
 
-	ob.insertOrderIntoHeap(order)
+// SlogLogger adapts a *slog.Logger to Logger: every message is logged at the info level, with the logger's attributes
+// and handler.
+type SlogLogger struct {
+	Logger *slog.Logger
+}
 
-	// if order.Side == "BUY" {
-	// 	order.HeapIndex = ob.BuyOrders.Len()
-	// 	heap.Push(ob.BuyOrders, order)
-	// } else if order.Side == "SELL" {
-	// 	order.HeapIndex = ob.SellOrders.Len()
-	// 	heap.Push(ob.SellOrders, order)
-	// }
+// Printf logs the formatted message at the info level.
+func (l SlogLogger) Printf(format string, v ...any) {
+	l.Logger.Info(strings.TrimSuffix(fmt.Sprintf(format, v...), "\n"))
+}
 
-	// always update orders map and sync it with the heap
-	ob.Orders[order.ID] = order
-	ob.matchOrders(order.ID, order.Side)
+// Println logs the message, formatted like fmt.Sprintln, at the info level.
+func (l SlogLogger) Println(v ...any) {
+	l.Logger.Info(strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
 }
 
-// Update the system by changing its price or volume. Update will set the value of the order's respective field: (price or volume) to the `newPrice` and `newVolume` respectively.
-// Updates also triggers a ob.matchOrders() call to check if the new order can be matched with the existing orders.
-// WHY are we using a ob.Orders (which is a map[int]*Order) to store the orders? The input we are expecting only mentions the order's ID, it doesn't really mention any other data:
-// We need to:
-// - get the order's price and volume
-// - check if a `reinsertion` is needed
-// So that is why we are using a map to store the orders, so we have a O(1) access to the order's data.
-// BUT, a tricky part is that when we ought to trigger a `reinsertion` we need to update the order's data in the map, and also in the heap, which would require us to search
-// item by item in the heap O(n) to find the particular order.
-func (ob *OrderBook) Update(orderID int, newPrice float64, newVolume int) {
-	ob.log.Printf("Starting update for orderID: %d, newPrice: %.2f, newVolume: %d\n", orderID, newPrice, newVolume)
+// WithLogger sets the logger the book traces to, e.g. a *log.Logger or a SlogLogger.
+func WithLogger(logger Logger) OrderBookOption {
+	return func(ob *OrderBook) {
+		ob.log = logger
+	}
+}
 
-	existingOrder, exists := ob.Orders[orderID]
-	if !exists {
-		ob.log.Println("Order not found.")
-		return
+// WithTickSize sets the minimum price increment of the order book. Different symbols trade in different increments
+// (e.g. 0.05 or 0.01), orders priced between two ticks are rejected by ValidateOrder.
+func WithTickSize(tick float64) OrderBookOption {
+	return func(ob *OrderBook) {
+		ob.TickSize = tick
 	}
+}
 
-	if existingOrder.Cancelled || newVolume <= 0 {
-		ob.log.Println("Order already cancelled.")
-		return
+// WithSizeLimits bounds the volume of every inserted or updated order to [min, max]. It is a risk control on top of the
+// rejection of non-positive volumes; a zero bound disables that side of the check.
+func WithSizeLimits(min, max int) OrderBookOption {
+	return func(ob *OrderBook) {
+		ob.MinVolume = min
+		ob.MaxVolume = max
 	}
+}
 
-	if existingOrder.Volume <= 0 {
-		ob.log.Println("Order already at zero volume.")
-		return
+// WithLotSize only accepts order volumes that are a multiple of lot, for symbols trading in round lots.
+func WithLotSize(lot int) OrderBookOption {
+	return func(ob *OrderBook) {
+		ob.LotSize = lot
+	}
+}
 
+// WithPriceBand rejects inserts priced more than pct percent away from the last traded price, mimicking exchange
+// limit-up/limit-down bands. The band only applies once the book has traded and has a reference price.
+func WithPriceBand(pct float64) OrderBookOption {
+	return func(ob *OrderBook) {
+		ob.PriceBand = pct
 	}
+}
 
-	ob.log.Printf("Found existing order: %+v\n", existingOrder)
+// SummaryOrder controls how the SELL levels of the book summary are sorted. BUY levels are always printed best (highest)
+// to worst.
+type SummaryOrder int
 
-	if newVolume <= 0 {
-		ob.log.Println("Order updated to zero volume, treating as cancellation.")
-		ob.removeOrderFromHeap(existingOrder)
-		existingOrder.Cancelled = true
-		return
+const (
+	// AsksDescending prints asks from the highest to the lowest price. This is how the spec examples print them
+	// (SELL,25.67 before SELL,25.56): the summary reads as a single price ladder, from the worst ask down to the best
+	// ask and then from the best bid down to the worst bid. This is the default.
+	AsksDescending SummaryOrder = iota
+	// AsksAscending prints asks in price priority, from the best (lowest) to the worst (highest) price.
+	AsksAscending
+)
 
+// WithSummaryOrder sets how the ask levels are sorted in the book summary.
+func WithSummaryOrder(order SummaryOrder) OrderBookOption {
+	return func(ob *OrderBook) {
+		ob.summaryOrder = order
 	}
+}
 
-	if newVolume > existingOrder.Volume {
-		ob.log.Printf("the new volume is greater than the existing volume: %d > %d\n", newVolume, existingOrder.Volume)
-		existingOrder.Inserted = time.Now()
-	}
-	needsReinsertion := existingOrder.Price != newPrice || existingOrder.Volume != newVolume
-	if needsReinsertion {
-		ob.log.Println("Removing order from heap for reinsertion.")
-		ob.removeOrderFromHeap(existingOrder)
-		existingOrder.Price = newPrice
-		existingOrder.Volume = newVolume
-		ob.log.Printf("Updated order for reinsertion: %+v\n", existingOrder)
-		ob.insertOrderIntoHeap(existingOrder)
-	} else {
-		existingOrder.Volume = newVolume
+// WithVerboseTrades switches the trade lines to the extended format
+// <symbol>,<price>,<volume>,<taker_order_id>,<maker_order_id>,<taker_remaining>,<maker_remaining>
+// where the remaining volumes are what's left of each order right after the fill.
+func WithVerboseTrades() OrderBookOption {
+	return func(ob *OrderBook) {
+		ob.verboseTrades = true
 	}
+}
 
-	// always update orders map
-	ob.Orders[orderID] = existingOrder
-	ob.log.Printf("Order after update: %+v\n", existingOrder)
-	ob.matchOrders(orderID, existingOrder.Side)
-	ob.log.Println("Finished update process.")
+// WithDisplayPrecision prints every price of the book's trade and summary lines with exactly decimals decimals, for
+// symbols that need a fixed display precision. It sets DisplayPrecision, which can also be set per symbol on the books
+// of an OrderBooks.
+func WithDisplayPrecision(decimals int) OrderBookOption {
+	return func(ob *OrderBook) {
+		ob.DisplayPrecision = &decimals
+	}
 }
 
-// matchOrders creates system matching. A very icky part was to correctly assign maker and taker. Also, we had to make a special case for two sell orders.
-func (ob *OrderBook) matchOrders(initiatingOrderID int, initiatingOrderSide string) {
-	if ob.SellOrders.Len() > 0 && ob.BuyOrders.Len() > 0 {
-		ob.log.Printf("Top Buy Order: %+v\n", (*ob.BuyOrders)[0])
-		ob.log.Printf("Top Sell Order: %+v\n", (*ob.SellOrders)[0])
+// WithTradeJournal writes every trade, synchronously as it executes, to w as an append-only journal line:
+// <trade_id>,<timestamp>,<trade line>, where the timestamp is the book's clock in RFC 3339 format and the trade line is
+// the one appended to Trades. Together with a snapshot of the resting orders, the journal lets the state be rebuilt
+// after a crash.
+func WithTradeJournal(w io.Writer) OrderBookOption {
+	return func(ob *OrderBook) {
+		ob.journal = w
 	}
+}
 
-	var handleTwoSells bool
-	if ob.SellOrders.Len() == 2 {
-		handleTwoSells = true
+// writeJournal writes a trade line to the trade journal, if any. Matching can't be undone, so a failed write is only
+// logged.
+func (ob *OrderBook) writeJournal(tradeID int, line string) {
+	if ob.journal == nil {
+		return
 	}
+	if _, err := fmt.Fprintf(ob.journal, "%d,%s,%s\n", tradeID, ob.clock().Format(time.RFC3339Nano), line); err != nil {
+		ob.log.Printf("Failed to journal trade %d: %v\n", tradeID, err)
+	}
+}
 
-	for ob.SellOrders.Len() > 0 && ob.BuyOrders.Len() > 0 {
-		buyOrder := (*ob.BuyOrders)[0]
-		sellOrder := (*ob.SellOrders)[0]
+// WithMaxOrders caps the book at n live resting orders to protect memory: once it is reached, inserts that would rest
+// (even partially) are rejected with ErrBookFull, while orders fully matching on insert are still accepted.
+func WithMaxOrders(n int) OrderBookOption {
+	return func(ob *OrderBook) {
+		ob.maxOrders = n
+	}
+}
 
-		if sellOrder.Cancelled {
-			heap.Pop(ob.SellOrders)
-			continue
-		}
-		if buyOrder.Cancelled {
-			heap.Pop(ob.BuyOrders)
-			continue
-		}
+// checkCapacity returns ErrBookFull if the book is at capacity and order wouldn't be fully filled on insert, i.e. the
+// opposite side doesn't hold enough volume at prices crossing it.
+func (ob *OrderBook) checkCapacity(order *Order) error {
+	live := ob.BuyOrders.Len() + ob.SellOrders.Len()
+	if ob.maxOrders <= 0 || live < ob.maxOrders {
+		return nil
+	}
 
-		// Log candidate orders before executing a trade
-		ob.log.Println("Potential matching candidates:")
-		ob.log.Println("Buy order candidates:")
-		for _, o := range *ob.BuyOrders {
-			if o.Price >= sellOrder.Price {
-				ob.log.Printf("Buy Order ID: %d, Price: %.2f, Volume: %d\n", o.ID, o.Price, o.Volume)
-			}
-		}
-		ob.log.Println("Sell order candidates:")
-		for _, o := range *ob.SellOrders {
-			if o.Price <= buyOrder.Price {
-				ob.log.Printf("Sell Order ID: %d, Price: %.2f, Volume: %d\n", o.ID, o.Price, o.Volume)
-			}
+	// crossing within the price tolerance, like matching does
+	var crossing int64
+	if !ob.halted {
+		crossing = ob.crossingVolume(order)
+	}
+	if crossing < int64(order.Volume) {
+		return fmt.Errorf("%w: %d live orders", ErrBookFull, live)
+	}
+	return nil
+}
+
+// Allocation decides how the volume of an incoming order is shared among the resting orders of a price level.
+type Allocation int
+
+const (
+	FIFO    Allocation = iota // the level's orders are filled one after the other in priority order, the default
+	ProRata                   // the level's orders are filled in proportion to their volume, see WithProRata
+)
+
+// RoundingMode decides how fractional pro-rata shares are rounded to whole volumes. Whatever the mode, the shares
+// never add up to more than the volume being allocated.
+type RoundingMode int
+
+const (
+	RoundDown   RoundingMode = iota // shares are floored, the default
+	RoundHalfUp                     // shares are rounded to the nearest volume, halves up
+)
+
+// WithProRata switches the book to pro-rata allocation: an incoming order matching a price level is shared among all
+// the level's resting orders in proportion to their volume, each share rounded with rounding. The residual volume the
+// rounding leaves goes to the earliest orders first; if rounding up allocates too much, the latest orders give it back.
+// Pro-rata trades execute at the resting level's price.
+func WithProRata(rounding RoundingMode) OrderBookOption {
+	return func(ob *OrderBook) {
+		ob.allocation = ProRata
+		ob.rounding = rounding
+	}
+}
+
+// allocateProRata shares volume among orders (in priority order) in proportion to their volume, see WithProRata. The
+// shares add up to exactly volume, which must not exceed the orders' total volume, and no share exceeds its order's
+// volume.
+func allocateProRata(orders []*Order, volume int, rounding RoundingMode) []int {
+	// the shares are computed in int64: the volume products would overflow int on 32-bit builds
+	var total int64
+	for _, order := range orders {
+		total += int64(order.Volume)
+	}
+
+	shares := make([]int, len(orders))
+	allocated := 0
+	for i, order := range orders {
+		if rounding == RoundHalfUp {
+			shares[i] = int((2*int64(volume)*int64(order.Volume) + total) / (2 * total))
+		} else {
+			shares[i] = int(int64(volume) * int64(order.Volume) / total)
 		}
+		shares[i] = min(shares[i], order.Volume)
+		allocated += shares[i]
+	}
 
-		if sellOrder.Price <= buyOrder.Price {
-			volume := min(sellOrder.Volume, buyOrder.Volume)
-			sellOrder.Volume -= volume
-			buyOrder.Volume -= volume
+	// rounding up gave too much: take it back from the latest orders
+	for i := len(orders) - 1; i >= 0 && allocated > volume; i-- {
+		back := min(shares[i], allocated-volume)
+		shares[i] -= back
+		allocated -= back
+	}
+	// rounding down left a residual: it goes to the earliest orders
+	for i := 0; i < len(orders) && allocated < volume; i++ {
+		extra := min(orders[i].Volume-shares[i], volume-allocated)
+		shares[i] += extra
+		allocated += extra
+	}
+	return shares
+}
 
-			var taker, maker *Order
+// matchProRata is the matching of pro-rata books: the initiating order takes the best opposite price levels it crosses
+// one at a time, each level being shared pro-rata among its orders.
+func (ob *OrderBook) matchProRata(initiatingOrderID int) []Trade {
+	executed := len(ob.Executions)
+	taker, exists := ob.Orders[initiatingOrderID]
+	if !exists || taker.CancelReason != "" {
+		return nil
+	}
+	opposite := "SELL"
+	if taker.Side == "SELL" {
+		opposite = "BUY"
+	}
 
-			if initiatingOrderID == sellOrder.ID && initiatingOrderSide == "SELL" {
-				taker = sellOrder
-				maker = buyOrder
-			} else {
-				taker = buyOrder
-				maker = sellOrder
+	for taker.Volume > 0 || ob.replenish(taker) {
+		queue := ob.newRestingQueue(opposite)
+		var level []*Order
+		var levelVolume int64
+		for queue.Len() > 0 {
+			order := heap.Pop(queue).(*Order)
+			if order.Cancelled {
+				continue
 			}
-
-			matchingPrice := max(sellOrder.Price, buyOrder.Price)
-			if handleTwoSells {
-				matchingPrice = sellOrder.Price
+			if len(level) > 0 && !sameLevel(order, level[0]) {
+				break
 			}
-			ob.Trades = append(ob.Trades, fmt.Sprintf("%s,%s,%d,%d,%d", sellOrder.Symbol, formatFloat(matchingPrice), volume, taker.ID, maker.ID))
+			level = append(level, order)
+			levelVolume += int64(order.Volume)
+		}
+		if len(level) == 0 {
+			break
+		}
+		price := level[0].Price
+		if (taker.Side == "BUY" && !ob.crosses(taker.Price, price)) || (taker.Side == "SELL" && !ob.crosses(price, taker.Price)) {
+			break
+		}
 
-			if sellOrder.Volume == 0 {
-				heap.Pop(ob.SellOrders)
+		shares := allocateProRata(level, int(min(int64(taker.Volume), levelVolume)), ob.rounding)
+		for i, maker := range level {
+			if shares[i] == 0 {
+				continue
 			}
-			if buyOrder.Volume == 0 {
-				heap.Pop(ob.BuyOrders)
+			maker.Volume -= shares[i]
+			taker.Volume -= shares[i]
+			ob.recordTrade(taker, maker, price, shares[i])
+			if maker.Volume == 0 && !ob.replenish(maker) {
+				maker.CancelReason = FullyFilled
+				ob.removeResting(maker)
+			} else {
+				ob.fixOrderInHeap(maker)
 			}
-		} else {
-			break
 		}
 	}
-}
 
-// Cancel an order by setting its Cancelled field to true, and remove it from sell / or buy orders depending on its side. We are also using our ob.Orders map here
-// same reasons as we did in Update.
-// Cancel is a no-op if the order is already cancelled or has zero volume.
-func (ob *OrderBook) Cancel(orderID int) {
-	ob.log.Printf("Attempting to cancel order with ID: %d\n", orderID)
-	order, exists := ob.Orders[orderID]
-	if !exists {
-		ob.log.Println("Order not found. Unable to cancel.")
+	if taker.Volume == 0 {
+		taker.CancelReason = FullyFilled
+		ob.removeResting(taker)
 	} else {
-		ob.log.Println("Order found and cancelled successfully.")
-		order.Cancelled = true
-		if order.Side == "BUY" {
-			for i := 0; i < ob.BuyOrders.Len(); i++ {
-				if (*ob.BuyOrders)[i].ID == order.ID {
-					ob.log.Printf("Buy orders before cancelling: %+v\n", ob.BuyOrders)
-					heap.Remove((*PriorityQueue)(ob.BuyOrders), i)
-					ob.log.Printf("Buy orders after cancelling: %+v\n", ob.BuyOrders)
-					break
-				}
+		ob.fixOrderInHeap(taker)
+	}
+	trades := ob.tradesSince(executed)
+	ob.triggerOCO(trades)
+	return trades
+}
+
+// crossingVolume returns the live volume on the other side of the book that order could trade against right now.
+func (ob *OrderBook) crossingVolume(order *Order) int64 {
+	var volume int64
+	if order.Side == "BUY" {
+		for _, resting := range *ob.SellOrders {
+			if !resting.Cancelled && ob.crosses(order.Price, resting.Price) {
+				volume += int64(resting.Volume)
 			}
-		} else if order.Side == "SELL" {
-			for i := 0; i < ob.SellOrders.Len(); i++ {
-				if (*ob.SellOrders)[i].ID == order.ID {
-					ob.log.Printf("Sell orders before cancelling: %+v\n", ob.SellOrders)
-					heap.Remove(ob.SellOrders, i)
-					ob.log.Printf("Sell orders after cancelling: %+v\n", ob.SellOrders)
-					break
-				}
+		}
+	} else {
+		for _, resting := range *ob.BuyOrders {
+			if !resting.Cancelled && ob.crosses(resting.Price, order.Price) {
+				volume += int64(resting.Volume)
 			}
 		}
 	}
+	return volume
 }
 
-// Insert a new symbol to the orderbooks. Since the trading can happen for multiple symbols, these methods acts as a wrapper to appropiate orderbook. They also delegate the
-// heavy lifting to the OrderBook.Insert method.
-func (obs OrderBooks) Insert(order *Order, opts OrderBookOption) {
-	ob, exists := obs[order.Symbol]
-	if !exists {
-		ob = NewOrderBook(opts)
-		obs[order.Symbol] = ob
+// removeResting removes an order from its heap, directly at its HeapIndex when it is valid.
+func (ob *OrderBook) removeResting(order *Order) {
+	i := order.HeapIndex
+	if order.Side == "BUY" && i >= 0 && i < ob.BuyOrders.Len() && (*ob.BuyOrders)[i] == order {
+		heap.Remove(ob.BuyOrders, i)
+		return
+	}
+	if order.Side == "SELL" && i >= 0 && i < ob.SellOrders.Len() && (*ob.SellOrders)[i] == order {
+		heap.Remove(ob.SellOrders, i)
+		return
 	}
-	ob.Insert(order)
+	ob.removeOrderFromHeap(order)
 }
 
-// Update an existing order with symbol in the order book. Also does the same as obs.Insert, by updating an order in a particular symbol and then delegates the extra process to ob.Update
-func (obs OrderBooks) Update(order *Order) {
-	ob, exists := obs[order.Symbol]
-	if !exists {
-		return
+// HaltMode decides what happens to orders that would cross the book while trading is halted.
+type HaltMode int
+
+const (
+	QueueDuringHalt  HaltMode = iota // crossing orders rest on the (crossed) book until Resume, the default
+	RejectDuringHalt                 // crossing inserts and updates are rejected with ErrHalted
+)
+
+// WithHaltMode sets how crossing orders are handled while the book is halted, see Halt.
+func WithHaltMode(mode HaltMode) OrderBookOption {
+	return func(ob *OrderBook) {
+		ob.haltMode = mode
 	}
+}
 
-	ob.log.Printf("Found OrderBook for symbol %s. Proceeding with update.\n", order.Symbol)
-	ob.Update(order.ID, order.Price, order.Volume)
-	ob.log.Println("Update call completed for OrderBook.")
+// Halt stops trading on the book, like an exchange halt of the symbol: no trade executes until Resume. Orders are still
+// accepted, crossing ones either rest on the book (QueueDuringHalt) or are rejected (RejectDuringHalt).
+func (ob *OrderBook) Halt() {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	ob.log.Println("Trading halted.")
+	ob.halted = true
 }
 
-// Cancel an order in the order book.
-func (obs OrderBooks) Cancel(orderID int, symbol string) {
-	ob, exists := obs[symbol]
-	if !exists {
-		ob.log.Printf("OrderBook for symbol %s not found\n", symbol)
-		return
+// IsHalted reports whether trading is halted.
+func (ob *OrderBook) IsHalted() bool {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+	return ob.halted
+}
+
+// Resume restarts trading after a Halt. The orders that accumulated during the halt are uncrossed in a single
+// auction: every trade executes at the one price maximizing the traded volume, see auctionPrice. It returns the trades
+// of the auction.
+func (ob *OrderBook) Resume() []Trade {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	defer ob.publishLevels()
+	defer ob.repeg()
+	if !ob.halted {
+		return nil
 	}
-	ob.Cancel(orderID)
+	ob.log.Println("Trading resumed.")
+	ob.halted, ob.inAuction = false, false
+	return ob.uncross()
 }
 
-// runMatchingEngine a helper method to parse the input and run the matching engine. It also returns the output in the expected format.
-func runMatchingEngine(operations []string) []string {
+// StartAuction starts an auction call phase, e.g. before the market opens: orders are collected without continuous
+// matching, and crossing orders always rest on the book whatever the HaltMode. Uncross ends the phase.
+func (ob *OrderBook) StartAuction() {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	ob.log.Println("Auction call phase started.")
+	ob.halted, ob.inAuction = true, true
+}
 
-	logger := log.New(io.Discard, "matching-engine: ", log.Ldate|log.Ltime|log.Lshortfile)
+// Uncross ends the auction call phase started by StartAuction: it computes the single clearing price maximizing the
+// matched volume (see auctionPrice), executes every crossing order at that price, and returns to continuous trading.
+// It returns the auction trades, nil when the collected book doesn't cross.
+func (ob *OrderBook) Uncross() []Trade {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	defer ob.publishLevels()
+	defer ob.repeg()
+	ob.log.Println("Uncrossing the auction.")
+	ob.halted, ob.inAuction = false, false
+	return ob.uncross()
+}
 
-	obs := NewOrderBooks()
-	var trades, summaries []string
+// checkHalt returns ErrHalted, under RejectDuringHalt, if an order of side at price would cross the book while it is
+// halted.
+func (ob *OrderBook) checkHalt(side string, price float64) error {
+	if !ob.halted || ob.inAuction || ob.haltMode != RejectDuringHalt {
+		return nil
+	}
+	if bestAsk, ok := ob.SellOrders.Peek(); ok && side == "BUY" && ob.crosses(price, bestAsk.Price) {
+		return fmt.Errorf("%w: buy at %s crosses the ask at %s", ErrHalted, formatFloat(price), formatFloat(bestAsk.Price))
+	}
+	if bestBid, ok := ob.BuyOrders.Peek(); ok && side == "SELL" && ob.crosses(bestBid.Price, price) {
+		return fmt.Errorf("%w: sell at %s crosses the bid at %s", ErrHalted, formatFloat(price), formatFloat(bestBid.Price))
+	}
+	return nil
+}
 
-	for _, operation := range operations {
-		parts := strings.Split(operation, ",")
-
-		switch parts[0] {
-		case "INSERT":
-			orderID, _ := strconv.Atoi(parts[1])
-			symbol := parts[2]
-			side := parts[3]
-			price, _ := strconv.ParseFloat(parts[4], 64)
-			volume, _ := strconv.Atoi(parts[5])
-			order := &Order{
-				ID:     orderID,
-				Symbol: symbol,
-				Side:   side,
-				Price:  price,
-				Volume: volume,
-			}
-			obs.Insert(order, WithLogger(*logger))
-		case "UPDATE":
-			orderID, _ := strconv.Atoi(parts[1])
-			price, _ := strconv.ParseFloat(parts[2], 64)
-			volume, _ := strconv.Atoi(parts[3])
-			var symbol, side string
-			found := false
-			for s, ob := range obs {
-				if order, ok := ob.Orders[orderID]; ok {
-					symbol = s
-					side = order.Side
-					found = true
-					break
+// auctionPrice finds the single price uncrossing the book: the price at which the most volume can trade, i.e.
+// maximizing min(bids at or above it, asks at or below it). Ties go to the smallest imbalance between both sides, then
+// to the lowest price. It reports false when the book isn't crossed.
+func (ob *OrderBook) auctionPrice() (price float64, volume int, ok bool) {
+	imbalance := 0
+	for _, candidates := range [][]*Order{*ob.BuyOrders, *ob.SellOrders} {
+		for _, candidate := range candidates {
+			bids, asks := 0, 0
+			for _, order := range *ob.BuyOrders {
+				if !order.Cancelled && order.Price >= candidate.Price {
+					bids += order.Volume
+				}
+			}
+			for _, order := range *ob.SellOrders {
+				if !order.Cancelled && order.Price <= candidate.Price {
+					asks += order.Volume
 				}
 			}
-			if !found {
 
-				continue
+			executable := min(bids, asks)
+			diff := bids - asks
+			if diff < 0 {
+				diff = -diff
 			}
-			order := &Order{
-				ID:     orderID,
-				Symbol: symbol,
-				Side:   side,
-				Price:  price,
-				Volume: volume,
-			}
-
-			obs.Update(order)
-
-		case "CANCEL":
-			orderID, _ := strconv.Atoi(parts[1])
-			var symbol string
-			for s, ob := range obs {
-				for _, order := range *ob.BuyOrders {
-					if order.ID == orderID {
-						symbol = s
-						break
-					}
-				}
-				for _, order := range *ob.SellOrders {
-					if order.ID == orderID {
-						symbol = s
-						break
-					}
-				}
+			if executable == 0 {
+				continue
 			}
-			if ob, exists := obs[symbol]; exists {
-				ob.Cancel(orderID)
-			} else {
-				ob.log.Printf("OrderBook for symbol %s not found\n", symbol)
+			if !ok || executable > volume || (executable == volume && (diff < imbalance || (diff == imbalance && candidate.Price < price))) {
+				price, volume, imbalance, ok = candidate.Price, executable, diff, true
 			}
 		}
 	}
+	return price, volume, ok
+}
 
-	symbols := make([]string, 0, len(obs))
-	for symbol := range obs {
-		symbols = append(symbols, symbol)
+// uncross runs the auction of Resume and Uncross: the best bids and asks trade in priority order, all at the auction price, until
+// the auction volume is exhausted. In each trade the later of the two orders is the taker.
+func (ob *OrderBook) uncross() []Trade {
+	executed := len(ob.Executions)
+	price, volume, ok := ob.auctionPrice()
+	if !ok {
+		return nil
 	}
-	sort.Strings(symbols)
-	for _, symbol := range symbols {
-		ob := obs[symbol]
-		trades = append(trades, ob.Trades...)
-		ob.Trades = nil
+	ob.log.Printf("Uncrossing %d at %s\n", volume, formatFloat(price))
 
-		sellOrderMap := make(map[float64]int)
-		for _, order := range *ob.SellOrders {
-			if !order.Cancelled {
-				sellOrderMap[order.Price] += order.Volume
-			}
+	for volume > 0 {
+		buyOrder, hasBuy := ob.BuyOrders.Peek()
+		sellOrder, hasSell := ob.SellOrders.Peek()
+		if !hasBuy || !hasSell {
+			break
 		}
-
-		buyOrderMap := make(map[float64]int)
-		for _, order := range *ob.BuyOrders {
-			ob.log.Printf("the buy order is: %+v\n", order)
-			if !order.Cancelled {
-				buyOrderMap[order.Price] += order.Volume
-			}
+		if sellOrder.Cancelled {
+			heap.Pop(ob.SellOrders)
+			continue
 		}
-
-		sellOrderSummaries := make([]OrderSummary, 0, len(sellOrderMap))
-		for price, volume := range sellOrderMap {
-			sellOrderSummaries = append(sellOrderSummaries, OrderSummary{Price: price, Volume: volume})
+		if buyOrder.Cancelled {
+			heap.Pop(ob.BuyOrders)
+			continue
 		}
 
-		buyOrderSummaries := make([]OrderSummary, 0, len(buyOrderMap))
-		for price, volume := range buyOrderMap {
-			buyOrderSummaries = append(buyOrderSummaries, OrderSummary{Price: price, Volume: volume})
+		taker, maker := buyOrder, sellOrder
+		if sellOrder.Inserted.After(buyOrder.Inserted) {
+			taker, maker = sellOrder, buyOrder
 		}
+		traded := min(buyOrder.Volume, sellOrder.Volume, volume)
+		ob.fill(buyOrder, sellOrder, taker, maker, price, traded)
+		volume -= traded
+	}
+	trades := ob.tradesSince(executed)
+	ob.triggerOCO(trades)
+	return trades
+}
 
-		// Sort the sell order summaries by price in descending order
-		sort.Slice(sellOrderSummaries, func(i, j int) bool {
-			return sellOrderSummaries[i].Price > sellOrderSummaries[j].Price
-		})
+// SelfTradeMode decides what happens to an incoming order priced through a resting order of its own account.
+type SelfTradeMode int
 
-		// Sort the buy order summaries by price in descending order
-		sort.Slice(buyOrderSummaries, func(i, j int) bool {
-			return buyOrderSummaries[i].Price > buyOrderSummaries[j].Price
-		})
+const (
+	AllowSelfTrade     SelfTradeMode = iota // orders of the same account match like any other, the default
+	RejectIncoming                          // the incoming order is rejected with ErrSelfCross before reaching the book
+	CancelNewest                            // the taker is cancelled when it meets a maker of its account
+	CancelOldest                            // the maker is cancelled when a taker of its account meets it
+	DecrementAndCancel                      // both lose the volume they would have traded, the exhausted ones are cancelled
+)
+
+// WithSelfTradeMode sets how orders crossing their own account's resting orders are handled. RejectIncoming is eager:
+// it happens on insert, against every resting order of the account, not only the ones the order would actually match.
+// The other modes happen in FIFO matching, only when a taker meets a maker of its account: instead of trading, the
+// orders they cancel leave the book with the SelfTradePrevention reason and matching goes on with the next orders.
+func WithSelfTradeMode(mode SelfTradeMode) OrderBookOption {
+	return func(ob *OrderBook) {
+		ob.selfTrade = mode
+	}
+}
+
+// WithTieBreak sets how orders resting at the same price are prioritized, TimeFirst unless configured otherwise.
+func WithTieBreak(tieBreak TieBreak) OrderBookOption {
+	return func(ob *OrderBook) {
+		ob.tieBreak = tieBreak
+	}
+}
+
+// PriorityPolicy controls whether an update increasing an order's volume sends it to the back of its price level.
+type PriorityPolicy int
+
+const (
+	// LoseOnVolumeIncrease resets the order's time priority when its volume increases. This is the default.
+	LoseOnVolumeIncrease PriorityPolicy = iota
+	// KeepOnVolumeIncrease keeps the order's place in the queue when its volume increases.
+	KeepOnVolumeIncrease
+)
+
+// WithPriorityPolicy sets how updates increasing an order's volume affect its time priority.
+func WithPriorityPolicy(policy PriorityPolicy) OrderBookOption {
+	return func(ob *OrderBook) {
+		ob.priority = policy
+	}
+}
+
+// WithFeeModel sets the fee schedule used to compute the maker and taker fees of every trade.
+func WithFeeModel(fees FeeModel) OrderBookOption {
+	return func(ob *OrderBook) {
+		ob.fees = fees
+	}
+}
+
+// WithLatencyRecorder makes Insert, Update and Cancel time themselves and report their wall clock duration, lock wait
+// included, to record (e.g. to feed a latency histogram). op is the operation type: INSERT, UPDATE or CANCEL. record
+// is called after the book is unlocked, so it may query the book. Without a recorder nothing is timed.
+func WithLatencyRecorder(record func(op string, d time.Duration)) OrderBookOption {
+	return func(ob *OrderBook) {
+		ob.latency = record
+	}
+}
+
+// recordLatency reports the time elapsed since start to the latency recorder.
+func (ob *OrderBook) recordLatency(op OpType, start time.Time) {
+	ob.latency(string(op), time.Since(start))
+}
+
+// WithPriceImprovement gives the taker price improvement: when an incoming order crosses a resting one with room
+// between their prices, they trade at the midpoint of the two prices instead of the default price (see matchOrders),
+// rounded to the tick towards the maker's price. Trades between equal prices are unchanged. It only applies to FIFO
+// matching; pro-rata trades and auction uncrosses keep their prices.
+// It is WithExecutionPrice(MidPrice).
+func WithPriceImprovement() OrderBookOption {
+	return WithExecutionPrice(MidPrice)
+}
+
+// ExecutionPrice decides the price a taker and a maker crossing each other trade at.
+type ExecutionPrice int
+
+const (
+	// LegacyPrice is the default, historical rule of this engine: the higher of the two prices, or the sell price while
+	// exactly two sells rest when the matching starts (see the package notes). It is neither side's price in general:
+	// an incoming bid lifting a cheaper ask trades at the bid.
+	LegacyPrice ExecutionPrice = iota
+	MakerPrice                 // the resting order's price
+	TakerPrice                 // the incoming order's price
+	MidPrice                   // the midpoint of the two prices, rounded to the tick towards the maker's price, see WithPriceImprovement
+)
+
+// WithExecutionPrice sets the price crossing orders trade at. It only applies to FIFO matching; pro-rata trades and
+// auction uncrosses keep their prices.
+func WithExecutionPrice(p ExecutionPrice) OrderBookOption {
+	return func(ob *OrderBook) {
+		ob.executionPrice = p
+	}
+}
+
+// WithMaxFillsPerMatch caps the number of fills a single matching (of an insert, an update, ...) executes, so an order
+// sweeping a deep crossed book doesn't block other work for long: once n fills are done the matching pauses, leaving
+// the book crossed, and ContinueMatching resumes it, e.g. on the next tick of a server loop. The default (0) doesn't
+// cap. Matching triggered in between by another order resumes from the book as it is, with that order as the taker.
+// An IOC remainder is cancelled after its first, possibly capped, matching. Pro-rata matching isn't capped.
+func WithMaxFillsPerMatch(n int) OrderBookOption {
+	return func(ob *OrderBook) {
+		ob.maxFills = n
+	}
+}
+
+// pendingMatch is a matching paused by the fill cap: the initiating order, its side and the price rule it started with.
+type pendingMatch struct {
+	orderID  int
+	side     string
+	twoSells bool
+}
+
+// ContinueMatching resumes the matching paused by the fill cap (see WithMaxFillsPerMatch), for at most another capped
+// batch of fills, and returns its trades. It returns nil once there is nothing left to match, so a caller can call it
+// until it does.
+func (ob *OrderBook) ContinueMatching() []Trade {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	defer ob.publishLevels()
+	defer ob.repeg()
+
+	if ob.pending == nil {
+		return nil
+	}
+	return ob.matchOrders(ob.pending.orderID, ob.pending.side)
+}
+
+// WithPositionChecker plugs the position system into the book: check is called with the remainder of every reduce-only
+// order left after matching, and returns whether it may rest (e.g. because it still only reduces the owner's position).
+// A veto cancels the remainder like an IOC. Without a checker, reduce-only remainders never rest. check runs with the
+// book locked, it must not call back into the book.
+func WithPositionChecker(check func(order OrderStatus) bool) OrderBookOption {
+	return func(ob *OrderBook) {
+		ob.positionCheck = check
+	}
+}
+
+// WithBustReinstatement makes BustTrade give the volume of the busted trade back to its maker and taker, when they are
+// still resting on the book. By default a bust only marks the trade, the orders are left as they are.
+func WithBustReinstatement() OrderBookOption {
+	return func(ob *OrderBook) {
+		ob.bustReinstates = true
+	}
+}
+
+// WithClock replaces time.Now as the source of the book's timestamps (insertion times and expiry checks). It is mostly
+// useful for tests and replays that need a deterministic notion of time.
+func WithClock(clock func() time.Time) OrderBookOption {
+	return func(ob *OrderBook) {
+		ob.clock = clock
+	}
+}
+
+func NewOrderBook(options ...OrderBookOption) *OrderBook {
+	ob := &OrderBook{
+		BuyOrders:  &MaxHeap{},
+		SellOrders: &MinHeap{},
+		log:        log.Default(),
+		Orders:     make(map[int]*Order),
+		Trades:     make([]string, 0),
+		TickSize:   DefaultTickSize,
+		fees:       ZeroFees{},
+		clock:      time.Now,
+		newTicker: func(d time.Duration) (<-chan time.Time, func()) {
+			ticker := time.NewTicker(d)
+			return ticker.C, ticker.Stop
+		},
+	}
+
+	for _, option := range options {
+		option(ob)
+	}
+
+	return ob
+}
 
-		summaries = append(summaries, "==="+symbol+"===")
+// Reset empties the book so it can be reused, e.g. from a sync.Pool, as if it was freshly built with the same options:
+// the resting orders, Orders, Trades, Executions, the trade IDs, LastPrice, the halt and auction state, the OCO links
+// and the level diffs are all cleared. The heaps, slices and maps keep their allocated capacity.
+func (ob *OrderBook) Reset() {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
 
-		for _, orderSummary := range sellOrderSummaries {
-			summaries = append(summaries, fmt.Sprintf("SELL,%s,%d", formatFloat(orderSummary.Price), orderSummary.Volume))
+	// drop the order pointers before truncating, so the backing arrays don't keep the old orders alive
+	clear(*ob.BuyOrders)
+	*ob.BuyOrders = (*ob.BuyOrders)[:0]
+	clear(*ob.SellOrders)
+	*ob.SellOrders = (*ob.SellOrders)[:0]
+	clear(ob.Orders)
+	clear(ob.Trades)
+	ob.Trades = ob.Trades[:0]
+	ob.Executions = ob.Executions[:0]
+	clear(ob.accounts)
+	clear(ob.oco)
+	clear(ob.pegged)
+	ob.pegged = ob.pegged[:0]
+
+	ob.nextTradeID, ob.LastPrice, ob.arrivals = 0, 0, 0
+	ob.halted, ob.inAuction = false, false
+	clear(ob.levels)
+	ob.levelChanges, ob.seq = ob.levelChanges[:0], 0
+	ob.pending = nil
+}
+
+// clone returns a deep copy of the book: its orders are copied, so matching against the clone never changes the volumes
+// of the original orders. The clone shares the book's configuration but logs nowhere.
+func (ob *OrderBook) clone() *OrderBook {
+	c := NewOrderBook(WithLogger(log.New(io.Discard, "", 0)))
+	c.TickSize, c.MinVolume, c.MaxVolume, c.PriceBand, c.LastPrice = ob.TickSize, ob.MinVolume, ob.MaxVolume, ob.PriceBand, ob.LastPrice
+	c.LotSize = ob.LotSize
+	c.DisplayPrecision = ob.DisplayPrecision
+	c.nextTradeID, c.fees, c.priority, c.tieBreak = ob.nextTradeID, ob.fees, ob.priority, ob.tieBreak
+	c.arrivals = ob.arrivals
+	c.summaryOrder, c.verboseTrades, c.selfTrade = ob.summaryOrder, ob.verboseTrades, ob.selfTrade
+	c.halted, c.inAuction, c.haltMode = ob.halted, ob.inAuction, ob.haltMode
+	c.maxOrders, c.allocation, c.rounding = ob.maxOrders, ob.allocation, ob.rounding
+	c.ocoTrigger, c.executionPrice, c.bustReinstates = ob.ocoTrigger, ob.executionPrice, ob.bustReinstates
+	c.positionCheck, c.maxFills = ob.positionCheck, ob.maxFills
+	if ob.pending != nil {
+		pending := *ob.pending
+		c.pending = &pending
+	}
+	c.clock, c.newTicker = ob.clock, ob.newTicker
+	c.Trades = append(c.Trades, ob.Trades...)
+	c.Executions = append([]Trade(nil), ob.Executions...)
+	c.levelDiffs, c.levels, c.seq = ob.levelDiffs, maps.Clone(ob.levels), ob.seq
+	c.levelChanges = append([]LevelChange(nil), ob.levelChanges...)
+
+	copies := make(map[*Order]*Order, len(ob.Orders))
+	copyOf := func(order *Order) *Order {
+		if copied, ok := copies[order]; ok {
+			return copied
+		}
+		copied := *order
+		copies[order] = &copied
+		return &copied
+	}
+	for _, order := range *ob.BuyOrders {
+		*c.BuyOrders = append(*c.BuyOrders, copyOf(order))
+	}
+	for _, order := range *ob.SellOrders {
+		*c.SellOrders = append(*c.SellOrders, copyOf(order))
+	}
+	for id, order := range ob.Orders {
+		c.Orders[id] = copyOf(order)
+	}
+	for _, orders := range ob.accounts {
+		for _, order := range orders {
+			c.indexAccount(copyOf(order))
+		}
+	}
+	for _, order := range ob.pegged {
+		c.pegged = append(c.pegged, copyOf(order))
+	}
+	for leg, other := range ob.oco {
+		if c.oco == nil {
+			c.oco = make(map[*Order]*Order)
 		}
+		c.oco[copyOf(leg)] = copyOf(other)
+	}
+	return c
+}
+
+// Clone returns a deep copy of the book, e.g. to fork it in a backtest and apply hypothetical flows: the heaps, the
+// Order values, Orders, Trades, Executions and the level diffs are all copied, so nothing done to the clone changes
+// the original and vice versa. The clone keeps the book's configuration, but logs nowhere and has neither a trade
+// journal nor a latency recorder, so hypothetical trades never reach the original's outputs.
+func (ob *OrderBook) Clone() *OrderBook {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+	return ob.clone()
+}
+
+// SimulateInsert returns the trades order would generate if it was inserted now, without changing the book: the order
+// is matched against a deep copy of the book, and order itself is left untouched. An order the book would reject
+// generates no trades.
+func (ob *OrderBook) SimulateInsert(order *Order) []Trade {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	incoming := *order
+	trades, err := ob.clone().insert(&incoming)
+	if err != nil {
+		ob.log.Printf("Simulated order %d would be rejected: %v\n", order.ID, err)
+		return nil
+	}
+	return trades
+}
+
+// NewOrderBookWithOrders creates a book preloaded with resting orders, e.g. to warm start from a snapshot. The orders
+// are assumed not to cross, so no matching happens: both heaps are built at once with heap.Init in O(n), instead of the
+// O(n log n) of n inserts. Orders keep their Inserted timestamp (the queue priority of the snapshot), orders without one
+// are stamped in slice order. An error is returned if an order is invalid, an ID is duplicated or the bids cross the
+// asks.
+func NewOrderBookWithOrders(orders []*Order, opts ...OrderBookOption) (*OrderBook, error) {
+	ob, err := newOrderBookWithOrders(orders, (*OrderBook).ValidateOrder, opts...)
+	if err != nil {
+		return nil, err
+	}
+	bestBid, hasBid := ob.BuyOrders.Peek()
+	bestAsk, hasAsk := ob.SellOrders.Peek()
+	if hasBid && hasAsk && bestBid.Price >= bestAsk.Price {
+		return nil, fmt.Errorf("%w: bid %d at %s, ask %d at %s", ErrCrossedBook, bestBid.ID, formatFloat(bestBid.Price), bestAsk.ID, formatFloat(bestAsk.Price))
+	}
+	return ob, nil
+}
+
+// newOrderBookWithOrders is NewOrderBookWithOrders checking every order with validate, and without the crossed book
+// check.
+func newOrderBookWithOrders(orders []*Order, validate func(ob *OrderBook, order *Order) error, opts ...OrderBookOption) (*OrderBook, error) {
+	ob := NewOrderBook(opts...)
 
-		for _, orderSummary := range buyOrderSummaries {
-			summaries = append(summaries, fmt.Sprintf("BUY,%s,%d", formatFloat(orderSummary.Price), orderSummary.Volume))
+	buys := make(MaxHeap, 0, len(orders))
+	sells := make(MinHeap, 0, len(orders))
+	for _, order := range orders {
+		if err := validate(ob, order); err != nil {
+			return nil, fmt.Errorf("order %d: %w", order.ID, err)
+		}
+		if _, exists := ob.Orders[order.ID]; exists {
+			return nil, fmt.Errorf("%w: %d", ErrDuplicateOrder, order.ID)
+		}
+		if order.Inserted.IsZero() {
+			order.Inserted = ob.clock()
+		}
+		ob.arrivals++
+		order.arrival = ob.arrivals
+		ob.Orders[order.ID] = order
+		ob.indexAccount(order)
+		if order.Peg != NoPeg {
+			ob.pegged = append(ob.pegged, order)
+		}
+		order.tieBreak = ob.tieBreak
+		order.tolerance = ob.priceTolerance()
+		if order.Side == "BUY" {
+			order.HeapIndex = len(buys)
+			buys = append(buys, order)
+		} else {
+			order.HeapIndex = len(sells)
+			sells = append(sells, order)
 		}
 	}
-	output := append(trades, summaries...)
-	return output
+	heap.Init(&buys)
+	heap.Init(&sells)
+	ob.BuyOrders = &buys
+	ob.SellOrders = &sells
+	return ob, nil
+}
+
+// validateRestored checks the structure of an order restored from a snapshot: the side must be BUY or SELL, the price
+// positive and finite and the volume positive. The rules of the book (tick, band, size limits) only apply to incoming
+// orders: a partially filled order may rest below the minimum size, and a saved book may legitimately be crossed.
+func validateRestored(_ *OrderBook, order *Order) error {
+	if order.Side != "BUY" && order.Side != "SELL" {
+		return fmt.Errorf("%w: %q", ErrInvalidSide, order.Side)
+	}
+	if math.IsNaN(order.Price) || math.IsInf(order.Price, 0) || order.Price <= 0 {
+		return fmt.Errorf("%w: %s", ErrInvalidPrice, formatFloat(order.Price))
+	}
+	if order.Volume <= 0 {
+		return fmt.Errorf("%w: %d is not positive", ErrVolumeOutOfRange, order.Volume)
+	}
+	return nil
+}
+
+// ValidateOrder checks an order against the book's rules before it is allowed in: the side must be BUY or SELL, the
+// price must sit on the tick grid and within the price band, and the volume must be positive and within the size limits.
+func (ob *OrderBook) ValidateOrder(order *Order) error {
+	if order.Side != "BUY" && order.Side != "SELL" {
+		return fmt.Errorf("%w: %q", ErrInvalidSide, order.Side)
+	}
+	if err := ob.validatePrice(order.Price); err != nil {
+		return err
+	}
+	if err := ob.validatePriceBand(order.Price); err != nil {
+		return err
+	}
+	if err := ob.validateDisplayPrice(order); err != nil {
+		return err
+	}
+	// an empty order would trade (and print) zero volume against the first order crossing it
+	if order.Volume <= 0 {
+		return fmt.Errorf("%w: %d is not positive", ErrVolumeOutOfRange, order.Volume)
+	}
+	return ob.validateVolume(order.Volume)
+}
+
+// validatePriceBand checks that price lies within LastPrice × (1 ± PriceBand/100). Without a band or a reference
+// price every price is accepted.
+func (ob *OrderBook) validatePriceBand(price float64) error {
+	if ob.PriceBand <= 0 || ob.LastPrice <= 0 {
+		return nil
+	}
+	low := ob.LastPrice * (1 - ob.PriceBand/100)
+	high := ob.LastPrice * (1 + ob.PriceBand/100)
+	if price < low-priceEpsilon || price > high+priceEpsilon {
+		return fmt.Errorf("%w: %s not in [%s, %s]", ErrOutsidePriceBand, formatFloat(price), formatFloat(low), formatFloat(high))
+	}
+	return nil
+}
+
+// validateDisplayPrice checks that the DisplayPrice of order, if any, is a valid price (positive, finite, on the tick)
+// on the order's own side of its Price: a bid may only be shown at or below its price and an ask at or above it, so
+// the visible book never shows an order better than it really is, nor on the other side of the book. With a band, it
+// must also lie within Price × (1 ± PriceBand/100).
+func (ob *OrderBook) validateDisplayPrice(order *Order) error {
+	if order.DisplayPrice == nil {
+		return nil
+	}
+	display := *order.DisplayPrice
+	if err := ob.validatePrice(display); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidDisplayPrice, err)
+	}
+	if order.Side == "BUY" && display-order.Price > ob.priceTolerance() {
+		return fmt.Errorf("%w: bid shown at %s above its price %s", ErrInvalidDisplayPrice, formatFloat(display), formatFloat(order.Price))
+	}
+	if order.Side == "SELL" && order.Price-display > ob.priceTolerance() {
+		return fmt.Errorf("%w: ask shown at %s below its price %s", ErrInvalidDisplayPrice, formatFloat(display), formatFloat(order.Price))
+	}
+	if ob.PriceBand <= 0 {
+		return nil
+	}
+	low := order.Price * (1 - ob.PriceBand/100)
+	high := order.Price * (1 + ob.PriceBand/100)
+	if display < low-priceEpsilon || display > high+priceEpsilon {
+		return fmt.Errorf("%w: %s not in [%s, %s]", ErrInvalidDisplayPrice, formatFloat(display), formatFloat(low), formatFloat(high))
+	}
+	return nil
+}
+
+// displayedPrice is the price order is shown at in the visible book: its DisplayPrice if set, its Price otherwise.
+func (o *Order) displayedPrice() float64 {
+	if o.DisplayPrice != nil {
+		return *o.DisplayPrice
+	}
+	return o.Price
+}
+
+// validateVolume checks volume against the MinVolume and MaxVolume bounds, both inclusive.
+func (ob *OrderBook) validateVolume(volume int) error {
+	if (ob.MinVolume > 0 && volume < ob.MinVolume) || (ob.MaxVolume > 0 && volume > ob.MaxVolume) {
+		return fmt.Errorf("%w: %d not in [%d, %d]", ErrVolumeOutOfRange, volume, ob.MinVolume, ob.MaxVolume)
+	}
+	if ob.LotSize > 0 && volume%ob.LotSize != 0 {
+		return fmt.Errorf("%w: %d (lot %d)", ErrInvalidLot, volume, ob.LotSize)
+	}
+	return nil
+}
+
+// validatePrice checks that price is positive, finite and a multiple of the tick size. NaN compares false with
+// everything, so it must be rejected up front or it would pass the tick check. The division is done in floats, so we
+// allow a small tolerance around the nearest whole number of ticks (12.25 / 0.05 = 244.99999999999997).
+func (ob *OrderBook) validatePrice(price float64) error {
+	if math.IsNaN(price) || math.IsInf(price, 0) || price <= 0 {
+		return fmt.Errorf("%w: %s", ErrInvalidPrice, formatFloat(price))
+	}
+	if ob.TickSize <= 0 {
+		return nil
+	}
+	ticks := price / ob.TickSize
+	if math.Abs(ticks-math.Round(ticks)) > 1e-6 {
+		return fmt.Errorf("%w: %s (tick %s)", ErrInvalidTick, formatFloat(price), formatFloat(ob.TickSize))
+	}
+	return nil
+}
+
+// Insert a new order into the system. The order is inserted into the respective heap based on its side (BUY or SELL). Insert triggers a call to ob.matchOrders() to check if the new order can be matched with the existing orders immediately.
+// Orders failing ValidateOrder are rejected and never reach the book, and so are orders whose ID is still resting
+// (ErrDuplicateOrder); the ID of an order that left the book may be reused.
+// Insert returns what happened to the order (see InsertResult), including the trades it generated; ob.Trades and
+// ob.Executions keep the cumulative log of every trade.
+func (ob *OrderBook) Insert(order *Order) (InsertResult, error) {
+	if ob.latency != nil {
+		defer ob.recordLatency(OpInsert, time.Now())
+	}
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	defer ob.publishLevels()
+	defer ob.repeg()
+
+	volume := order.Volume + order.Reserve
+	trades, err := ob.insert(order)
+	if err != nil {
+		return InsertResult{}, err
+	}
+	remaining := order.Volume + order.Reserve
+	return InsertResult{
+		Trades:          trades,
+		Resting:         order.CancelReason == "" && ob.Orders[order.ID] == order,
+		FilledVolume:    volume - remaining,
+		RemainingVolume: remaining,
+	}, nil
+}
+
+// InsertResult tells a client at a glance what an Insert did, without diffing the book.
+type InsertResult struct {
+	Trades          []Trade // the trades the order generated, nil when it didn't trade
+	Resting         bool    // whether (what is left of) the order rests in the book
+	FilledVolume    int     // volume traded on insertion
+	RemainingVolume int     // volume left once matching is over, iceberg reserve included
+}
+
+// insert is Insert without locking.
+func (ob *OrderBook) insert(order *Order) ([]Trade, error) {
+	ob.log.Printf("Inserting order: %+v\n", order)
+	if err := ob.ValidateOrder(order); err != nil {
+		ob.log.Printf("Rejected order %d: %v\n", order.ID, err)
+		return nil, err
+	}
+	// a second live order under the same ID would leave the first one in its heap, unreachable through ob.Orders
+	if resting, exists := ob.Orders[order.ID]; exists && resting.CancelReason == "" {
+		err := fmt.Errorf("%w: %d is still resting", ErrDuplicateOrder, order.ID)
+		ob.log.Printf("Rejected order %d: %v\n", order.ID, err)
+		return nil, err
+	}
+	if err := ob.checkSelfCross(order, order.ID); err != nil {
+		ob.log.Printf("Rejected order %d: %v\n", order.ID, err)
+		return nil, err
+	}
+	if err := ob.checkHalt(order.Side, order.Price); err != nil {
+		ob.log.Printf("Rejected order %d: %v\n", order.ID, err)
+		return nil, err
+	}
+	if err := ob.checkCapacity(order); err != nil {
+		ob.log.Printf("Rejected order %d: %v\n", order.ID, err)
+		return nil, err
+	}
+	// Set the Inserted field to the current time
+	ob.stamp(order)
+	// an iceberg only shows its peak, the rest of its volume goes to the reserve
+	if order.Peak > 0 && order.Volume > order.Peak {
+		order.Reserve += order.Volume - order.Peak
+		order.Volume = order.Peak
+	}
+
+	ob.insertOrderIntoHeap(order)
+	ob.indexAccount(order)
+
+	// if order.Side == "BUY" {
+	// 	order.HeapIndex = ob.BuyOrders.Len()
+	// 	heap.Push(ob.BuyOrders, order)
+	// } else if order.Side == "SELL" {
+	// 	order.HeapIndex = ob.SellOrders.Len()
+	// 	heap.Push(ob.SellOrders, order)
+	// }
+
+	// always update orders map and sync it with the heap
+	ob.Orders[order.ID] = order
+	if order.Peg != NoPeg {
+		ob.pegged = append(ob.pegged, order)
+	}
+	trades := ob.matchOrders(order.ID, order.Side)
+	if order.CancelReason == "" && (order.TimeInForce == IOC || (order.ReduceOnly && !ob.mayRest(order)) ||
+		(order.TopOfBookOnly && !ob.atTopOfBook(order))) {
+		ob.cancel(order.ID, Expired)
+	}
+	return trades, nil
+}
+
+// stamp gives order its time priority as of now: Inserted from the book's clock, and the next arrival sequence number
+// to order it after every order stamped before, even within the same clock tick.
+func (ob *OrderBook) stamp(order *Order) {
+	order.Inserted = ob.clock()
+	ob.arrivals++
+	order.arrival = ob.arrivals
+}
+
+// atTopOfBook reports whether the resting order alone makes the best price of its side: every other order of the side
+// is priced strictly worse, or there is none. Only the root of the heap and, when it is the order, the root's children
+// can hold the best other price, so it is O(1).
+func (ob *OrderBook) atTopOfBook(order *Order) bool {
+	orders := []*Order(*ob.SellOrders)
+	if order.Side == "BUY" {
+		orders = *ob.BuyOrders
+	}
+	if len(orders) == 0 || orders[0] != order {
+		return false
+	}
+	for _, other := range orders[1:min(3, len(orders))] {
+		if order.Side == "BUY" && other.Price-order.Price > -ob.priceTolerance() {
+			return false
+		}
+		if order.Side == "SELL" && order.Price-other.Price > -ob.priceTolerance() {
+			return false
+		}
+	}
+	return true
+}
+
+// mayRest asks the position checker whether the remainder of a reduce-only order may rest. Without a checker it never
+// does.
+func (ob *OrderBook) mayRest(order *Order) bool {
+	return ob.positionCheck != nil && ob.positionCheck(order.status())
+}
+
+// Update the system by changing its price or volume. Update will set the value of the order's respective field: (price or volume) to the `newPrice` and `newVolume` respectively.
+// Updates also triggers a ob.matchOrders() call to check if the new order can be matched with the existing orders.
+// WHY are we using a ob.Orders (which is a map[int]*Order) to store the orders? The input we are expecting only mentions the order's ID, it doesn't really mention any other data:
+// We need to:
+// - get the order's price and volume
+// - check if a `reinsertion` is needed
+// So that is why we are using a map to store the orders, so we have a O(1) access to the order's data.
+// BUT, a tricky part is that when we ought to trigger a `reinsertion` we need to update the order's data in the map, and also in the heap, which would require us to search
+// item by item in the heap O(n) to find the particular order.
+// A new price that is not on the tick grid, or a new volume outside the size limits, is rejected and leaves the order untouched.
+// newVolume is the order's new absolute volume: zero and negative volumes are rejected with ErrVolumeOutOfRange and
+// discarded, use Reduce to take some volume off an order.
+// Like Insert, Update returns the trades the updated order generated.
+func (ob *OrderBook) Update(orderID int, newPrice float64, newVolume int) ([]Trade, error) {
+	if ob.latency != nil {
+		defer ob.recordLatency(OpUpdate, time.Now())
+	}
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	defer ob.publishLevels()
+	defer ob.repeg()
+	return ob.update(orderID, newPrice, newVolume)
+}
+
+// update is Update without locking.
+func (ob *OrderBook) update(orderID int, newPrice float64, newVolume int) ([]Trade, error) {
+	ob.log.Printf("Starting update for orderID: %d, newPrice: %.2f, newVolume: %d\n", orderID, newPrice, newVolume)
+
+	existingOrder, exists := ob.Orders[orderID]
+	if !exists {
+		ob.log.Println("Order not found.")
+		return nil, nil
+	}
+
+	if existingOrder.Cancelled {
+		ob.log.Println("Order already cancelled.")
+		return nil, nil
+	}
+	// the new volume is absolute: a negative one isn't a reduction (see Reduce), the update is discarded
+	if newVolume <= 0 {
+		err := fmt.Errorf("%w: %d is not positive", ErrVolumeOutOfRange, newVolume)
+		ob.log.Printf("Rejected update for order %d: %v\n", orderID, err)
+		return nil, err
+	}
+
+	if existingOrder.Volume <= 0 {
+		ob.log.Println("Order already at zero volume.")
+		return nil, nil
+
+	}
+
+	if err := ob.validatePrice(newPrice); err != nil {
+		ob.log.Printf("Rejected update for order %d: %v\n", orderID, err)
+		return nil, err
+	}
+	if err := ob.validateVolume(newVolume); err != nil {
+		ob.log.Printf("Rejected update for order %d: %v\n", orderID, err)
+		return nil, err
+	}
+
+	if err := ob.checkHalt(existingOrder.Side, newPrice); err != nil {
+		ob.log.Printf("Rejected update for order %d: %v\n", orderID, err)
+		return nil, err
+	}
+
+	ob.log.Printf("Found existing order: %+v\n", existingOrder)
+
+	// nothing changes: the order keeps its priority and, since the book didn't move, there is nothing to match
+	if existingOrder.Price == newPrice && existingOrder.Volume == newVolume {
+		ob.log.Println("Update is a no-op, skipping.")
+		return nil, nil
+	}
+
+	if newVolume <= 0 {
+		ob.log.Println("Order updated to zero volume, treating as cancellation.")
+		ob.removeOrderFromHeap(existingOrder)
+		existingOrder.Cancelled = true
+		return nil, nil
+
+	}
+
+	// a pure volume decrease keeps the order's time priority, so it is applied in place and, since the book can't cross
+	// more than before, without matching. Under VolumeFirst the volume is part of the sort key, so the order is
+	// re-sifted, like Reduce does.
+	if existingOrder.Price == newPrice && newVolume < existingOrder.Volume {
+		existingOrder.Volume = newVolume
+		if existingOrder.tieBreak == VolumeFirst {
+			ob.fixOrderInHeap(existingOrder)
+		}
+		ob.log.Printf("Order volume reduced in place: %+v\n", existingOrder)
+		return nil, nil
+	}
+
+	if newVolume > existingOrder.Volume && ob.priority == LoseOnVolumeIncrease {
+		ob.log.Printf("the new volume is greater than the existing volume: %d > %d\n", newVolume, existingOrder.Volume)
+		ob.stamp(existingOrder)
+	}
+	// the order stays on its side, so a reprice or volume change is re-sifted in place from its HeapIndex with heap.Fix,
+	// in O(log n). Remove and reinsert is only the fallback for an order that isn't at its HeapIndex.
+	existingOrder.Price = newPrice
+	existingOrder.Volume = newVolume
+	if !ob.fixOrderInHeap(existingOrder) {
+		ob.log.Println("Removing order from heap for reinsertion.")
+		ob.removeOrderFromHeap(existingOrder)
+		ob.log.Printf("Updated order for reinsertion: %+v\n", existingOrder)
+		ob.insertOrderIntoHeap(existingOrder)
+	}
+
+	// always update orders map
+	ob.Orders[orderID] = existingOrder
+	ob.log.Printf("Order after update: %+v\n", existingOrder)
+	trades := ob.matchOrders(orderID, existingOrder.Side)
+	ob.log.Println("Finished update process.")
+	return trades, nil
+}
+
+// indexAccount adds order to the index of its account, if it has one.
+func (ob *OrderBook) indexAccount(order *Order) {
+	if order.Account == "" {
+		return
+	}
+	if ob.accounts == nil {
+		ob.accounts = make(map[string]map[int]*Order)
+	}
+	if ob.accounts[order.Account] == nil {
+		ob.accounts[order.Account] = make(map[int]*Order)
+	}
+	ob.accounts[order.Account][order.ID] = order
+}
+
+// checkSelfCross returns ErrSelfCross, under RejectIncoming, if order is priced at or through a resting order of the
+// opposite side with the same account. The resting order ignoreID is skipped.
+func (ob *OrderBook) checkSelfCross(order *Order, ignoreID int) error {
+	if ob.selfTrade != RejectIncoming || order.Account == "" {
+		return nil
+	}
+	for id, resting := range ob.accounts[order.Account] {
+		if resting.CancelReason != "" || resting.Cancelled {
+			delete(ob.accounts[order.Account], id)
+			continue
+		}
+		if id == ignoreID || resting.Side == order.Side {
+			continue
+		}
+		if (order.Side == "BUY" && order.Price >= resting.Price) || (order.Side == "SELL" && order.Price <= resting.Price) {
+			return fmt.Errorf("%w: order %d of %s at %s, resting order %d at %s", ErrSelfCross, order.ID, order.Account,
+				formatFloat(order.Price), resting.ID, formatFloat(resting.Price))
+		}
+	}
+	return nil
+}
+
+// OCOTrigger decides which trades of an OCO leg cancel the other leg.
+type OCOTrigger int
+
+const (
+	OCOOnAnyFill  OCOTrigger = iota // the first trade of a leg, even partial, cancels the other leg, the default
+	OCOOnFullFill                   // only a leg trading its whole volume cancels the other leg
+)
+
+// WithOCOTrigger sets when a trading OCO leg cancels the other leg, see InsertOCO.
+func WithOCOTrigger(trigger OCOTrigger) OrderBookOption {
+	return func(ob *OrderBook) {
+		ob.ocoTrigger = trigger
+	}
+}
+
+// InsertOCO inserts a and b as a one-cancels-other pair: once one leg trades (see WithOCOTrigger), the other is
+// cancelled with the OneCancelsOther reason. The legs are plain limit orders, inserted a first. If a triggers on
+// insertion, b never rests (it is recorded as cancelled with OneCancelsOther); if b is rejected, a is cancelled as
+// well and the error is returned: either both legs rest, or neither does past the call. Both legs are validated before
+// anything is inserted.
+func (ob *OrderBook) InsertOCO(a, b *Order) error {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	defer ob.publishLevels()
+	defer ob.repeg()
+
+	if a.ID == b.ID {
+		return fmt.Errorf("%w: both OCO legs are %d", ErrDuplicateOrder, a.ID)
+	}
+	for _, leg := range []*Order{a, b} {
+		err := ob.ValidateOrder(leg)
+		if resting, exists := ob.Orders[leg.ID]; err == nil && exists && resting.CancelReason == "" {
+			err = fmt.Errorf("%w: %d is still resting", ErrDuplicateOrder, leg.ID)
+		}
+		if err != nil {
+			ob.log.Printf("Rejected OCO leg %d: %v\n", leg.ID, err)
+			return err
+		}
+	}
+
+	if ob.oco == nil {
+		ob.oco = make(map[*Order]*Order)
+	}
+	ob.oco[a], ob.oco[b] = b, a
+	if _, err := ob.insert(a); err != nil {
+		delete(ob.oco, a)
+		delete(ob.oco, b)
+		return err
+	}
+	if _, linked := ob.oco[a]; !linked {
+		// a traded on insertion and so already cancelled b, which must not rest
+		b.Cancelled, b.CancelReason = true, OneCancelsOther
+		ob.Orders[b.ID] = b
+		return nil
+	}
+	if _, err := ob.insert(b); err != nil {
+		delete(ob.oco, a)
+		delete(ob.oco, b)
+		ob.cancel(a.ID, OneCancelsOther)
+		return err
+	}
+	return nil
+}
+
+// triggerOCO cancels the other leg of every OCO leg that took part in trades, as configured by WithOCOTrigger. It runs
+// once matching is over, so the heaps are never changed under a match in progress.
+func (ob *OrderBook) triggerOCO(trades []Trade) {
+	if len(ob.oco) == 0 {
+		return
+	}
+	for _, trade := range trades {
+		for _, id := range []int{trade.TakerID, trade.MakerID} {
+			leg := ob.Orders[id]
+			other, linked := ob.oco[leg]
+			if !linked || (ob.ocoTrigger == OCOOnFullFill && leg.CancelReason != FullyFilled) {
+				continue
+			}
+			delete(ob.oco, leg)
+			delete(ob.oco, other)
+			ob.log.Printf("OCO leg %d traded, cancelling leg %d\n", leg.ID, other.ID)
+			if ob.Orders[other.ID] == other {
+				ob.cancel(other.ID, OneCancelsOther)
+			} else {
+				// the other leg isn't in the book (yet), see InsertOCO
+				other.Cancelled, other.CancelReason = true, OneCancelsOther
+			}
+		}
+	}
+}
+
+// Replace atomically cancels the order oldID and inserts newOrder in its place, for protocols modelling an amend as a
+// cancel plus a new order with a new ID. Unlike Update, the new order always gets a fresh Inserted timestamp, so it
+// goes to the back of its price level. If newOrder is rejected for any reason insert would reject it (validation,
+// duplicate ID, halt, capacity, ...) the whole replace is rejected and oldID keeps resting, with its priority and place
+// in the heap; an unknown (or no longer resting) oldID doesn't prevent the insert. It returns the trades of newOrder.
+func (ob *OrderBook) Replace(oldID int, newOrder *Order) ([]Trade, error) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	defer ob.publishLevels()
+	defer ob.repeg()
+
+	if err := ob.ValidateOrder(newOrder); err != nil {
+		ob.log.Printf("Rejected replace of order %d by %d: %v\n", oldID, newOrder.ID, err)
+		return nil, err
+	}
+	// the replaced order is about to leave, it can't be self crossed
+	if err := ob.checkSelfCross(newOrder, oldID); err != nil {
+		ob.log.Printf("Rejected replace of order %d by %d: %v\n", oldID, newOrder.ID, err)
+		return nil, err
+	}
+
+	// the old order leaves before the insert, so the new one doesn't count against it (capacity, duplicate ID, ...).
+	// insert rejects orders before touching the book, so on failure restoring the old order's heap undoes the cancel.
+	old, exists := ob.Orders[oldID]
+	resting := exists && old.CancelReason == ""
+	var heapBefore []*Order
+	if resting {
+		heapBefore = ob.heapOrders(old.Side)
+	}
+	ob.cancel(oldID, Replaced)
+	trades, err := ob.insert(newOrder)
+	if err != nil && resting {
+		ob.log.Printf("Rejected replace of order %d by %d, restoring order %d: %v\n", oldID, newOrder.ID, oldID, err)
+		old.Cancelled, old.CancelReason = false, ""
+		ob.restoreHeap(old.Side, heapBefore)
+	}
+	return trades, err
+}
+
+// heapOrders returns a copy of the heap array of side (BUY or SELL), see restoreHeap.
+func (ob *OrderBook) heapOrders(side string) []*Order {
+	if side == "BUY" {
+		return append([]*Order(nil), *ob.BuyOrders...)
+	}
+	return append([]*Order(nil), *ob.SellOrders...)
+}
+
+// restoreHeap puts back the heap array of side taken by heapOrders, along with the HeapIndex of its orders.
+func (ob *OrderBook) restoreHeap(side string, orders []*Order) {
+	for i, order := range orders {
+		order.HeapIndex = i
+	}
+	if side == "BUY" {
+		*ob.BuyOrders = orders
+	} else {
+		*ob.SellOrders = orders
+	}
+}
+
+// Reprice changes only the price of an order, keeping its current volume. It is Update with the volume read from the
+// book, so callers can't accidentally resize the order by passing a stale volume. Unknown orders are ignored.
+func (ob *OrderBook) Reprice(orderID int, newPrice float64) ([]Trade, error) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	defer ob.publishLevels()
+	defer ob.repeg()
+
+	order, exists := ob.Orders[orderID]
+	if !exists {
+		ob.log.Printf("Order %d not found. Unable to reprice.\n", orderID)
+		return nil, nil
+	}
+	return ob.update(orderID, newPrice, order.Volume)
+}
+
+// Resize changes only the volume of an order, keeping its current price. It is Update with the price read from the
+// book, so callers can't accidentally move the order by passing a stale price. Unknown orders are ignored.
+func (ob *OrderBook) Resize(orderID int, newVolume int) ([]Trade, error) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	defer ob.publishLevels()
+	defer ob.repeg()
+
+	order, exists := ob.Orders[orderID]
+	if !exists {
+		ob.log.Printf("Order %d not found. Unable to resize.\n", orderID)
+		return nil, nil
+	}
+	return ob.update(orderID, order.Price, newVolume)
+}
+
+// matchOrders creates system matching. A very icky part was to correctly assign maker and taker. Also, we had to make a special case for two sell orders.
+// It returns the trades executed by this call, i.e. the tail it appended to ob.Executions.
+func (ob *OrderBook) matchOrders(initiatingOrderID int, initiatingOrderSide string) []Trade {
+	if ob.halted {
+		ob.log.Println("Trading is halted, not matching.")
+		return nil
+	}
+	if order, exists := ob.Orders[initiatingOrderID]; exists && order.MinFill > 0 && order.CancelReason == "" {
+		if available := ob.crossingVolume(order); available < int64(min(order.MinFill, order.Volume)) {
+			ob.log.Printf("Order %d needs %d to trade, only %d available, not matching.\n", order.ID, order.MinFill, available)
+			return nil
+		}
+	}
+	if ob.allocation == ProRata {
+		return ob.matchProRata(initiatingOrderID)
+	}
+	executed := len(ob.Executions)
+	topBuy, hasBuy := ob.BuyOrders.Peek()
+	topSell, hasSell := ob.SellOrders.Peek()
+	if hasBuy && hasSell {
+		ob.log.Printf("Top Buy Order: %+v\n", topBuy)
+		ob.log.Printf("Top Sell Order: %+v\n", topSell)
+	}
+
+	var handleTwoSells bool
+	if ob.SellOrders.Len() == 2 {
+		handleTwoSells = true
+	}
+	// a cascade cut short by the fill cap resumes with the price rule it started with
+	if ob.pending != nil && ob.pending.orderID == initiatingOrderID {
+		handleTwoSells = ob.pending.twoSells
+	}
+	ob.pending = nil
+
+	fills := 0
+	for {
+		buyOrder, hasBuy := ob.BuyOrders.Peek()
+		sellOrder, hasSell := ob.SellOrders.Peek()
+		if !hasBuy || !hasSell {
+			break
+		}
+
+		if sellOrder.Cancelled {
+			heap.Pop(ob.SellOrders)
+			continue
+		}
+		if buyOrder.Cancelled {
+			heap.Pop(ob.BuyOrders)
+			continue
+		}
+
+		// Log candidate orders before executing a trade
+		ob.log.Println("Potential matching candidates:")
+		ob.log.Println("Buy order candidates:")
+		for _, o := range *ob.BuyOrders {
+			if o.Price >= sellOrder.Price {
+				ob.log.Printf("Buy Order ID: %d, Price: %.2f, Volume: %d\n", o.ID, o.Price, o.Volume)
+			}
+		}
+		ob.log.Println("Sell order candidates:")
+		for _, o := range *ob.SellOrders {
+			if o.Price <= buyOrder.Price {
+				ob.log.Printf("Sell Order ID: %d, Price: %.2f, Volume: %d\n", o.ID, o.Price, o.Volume)
+			}
+		}
+
+		if ob.crosses(buyOrder.Price, sellOrder.Price) {
+			volume := min(sellOrder.Volume, buyOrder.Volume)
+
+			var taker, maker *Order
+
+			if initiatingOrderID == sellOrder.ID && initiatingOrderSide == "SELL" {
+				taker = sellOrder
+				maker = buyOrder
+			} else {
+				taker = buyOrder
+				maker = sellOrder
+			}
+
+			if ob.preventSelfTrade(taker, maker) {
+				continue
+			}
+
+			matchingPrice := max(sellOrder.Price, buyOrder.Price)
+			if handleTwoSells {
+				matchingPrice = sellOrder.Price
+			}
+			switch {
+			case ob.executionPrice == MakerPrice:
+				matchingPrice = maker.Price
+			case ob.executionPrice == TakerPrice:
+				matchingPrice = taker.Price
+			case ob.executionPrice == MidPrice && buyOrder.Price-sellOrder.Price > ob.priceTolerance():
+				// crossing with room: meet at the midpoint, rounded towards the maker's price when it is off the grid
+				matchingPrice = ob.snapToTick((buyOrder.Price+sellOrder.Price)/2, maker.Side == "SELL")
+			}
+			ob.fill(buyOrder, sellOrder, taker, maker, matchingPrice, volume)
+			fills++
+			if ob.maxFills > 0 && fills >= ob.maxFills {
+				ob.log.Printf("Reached %d fills, pausing the matching of order %d.\n", fills, initiatingOrderID)
+				ob.pending = &pendingMatch{orderID: initiatingOrderID, side: initiatingOrderSide, twoSells: handleTwoSells}
+				break
+			}
+		} else {
+			break
+		}
+	}
+
+	trades := ob.tradesSince(executed)
+	ob.triggerOCO(trades)
+	return trades
+}
+
+// preventSelfTrade applies the book's SelfTradeMode to a taker and a maker about to trade. If they belong to the same
+// account and the mode prevents the trade, it cancels one or both of them (SelfTradePrevention) and reports true: the
+// top of the book changed and must be looked at again.
+func (ob *OrderBook) preventSelfTrade(taker, maker *Order) bool {
+	if taker.Account == "" || taker.Account != maker.Account {
+		return false
+	}
+	switch ob.selfTrade {
+	case CancelNewest:
+		ob.cancel(taker.ID, SelfTradePrevention)
+	case CancelOldest:
+		ob.cancel(maker.ID, SelfTradePrevention)
+	case DecrementAndCancel:
+		volume := min(taker.Volume, maker.Volume)
+		for _, order := range []*Order{taker, maker} {
+			order.Volume -= volume
+			if order.Volume == 0 {
+				ob.cancel(order.ID, SelfTradePrevention)
+			} else {
+				ob.fixOrderInHeap(order)
+			}
+		}
+	default:
+		return false
+	}
+	ob.log.Printf("Prevented a self trade between orders %d and %d of account %s\n", taker.ID, maker.ID, taker.Account)
+	return true
+}
+
+// tradesSince returns a copy of the trades executed after the first executed ones, nil if there are none. It is a copy
+// so appending to the returned trades never overwrites later executions.
+func (ob *OrderBook) tradesSince(executed int) []Trade {
+	if len(ob.Executions) == executed {
+		return nil
+	}
+	return append([]Trade(nil), ob.Executions[executed:]...)
+}
+
+// fill trades volume between the top buy and the top sell order at price: it decrements both orders, records the trade
+// (Executions, Trades, journal, LastPrice) and pops the orders it fully filled.
+func (ob *OrderBook) fill(buyOrder, sellOrder, taker, maker *Order, price float64, volume int) {
+	sellOrder.Volume -= volume
+	buyOrder.Volume -= volume
+	ob.recordTrade(taker, maker, price, volume)
+
+	// a partially filled top order stays in place, unless the VolumeFirst tie break moves it behind a larger one or it
+	// is an iceberg losing its priority on refill
+	if sellOrder.Volume == 0 && !ob.replenish(sellOrder) {
+		sellOrder.CancelReason = FullyFilled
+		heap.Pop(ob.SellOrders)
+	} else {
+		heap.Fix(ob.SellOrders, 0)
+	}
+	if buyOrder.Volume == 0 && !ob.replenish(buyOrder) {
+		buyOrder.CancelReason = FullyFilled
+		heap.Pop(ob.BuyOrders)
+	} else {
+		heap.Fix(ob.BuyOrders, 0)
+	}
+}
+
+// recordTrade records a trade of volume at price between taker and maker, whose volumes were already decremented:
+// Executions, Trades, the journal and LastPrice.
+func (ob *OrderBook) recordTrade(taker, maker *Order, price float64, volume int) {
+	ob.nextTradeID++
+	trade := Trade{
+		ID:      ob.nextTradeID,
+		Symbol:  maker.Symbol,
+		Price:   price,
+		Volume:  volume,
+		TakerID: taker.ID,
+		MakerID: maker.ID,
+
+		AggressorSide: taker.Side,
+		IsWash:        taker.Account != "" && taker.Account == maker.Account,
+	}
+	trade.MakerFee = ob.fees.Fee(trade, true)
+	trade.TakerFee = ob.fees.Fee(trade, false)
+	ob.Executions = append(ob.Executions, trade)
+
+	line := trade.format(ob.formatPrice(trade.Price))
+	if ob.verboseTrades {
+		line += fmt.Sprintf(",%d,%d", taker.Volume, maker.Volume)
+	}
+	ob.Trades = append(ob.Trades, line)
+	ob.writeJournal(trade.ID, line)
+	ob.LastPrice = price
+}
+
+// Cancel an order by setting its Cancelled field to true, and remove it from sell / or buy orders depending on its side. We are also using our ob.Orders map here
+// same reasons as we did in Update.
+// Cancel is a no-op if the order already left the book (cancelled, expired or fully filled), so retried cancels are
+// safe and never overwrite the reason the order was first removed for.
+func (ob *OrderBook) Cancel(orderID int) {
+	if ob.latency != nil {
+		defer ob.recordLatency(OpCancel, time.Now())
+	}
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	defer ob.publishLevels()
+	defer ob.repeg()
+	ob.cancel(orderID, UserCancel)
+}
+
+// cancel is Cancel without locking, recording reason as the order's CancelReason.
+func (ob *OrderBook) cancel(orderID int, reason CancelReason) {
+	ob.log.Printf("Attempting to cancel order with ID: %d\n", orderID)
+	order, exists := ob.Orders[orderID]
+	if !exists {
+		ob.log.Println("Order not found. Unable to cancel.")
+	} else if order.CancelReason != "" {
+		ob.log.Printf("Order already removed (%s), nothing to cancel.\n", order.CancelReason)
+	} else {
+		ob.log.Println("Order found and cancelled successfully.")
+		order.Cancelled = true
+		order.CancelReason = reason
+		ob.removeOrderFromHeap(order)
+	}
+}
+
+// CancelByAccount cancels every live resting order of account, e.g. for risk to pull a trader's liquidity, and returns
+// how many orders it cancelled. It walks the account index, not the heaps, so it only costs the account's orders.
+// Anonymous orders (empty Account) are never cancelled this way.
+func (ob *OrderBook) CancelByAccount(account string) int {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	defer ob.publishLevels()
+	defer ob.repeg()
+
+	if account == "" {
+		return 0
+	}
+	ids := make([]int, 0, len(ob.accounts[account]))
+	for id := range ob.accounts[account] {
+		ids = append(ids, id)
+	}
+	// cancel in ID order, so the log (and any level diff) doesn't depend on the map order
+	sort.Ints(ids)
+
+	cancelled := 0
+	for _, id := range ids {
+		if order := ob.accounts[account][id]; order.CancelReason == "" {
+			ob.cancel(id, UserCancel)
+			cancelled++
+		}
+	}
+	// every order of the account left the book
+	delete(ob.accounts, account)
+	ob.log.Printf("Cancelled %d orders of account %s\n", cancelled, account)
+	return cancelled
+}
+
+// Reduce decreases the resting volume of an order by byVolume without touching its price or Inserted timestamp, so the
+// order keeps its queue priority. This is the explicit form of the "volume decrease keeps priority" rule of Update. The
+// reduction of an iceberg comes out of its reserve first, and only then out of its displayed volume. An order reduced
+// to zero (or below), reserve included, is cancelled; non positive reductions and orders that already left the book
+// are ignored.
+func (ob *OrderBook) Reduce(orderID int, byVolume int) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	defer ob.publishLevels()
+	defer ob.repeg()
+
+	ob.log.Printf("Reducing order %d by %d\n", orderID, byVolume)
+	order, exists := ob.Orders[orderID]
+	if !exists || order.CancelReason != "" {
+		ob.log.Println("Order not found or not resting. Unable to reduce.")
+		return
+	}
+	if byVolume <= 0 {
+		ob.log.Println("Non positive reduction, ignoring.")
+		return
+	}
+
+	if byVolume >= order.Volume+order.Reserve {
+		ob.cancel(orderID, UserCancel)
+		return
+	}
+	fromReserve := min(byVolume, order.Reserve)
+	order.Reserve -= fromReserve
+	// a smaller volume doesn't change the order's place in the heap under time priority, so there's nothing to re-sift
+	order.Volume -= byVolume - fromReserve
+	if order.tieBreak == VolumeFirst {
+		ob.fixOrderInHeap(order)
+	}
+}
+
+// fixOrderInHeap restores the heap order after the priority of a resting order changed in place, in O(log n) thanks
+// to its HeapIndex. It reports false, changing nothing, if the order isn't at its HeapIndex (i.e. not in the heap).
+func (ob *OrderBook) fixOrderInHeap(order *Order) bool {
+	i := order.HeapIndex
+	if order.Side == "BUY" {
+		if i >= 0 && i < ob.BuyOrders.Len() && (*ob.BuyOrders)[i] == order {
+			heap.Fix(ob.BuyOrders, i)
+			return true
+		}
+	} else if order.Side == "SELL" {
+		if i >= 0 && i < ob.SellOrders.Len() && (*ob.SellOrders)[i] == order {
+			heap.Fix(ob.SellOrders, i)
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the internal consistency of the book and returns an error describing the first violation found, or
+// nil. It verifies on both heaps that no order comes before its parent by the heap's Less rule, that every order sits at
+// its HeapIndex, on the right side, is the one ob.Orders holds for its ID and hasn't left the book (cancelled, filled,
+// ...). A valid book never fails it; it's meant for tests and fuzzing.
+func (ob *OrderBook) Validate() error {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	if err := ob.validateHeap("BUY", *ob.BuyOrders, ob.BuyOrders.Less); err != nil {
+		return err
+	}
+	return ob.validateHeap("SELL", *ob.SellOrders, ob.SellOrders.Less)
+}
+
+// validateHeap is the Validate check of the heap of one side.
+func (ob *OrderBook) validateHeap(side string, orders []*Order, less func(i, j int) bool) error {
+	for i, order := range orders {
+		if i > 0 && less(i, (i-1)/2) {
+			return fmt.Errorf("%s heap: order %d at %d comes before its parent order %d", side, order.ID, i, orders[(i-1)/2].ID)
+		}
+		if order.HeapIndex != i {
+			return fmt.Errorf("%s heap: order %d is at %d but has HeapIndex %d", side, order.ID, i, order.HeapIndex)
+		}
+		if order.Side != side {
+			return fmt.Errorf("%s heap: order %d has side %q", side, order.ID, order.Side)
+		}
+		if known, exists := ob.Orders[order.ID]; !exists || known != order {
+			return fmt.Errorf("%s heap: order %d isn't the one known by its ID", side, order.ID)
+		}
+		if order.Cancelled || order.CancelReason != "" {
+			return fmt.Errorf("%s heap: order %d left the book (%s) but is still resting", side, order.ID, order.CancelReason)
+		}
+	}
+	return nil
+}
+
+// Reconcile is a safety valve for a book whose heaps and ob.Orders went out of sync, which matching must never see: it
+// could loop on, or trade at the price of, an order that isn't really there. It removes from the heaps every entry
+// that isn't a live order ob.Orders holds for its ID on that side (including duplicates), removes from ob.Orders (and
+// the account index) every live order neither heap holds, restores the heap order, and logs each fix. A consistent
+// book is left unchanged, so it is cheap insurance to run after a suspicious failure, though it costs O(n).
+func (ob *OrderBook) Reconcile() {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	defer ob.publishLevels()
+	defer ob.repeg()
+
+	resting := make(map[*Order]bool, ob.BuyOrders.Len()+ob.SellOrders.Len())
+	buys := MaxHeap(ob.reconcileHeap("BUY", *ob.BuyOrders, resting))
+	sells := MinHeap(ob.reconcileHeap("SELL", *ob.SellOrders, resting))
+	heap.Init(&buys)
+	heap.Init(&sells)
+	*ob.BuyOrders, *ob.SellOrders = buys, sells
+
+	ids := make([]int, 0, len(ob.Orders))
+	for id := range ob.Orders {
+		ids = append(ids, id)
+	}
+	// fix in ID order, so the log doesn't depend on the map order
+	sort.Ints(ids)
+	for _, id := range ids {
+		order := ob.Orders[id]
+		if order.Cancelled || order.CancelReason != "" || resting[order] {
+			continue
+		}
+		ob.log.Printf("Reconcile: order %d is live but in no heap, forgetting it\n", id)
+		delete(ob.Orders, id)
+		if order.Account != "" && ob.accounts[order.Account][id] == order {
+			delete(ob.accounts[order.Account], id)
+		}
+	}
+}
+
+// reconcileHeap is the Reconcile repair of the heap of one side: it returns the entries of orders worth keeping, with
+// their HeapIndex set to their new position, and marks them in resting.
+func (ob *OrderBook) reconcileHeap(side string, orders []*Order, resting map[*Order]bool) []*Order {
+	kept := make([]*Order, 0, len(orders))
+	for _, order := range orders {
+		switch {
+		case order.Side != side:
+			ob.log.Printf("Reconcile: dropping order %d with side %q from the %s heap\n", order.ID, order.Side, side)
+		case ob.Orders[order.ID] != order:
+			ob.log.Printf("Reconcile: dropping order %d, unknown by its ID, from the %s heap\n", order.ID, side)
+		case order.Cancelled || order.CancelReason != "":
+			ob.log.Printf("Reconcile: dropping order %d, which left the book (%s), from the %s heap\n", order.ID, order.CancelReason, side)
+		case resting[order]:
+			ob.log.Printf("Reconcile: dropping a duplicate entry of order %d from the %s heap\n", order.ID, side)
+		default:
+			order.HeapIndex = len(kept)
+			kept = append(kept, order)
+			resting[order] = true
+		}
+	}
+	return kept
+}
+
+// Len returns the number of live (uncancelled) resting orders on each side of the book. Cancelled orders are removed
+// from the heaps, but counting here keeps callers independent of that detail.
+func (ob *OrderBook) Len() (buy int, sell int) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	for _, order := range *ob.BuyOrders {
+		if !order.Cancelled {
+			buy++
+		}
+	}
+	for _, order := range *ob.SellOrders {
+		if !order.Cancelled {
+			sell++
+		}
+	}
+	return buy, sell
+}
+
+// ForEachResting calls fn with a snapshot of every live resting order of side (BUY or SELL), in priority order (best
+// price first, then earliest first), until fn returns false. It walks a copy of the heap, so fn may safely query the
+// book but must not modify it (the read lock is held during the walk).
+func (ob *OrderBook) ForEachResting(side string, fn func(OrderStatus) bool) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	queue := ob.newRestingQueue(side)
+	for queue.Len() > 0 {
+		order := heap.Pop(queue).(*Order)
+		if order.Cancelled {
+			continue
+		}
+		if !fn(order.status()) {
+			return
+		}
+	}
+}
+
+// OrdersAtLevel returns a snapshot of every live resting order of side (BUY or SELL) at price, in priority order: the
+// individual orders behind one level of Depth, hidden ones included. Prices are compared within the book's price
+// tolerance; unknown sides and empty levels return nil.
+func (ob *OrderBook) OrdersAtLevel(side string, price float64) []OrderStatus {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	var orders []OrderStatus
+	queue := ob.newRestingQueue(side)
+	for queue.Len() > 0 {
+		order := heap.Pop(queue).(*Order)
+		if order.Cancelled {
+			continue
+		}
+		if math.Abs(order.Price-price) <= ob.priceTolerance() {
+			orders = append(orders, order.status())
+		} else if orders != nil {
+			break // levels come out one after the other, this one is over
+		}
+	}
+	return orders
+}
+
+// QueuePosition tells how far back a resting order is at its price level: its 0-based position among the live orders
+// of the same side and price level in priority order (time priority, or the book's TieBreak), and the number of such
+// orders. ok is false for unknown orders and orders no longer resting.
+func (ob *OrderBook) QueuePosition(orderID int) (position, levelCount int, ok bool) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	target, exists := ob.Orders[orderID]
+	if !exists || target.Cancelled || target.CancelReason != "" {
+		return 0, 0, false
+	}
+
+	queue := ob.newRestingQueue(target.Side)
+	for queue.Len() > 0 {
+		order := heap.Pop(queue).(*Order)
+		if order.Cancelled || !sameLevel(order, target) {
+			if levelCount > 0 {
+				break // levels come out one after the other, this one is over
+			}
+			continue
+		}
+		if order == target {
+			position, ok = levelCount, true
+		}
+		levelCount++
+	}
+	if !ok {
+		return 0, 0, false
+	}
+	return position, levelCount, true
+}
+
+// GetOrder returns a snapshot of the order with the given ID. Orders that left the book are still returned, with their
+// CancelReason telling why they left.
+func (ob *OrderBook) GetOrder(orderID int) (OrderStatus, bool) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	order, exists := ob.Orders[orderID]
+	if !exists {
+		return OrderStatus{}, false
+	}
+	return order.status(), true
+}
+
+// OrdersOlderThan returns a snapshot of every live resting order inserted more than d before now, oldest first, to
+// flag stale quotes. Inserted comes from the book's clock, so now should too. Iceberg refills losing their priority are
+// timestamped anew and so count as fresh.
+func (ob *OrderBook) OrdersOlderThan(d time.Duration, now time.Time) []OrderStatus {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	cutoff := now.Add(-d)
+	var stale []OrderStatus
+	for _, orders := range [][]*Order{*ob.BuyOrders, *ob.SellOrders} {
+		for _, order := range orders {
+			if !order.Cancelled && order.Inserted.Before(cutoff) {
+				stale = append(stale, order.status())
+			}
+		}
+	}
+	sort.SliceStable(stale, func(i, j int) bool {
+		if !stale[i].Inserted.Equal(stale[j].Inserted) {
+			return stale[i].Inserted.Before(stale[j].Inserted)
+		}
+		return stale[i].ID < stale[j].ID
+	})
+	return stale
+}
+
+// ExpireOrders cancels every resting good-till-date order whose ExpiresAt is at or before now, and returns how many
+// orders were expired. Orders without an ExpiresAt never expire.
+func (ob *OrderBook) ExpireOrders(now time.Time) int {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	defer ob.publishLevels()
+	defer ob.repeg()
+
+	var expired []int
+	for _, order := range *ob.BuyOrders {
+		if !order.ExpiresAt.IsZero() && !now.Before(order.ExpiresAt) {
+			expired = append(expired, order.ID)
+		}
+	}
+	for _, order := range *ob.SellOrders {
+		if !order.ExpiresAt.IsZero() && !now.Before(order.ExpiresAt) {
+			expired = append(expired, order.ID)
+		}
+	}
+	for _, id := range expired {
+		ob.log.Printf("Order %d expired\n", id)
+		ob.cancel(id, Expired)
+	}
+	return len(expired)
+}
+
+// EndSession closes the trading session: every resting DAY order is cancelled with the Expired reason, while GTC orders
+// keep resting for the next session.
+func (ob *OrderBook) EndSession() {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	defer ob.publishLevels()
+	defer ob.repeg()
+
+	var expired []int
+	for _, order := range *ob.BuyOrders {
+		if order.TimeInForce == DAY {
+			expired = append(expired, order.ID)
+		}
+	}
+	for _, order := range *ob.SellOrders {
+		if order.TimeInForce == DAY {
+			expired = append(expired, order.ID)
+		}
+	}
+	for _, id := range expired {
+		ob.log.Printf("Day order %d expired at the end of the session\n", id)
+		ob.cancel(id, Expired)
+	}
+}
+
+// StartExpiry starts a background sweeper calling ExpireOrders with the book's clock every interval. This is what a long
+// running server needs to enforce good-till-date orders without an incoming operation to trigger it. The returned stop
+// function stops the sweeper and waits for it to exit; calling it more than once is safe.
+func (ob *OrderBook) StartExpiry(interval time.Duration) (stop func()) {
+	ticks, stopTicker := ob.newTicker(interval)
+	done := make(chan struct{})
+	exited := make(chan struct{})
+
+	go func() {
+		defer close(exited)
+		for {
+			select {
+			case <-ticks:
+				ob.ExpireOrders(ob.clock())
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			stopTicker()
+			close(done)
+			<-exited
+		})
+	}
+}
+
+// Insert a new symbol to the orderbooks. Since the trading can happen for multiple symbols, these methods acts as a wrapper to appropiate orderbook. They also delegate the
+// heavy lifting to the OrderBook.Insert method. A symbol seen for the first time gets a new book configured with the
+// OrderBooks default options and the symbol's registered configuration. In strict mode, unregistered symbols are
+// rejected with ErrUnknownSymbol.
+func (obs OrderBooks) Insert(order *Order) error {
+	defer obs.triggerContingent()
+	return obs.insert(order)
+}
+
+// insert is Insert without the contingent orders check.
+func (obs OrderBooks) insert(order *Order) error {
+	if symbol, used := obs.ids[order.ID]; obs.globalID && used {
+		return fmt.Errorf("%w: %d already used for %s", ErrDuplicateOrder, order.ID, symbol)
+	}
+	ob, exists := obs.books[order.Symbol]
+	if !exists {
+		cfg, registered := obs.symbols[order.Symbol]
+		if !registered && obs.strict {
+			return fmt.Errorf("%w: %s", ErrUnknownSymbol, order.Symbol)
+		}
+		// full slice expression: never append into the backing array of the shared defaults
+		opts := append(obs.defaults[:len(obs.defaults):len(obs.defaults)], cfg.options()...)
+		ob = NewOrderBook(opts...)
+		obs.books[order.Symbol] = ob
+	}
+	_, err := ob.Insert(order)
+	if err == nil && obs.globalID {
+		obs.ids[order.ID] = order.Symbol
+	}
+	return err
+}
+
+// Update an existing order with symbol in the order book. Also does the same as obs.Insert, by updating an order in a particular symbol and then delegates the extra process to ob.Update
+// A symbol without a book is reported as ErrUnknownSymbol.
+func (obs OrderBooks) Update(order *Order) error {
+	defer obs.triggerContingent()
+	ob, exists := obs.books[order.Symbol]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrUnknownSymbol, order.Symbol)
+	}
+
+	ob.log.Printf("Found OrderBook for symbol %s. Proceeding with update.\n", order.Symbol)
+	_, err := ob.Update(order.ID, order.Price, order.Volume)
+	ob.log.Println("Update call completed for OrderBook.")
+	return err
+}
+
+// TotalOrders returns the number of live resting orders across every symbol and side.
+func (obs OrderBooks) TotalOrders() int {
+	total := 0
+	for _, ob := range obs.books {
+		buy, sell := ob.Len()
+		total += buy + sell
+	}
+	return total
+}
+
+// Cancel an order in the order book. A symbol without a book is reported as ErrUnknownSymbol, there is no book (and
+// no logger) to hand the cancel to.
+func (obs OrderBooks) Cancel(orderID int, symbol string) error {
+	ob, exists := obs.books[symbol]
+	if !exists {
+		return fmt.Errorf("%w: cannot cancel order %d of %s", ErrUnknownSymbol, orderID, symbol)
+	}
+	defer obs.triggerContingent()
+	ob.Cancel(orderID)
+	return nil
+}
+
+// Replace cancels the order oldID and inserts newOrder in its place in the book of newOrder's symbol, see
+// OrderBook.Replace. A symbol without a book is reported as ErrUnknownSymbol.
+func (obs OrderBooks) Replace(oldID int, newOrder *Order) error {
+	if symbol, used := obs.ids[newOrder.ID]; obs.globalID && used {
+		return fmt.Errorf("%w: %d already used for %s", ErrDuplicateOrder, newOrder.ID, symbol)
+	}
+	ob, exists := obs.books[newOrder.Symbol]
+	if !exists {
+		return fmt.Errorf("%w: cannot replace order %d of %s", ErrUnknownSymbol, oldID, newOrder.Symbol)
+	}
+	defer obs.triggerContingent()
+	_, err := ob.Replace(oldID, newOrder)
+	if err == nil && obs.globalID {
+		obs.ids[newOrder.ID] = newOrder.Symbol
+	}
+	return err
+}
+
+// Mid returns the mid price of the book, halfway between the best bid and the best ask. ok is false unless both sides
+// have a live order.
+func (ob *OrderBook) Mid() (mid float64, ok bool) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	bid, hasBid := ob.BuyOrders.Peek()
+	ask, hasAsk := ob.SellOrders.Peek()
+	if !hasBid || !hasAsk || bid.Cancelled || ask.Cancelled {
+		return 0, false
+	}
+	return (bid.Price + ask.Price) / 2, true
+}
+
+// PairSpread returns the spread between the mid prices of symbols a and b, mid(a) - mid(b), for pairs and basket
+// traders. ok is false if either symbol has no book or no mid price.
+func (obs OrderBooks) PairSpread(a, b string) (spread float64, ok bool) {
+	bookA, existsA := obs.books[a]
+	bookB, existsB := obs.books[b]
+	if !existsA || !existsB {
+		return 0, false
+	}
+	midA, okA := bookA.Mid()
+	midB, okB := bookB.Mid()
+	if !okA || !okB {
+		return 0, false
+	}
+	return midA - midB, true
+}
+
+// SpreadTrigger is the condition of a contingent order on the PairSpread of symbols A and B: it is met once the spread
+// is at or above Threshold when Above is set, at or below it otherwise.
+type SpreadTrigger struct {
+	A, B      string
+	Threshold float64
+	Above     bool
+}
+
+// met reports whether the trigger condition holds for the current books.
+func (trigger SpreadTrigger) met(obs OrderBooks) bool {
+	spread, ok := obs.PairSpread(trigger.A, trigger.B)
+	if !ok {
+		return false
+	}
+	if trigger.Above {
+		return spread >= trigger.Threshold-priceEpsilon
+	}
+	return spread <= trigger.Threshold+priceEpsilon
+}
+
+// contingentOrder is an order held back until its trigger is met.
+type contingentOrder struct {
+	order   *Order
+	trigger SpreadTrigger
+}
+
+// InsertContingent holds order back until the spread between two symbols crosses a threshold (see SpreadTrigger), then
+// inserts it like Insert. The trigger is checked right away and after every Insert, Update, Cancel and Replace going
+// through the OrderBooks, since trades and quotes both move the mid prices. A triggered order its book rejects is dropped.
+func (obs OrderBooks) InsertContingent(order *Order, trigger SpreadTrigger) error {
+	if _, waiting := obs.contingent[order.ID]; waiting {
+		return fmt.Errorf("%w: %d is already a contingent order", ErrDuplicateOrder, order.ID)
+	}
+	obs.contingent[order.ID] = contingentOrder{order: order, trigger: trigger}
+	obs.triggerContingent()
+	return nil
+}
+
+// triggerContingent inserts the contingent orders whose trigger is met, in ID order. A triggered order may move the
+// spreads itself, so every trigger is checked against the books as they are at that point, until no more order fires.
+func (obs OrderBooks) triggerContingent() {
+	for fired := true; fired; {
+		fired = false
+		ids := make([]int, 0, len(obs.contingent))
+		for id := range obs.contingent {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			contingent := obs.contingent[id]
+			if !contingent.trigger.met(obs) {
+				continue
+			}
+			delete(obs.contingent, id)
+			obs.insert(contingent.order)
+			fired = true
+		}
+	}
+}
+
+// Router shards symbols across several OrderBooks, e.g. one per worker, by a hash of the symbol: every operation of a
+// symbol is routed to the shard owning it, so a symbol always trades in a single book. It exposes the same Insert,
+// Update and Cancel surface as OrderBooks, and fans queries out to every shard.
+type Router struct {
+	shards []OrderBooks
+}
+
+// NewRouter creates a router over shards OrderBooks (at least one), each created with opts like NewOrderBooks.
+func NewRouter(shards int, opts ...OrderBookOption) *Router {
+	r := &Router{shards: make([]OrderBooks, max(shards, 1))}
+	for i := range r.shards {
+		r.shards[i] = NewOrderBooks(opts...)
+	}
+	return r
+}
+
+// shard returns the index of the shard owning symbol: the FNV-1a hash of the symbol modulo the number of shards.
+func (r *Router) shard(symbol string) int {
+	h := fnv.New32a()
+	h.Write([]byte(symbol))
+	return int(h.Sum32() % uint32(len(r.shards)))
+}
+
+// Insert routes order to the shard owning its symbol, see OrderBooks.Insert.
+func (r *Router) Insert(order *Order) error {
+	return r.shards[r.shard(order.Symbol)].Insert(order)
+}
+
+// Update routes the update to the shard owning the order's symbol, see OrderBooks.Update.
+func (r *Router) Update(order *Order) error {
+	return r.shards[r.shard(order.Symbol)].Update(order)
+}
+
+// Cancel routes the cancel to the shard owning symbol, see OrderBooks.Cancel.
+func (r *Router) Cancel(orderID int, symbol string) error {
+	return r.shards[r.shard(symbol)].Cancel(orderID, symbol)
+}
+
+// Book returns the order book of symbol from its shard, if any order was ever inserted for it.
+func (r *Router) Book(symbol string) (*OrderBook, bool) {
+	return r.shards[r.shard(symbol)].Book(symbol)
+}
+
+// TotalOrders returns the number of live resting orders across every shard.
+func (r *Router) TotalOrders() int {
+	total := 0
+	for _, obs := range r.shards {
+		total += obs.TotalOrders()
+	}
+	return total
+}
+
+// SummarySnapshot is OrderBooks.SummarySnapshot over every shard: the trades of every symbol followed by the book
+// summaries, globally sorted by symbol, so the output is the same as a single OrderBooks would produce.
+func (r *Router) SummarySnapshot() []string {
+	// symbols are disjoint across shards, their books can be merged into a single view
+	all := NewOrderBooks()
+	for _, obs := range r.shards {
+		for symbol, ob := range obs.books {
+			all.books[symbol] = ob
+		}
+	}
+	return all.SummarySnapshot()
+}
+
+// OpType is the kind of an Operation.
+type OpType string
+
+const (
+	OpInsert OpType = "INSERT"
+	OpUpdate OpType = "UPDATE"
+	OpCancel OpType = "CANCEL"
+)
+
+// Operation is the typed form of an operation line, used by OrderBooks.Apply. Symbol may be left empty for updates and
+// cancels, it is then resolved from the ID like runMatchingEngine does; Side is only used by inserts.
+type Operation struct {
+	Type   OpType
+	ID     int
+	Symbol string
+	Side   string
+	Price  float64
+	Volume int
+}
+
+var (
+	// ErrUnknownOperation is returned by Apply for operations of an unknown type.
+	ErrUnknownOperation = errors.New("unknown operation type")
+	// ErrOrderNotFound is returned when an operation targets an order that isn't in the book.
+	ErrOrderNotFound = errors.New("order not found")
+)
+
+// Apply runs a batch of typed operations, in order, and returns one error per operation (nil when it succeeded). It
+// is the programmatic counterpart of runMatchingEngine: no csv parsing, and every rejection is reported to the caller
+// instead of being logged and skipped.
+func (obs OrderBooks) Apply(ops []Operation) []error {
+	errs := make([]error, len(ops))
+	for i, op := range ops {
+		errs[i] = obs.apply(op)
+	}
+	return errs
+}
+
+// apply dispatches a single operation to Insert, Update or Cancel.
+func (obs OrderBooks) apply(op Operation) error {
+	if op.Type == OpInsert {
+		return obs.Insert(&Order{ID: op.ID, Symbol: op.Symbol, Side: op.Side, Price: op.Price, Volume: op.Volume})
+	}
+	if op.Type != OpUpdate && op.Type != OpCancel {
+		return fmt.Errorf("%w: %q", ErrUnknownOperation, op.Type)
+	}
+
+	var existing *Order
+	if op.Symbol == "" {
+		symbol, order, found := obs.findOrder(op.ID, op.Type == OpCancel)
+		if !found {
+			return fmt.Errorf("%w: %d", ErrOrderNotFound, op.ID)
+		}
+		op.Symbol, existing = symbol, order
+	} else if ob, exists := obs.books[op.Symbol]; exists {
+		existing = ob.Orders[op.ID]
+	}
+	if existing == nil {
+		return fmt.Errorf("%w: %d in %s", ErrOrderNotFound, op.ID, op.Symbol)
+	}
+
+	if op.Type == OpCancel {
+		return obs.Cancel(op.ID, op.Symbol)
+	}
+	return obs.Update(&Order{ID: op.ID, Symbol: op.Symbol, Side: existing.Side, Price: op.Price, Volume: op.Volume})
+}
+
+// operationFields is the number of comma separated fields (command included) expected for each command.
+var operationFields = map[string]int{
+	"INSERT": 6,
+	"UPDATE": 4,
+	"CANCEL": 2,
+	"CXR":    5,
+	"PRINT":  2,
+}
+
+// ErrMalformedOperation is returned for operation lines that can't be parsed: unknown commands, a wrong number of
+// fields or non numeric ids, prices and volumes.
+var ErrMalformedOperation = errors.New("malformed operation")
+
+// splitOperation splits an operation line into its fields. It is lenient with hand written input: padded fields and a
+// lowercase command are accepted as is, the values themselves are still validated by applyOperation.
+func splitOperation(operation string) []string {
+	parts := strings.Split(operation, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	parts[0] = strings.ToUpper(parts[0])
+	return parts
+}
+
+// printOperation reports the symbol of a well formed PRINT operation line, ok is false for any other line.
+func printOperation(operation string) (symbol string, ok bool) {
+	parts := splitOperation(operation)
+	if parts[0] != "PRINT" || len(parts) != operationFields["PRINT"] {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// applyOperationOutput applies operation like applyOperation, for the runners collecting their whole output. A PRINT
+// appends its output to out: the trades executed so far (consumed from the books, grouped by symbol like
+// engineOutput), then the summary of the book as of now, each if mode selects it. So an interim summary lands at the
+// point of the run the PRINT was issued at, and the books' Trades only ever hold trades (see Save, WithJournal).
+func applyOperationOutput(obs OrderBooks, operation string, mode OutputMode, out []string) ([]string, error) {
+	ob, err := applyOperation(obs, operation)
+	if err != nil {
+		return out, err
+	}
+	symbol, ok := printOperation(operation)
+	if !ok {
+		return out, nil
+	}
+	if trades := engineOutput(obs, OutputTradesOnly); mode != OutputBookOnly {
+		out = append(out, trades...)
+	}
+	if mode != OutputTradesOnly {
+		ob.mu.RLock()
+		out = append(out, ob.summaryLines(symbol)...)
+		ob.mu.RUnlock()
+	}
+	return out, nil
+}
+
+// applyOperation parses a single csv operation line and applies it to the order books, returning the book the operation
+// was routed to (nil if none). Malformed lines are reported as ErrMalformedOperation and leave the books untouched, so a
+// truncated line can't crash the whole run.
+func applyOperation(obs OrderBooks, operation string) (*OrderBook, error) {
+	parts := splitOperation(operation)
+
+	fields, known := operationFields[parts[0]]
+	if !known {
+		return nil, fmt.Errorf("%w: unknown command %q", ErrMalformedOperation, parts[0])
+	}
+	if len(parts) != fields {
+		return nil, fmt.Errorf("%w: %s expects %d fields, got %d", ErrMalformedOperation, parts[0], fields, len(parts))
+	}
+
+	if parts[0] == "PRINT" {
+		// PRINT,<symbol> doesn't change the book, printing it is up to the runner (see printOperation): only the
+		// symbol is checked here
+		ob, exists := obs.books[parts[1]]
+		if !exists {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownSymbol, parts[1])
+		}
+		return ob, nil
+	}
+
+	orderID, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid order id %q", ErrMalformedOperation, parts[1])
+	}
+
+	switch parts[0] {
+	case "INSERT":
+		symbol := parts[2]
+		side := strings.ToUpper(parts[3])
+		price, volume, err := parsePriceVolume(parts[4], parts[5], obs.decimals)
+		if err != nil {
+			return nil, err
+		}
+		order := &Order{
+			ID:     orderID,
+			Symbol: symbol,
+			Side:   side,
+			Price:  price,
+			Volume: volume,
+		}
+		err = obs.Insert(order)
+		return obs.books[symbol], err
+	case "UPDATE":
+		price, volume, err := parsePriceVolume(parts[2], parts[3], obs.decimals)
+		if err != nil {
+			return nil, err
+		}
+		symbol, existing, found := obs.findOrder(orderID, false)
+		if !found {
+			return nil, nil
+		}
+		order := &Order{
+			ID:     orderID,
+			Symbol: symbol,
+			Side:   existing.Side,
+			Price:  price,
+			Volume: volume,
+		}
+
+		return obs.books[symbol], obs.Update(order)
+
+	case "CANCEL":
+		symbol, _, found := obs.findOrder(orderID, true)
+		if !found {
+			return nil, fmt.Errorf("resting order %d not found", orderID)
+		}
+		return obs.books[symbol], obs.Cancel(orderID, symbol)
+
+	case "CXR":
+		// CXR,<old_id>,<new_id>,<price>,<volume>: the new order takes the symbol and side of the old one
+		newID, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid order id %q", ErrMalformedOperation, parts[2])
+		}
+		price, volume, err := parsePriceVolume(parts[3], parts[4], obs.decimals)
+		if err != nil {
+			return nil, err
+		}
+		symbol, existing, found := obs.findOrder(orderID, true)
+		if !found {
+			return nil, fmt.Errorf("resting order %d not found", orderID)
+		}
+		order := &Order{
+			ID:     newID,
+			Symbol: symbol,
+			Side:   existing.Side,
+			Price:  price,
+			Volume: volume,
+		}
+		return obs.books[symbol], obs.Replace(orderID, order)
+	}
+	return nil, nil
+}
+
+// findOrder looks up an order by ID across all symbols, restricted to orders still resting in their book if resting is
+// set. IDs are only unique per symbol, so when several symbols know the ID the alphabetically first one wins: symbols
+// are visited in sorted order (never in map order) to keep the resolution deterministic.
+func (obs OrderBooks) findOrder(orderID int, resting bool) (string, *Order, bool) {
+	for _, symbol := range obs.sortedSymbols() {
+		order, exists := obs.books[symbol].Orders[orderID]
+		if !exists || (resting && order.CancelReason != "") {
+			continue
+		}
+		return symbol, order, true
+	}
+	return "", nil, false
+}
+
+// plainDecimal matches the prices of the csv input: digits, optionally followed by a "." and more digits. It keeps out
+// what strconv.ParseFloat would accept besides ("NaN", "Inf", "1e-9", "0x1p-2", ...), which would bypass the decimals
+// check.
+var plainDecimal = regexp.MustCompile(`^-?\d+(\.\d+)?$`)
+
+// parsePriceVolume parses the price and volume columns of an INSERT, UPDATE or CXR line. Prices must be plain decimal
+// text, with at most decimals digits behind the ".".
+func parsePriceVolume(rawPrice, rawVolume string, decimals int) (float64, int, error) {
+	if !plainDecimal.MatchString(rawPrice) {
+		return 0, 0, fmt.Errorf("%w: invalid price %q", ErrMalformedOperation, rawPrice)
+	}
+	price, err := strconv.ParseFloat(rawPrice, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: invalid price %q", ErrMalformedOperation, rawPrice)
+	}
+	// the digits are counted on the raw text, the float may not represent them exactly; trailing zeros don't count
+	if dot := strings.IndexByte(rawPrice, '.'); dot >= 0 && len(strings.TrimRight(rawPrice[dot+1:], "0")) > decimals {
+		return 0, 0, fmt.Errorf("%w: price %q has more than %d decimals", ErrMalformedOperation, rawPrice, decimals)
+	}
+	volume, err := strconv.Atoi(rawVolume)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: invalid volume %q", ErrMalformedOperation, rawVolume)
+	}
+	return price, volume, nil
+}
+
+// OutputMode controls which sections of the output the matching engine emits.
+type OutputMode int
+
+const (
+	OutputBoth       OutputMode = iota // the trades followed by the book summary (default)
+	OutputTradesOnly                   // only the trade tape
+	OutputBookOnly                     // only the final book summary
+)
+
+// runMatchingEngine a helper method to parse the input and run the matching engine. It also returns the output in the expected format.
+func runMatchingEngine(operations []string) []string {
+	return runMatchingEngineMode(operations, OutputBoth)
+}
+
+// runMatchingEngineMode runs the matching engine like runMatchingEngine, but only returns the sections selected by mode.
+func runMatchingEngineMode(operations []string, mode OutputMode) []string {
+	logger := engineLogger()
+
+	obs := NewOrderBooks(WithLogger(logger))
+	var output []string // the output of the PRINT operations, see applyOperationOutput
+	for _, operation := range operations {
+		var err error
+		if output, err = applyOperationOutput(obs, operation, mode, output); err != nil {
+			logger.Printf("Skipping operation %q: %v\n", operation, err)
+		}
+	}
+	return append(output, engineOutput(obs, mode)...)
+}
+
+// engineLogger is the logger of the matching engine runs. It discards everything, logging every operation is far too
+// slow for the expected input sizes; point it to os.Stderr when debugging.
+func engineLogger() *log.Logger {
+	return log.New(io.Discard, "matching-engine: ", log.Ldate|log.Ltime|log.Lshortfile)
+}
+
+// engineOutput collects the trades of every book (grouped by symbol, in alphabetical order) followed by their book
+// summaries, restricted to the sections selected by mode. The books' trades are consumed. Every book is locked for the
+// whole collection, so the output is a consistent view even while other goroutines keep trading.
+func engineOutput(obs OrderBooks, mode OutputMode) []string {
+	defer obs.lockAll()()
+
+	var trades, summaries []string
+	for _, symbol := range obs.sortedSymbols() {
+		ob := obs.books[symbol]
+		trades = append(trades, ob.Trades...)
+		ob.Trades = nil
+		summaries = append(summaries, ob.summaryLines(symbol)...)
+	}
+
+	switch mode {
+	case OutputTradesOnly:
+		return trades
+	case OutputBookOnly:
+		return summaries
+	}
+	output := append(trades, summaries...)
+	return output
+}
+
+// SummarySnapshot returns the output of runMatchingEngine for the current state of the books: the pending trades of
+// every symbol followed by the book summaries. It takes the lock of every book before reading any of them, so the
+// snapshot is consistent across symbols even with concurrent inserts, and it consumes the trades like
+// runMatchingEngine does. Books must not be created (first insert of a new symbol) concurrently, the OrderBooks map
+// itself isn't synchronized.
+func (obs OrderBooks) SummarySnapshot() []string {
+	return engineOutput(obs, OutputBoth)
+}
+
+// snapshotVersion is the version of the format written by OrderBooks.Save, bumped on incompatible changes.
+const snapshotVersion = 1
+
+// ErrSnapshotVersion is returned by LoadOrderBooks for snapshots written in a format version it doesn't know.
+var ErrSnapshotVersion = errors.New("unsupported snapshot version")
+
+// booksSnapshot is the persisted form of an OrderBooks, see Save.
+type booksSnapshot struct {
+	Version  int
+	Strict   bool
+	GlobalID bool
+	Decimals int
+	Symbols  map[string]SymbolConfig
+	IDs      map[int]string
+	Books    []bookSnapshot
+}
+
+// bookSnapshot is the persisted form of one symbol's book: its resting orders in priority order (bids then asks), its
+// trades and its halt or auction state.
+type bookSnapshot struct {
+	Symbol      string
+	Orders      []Order
+	Trades      []string
+	Executions  []Trade
+	LastPrice   float64
+	NextTradeID int
+	Halted      bool
+	InAuction   bool
+}
+
+// Save writes every symbol's resting orders, trades and halt state to w as versioned JSON, for warm restarts with
+// LoadOrderBooks. The books are locked for the whole write, so the snapshot is consistent across symbols. Book
+// options (logger, fees, tick size, ...) are code rather than state and aren't saved, except the registered symbol
+// configurations; neither are the orders that left the book, OCO links and contingent orders.
+func (obs OrderBooks) Save(w io.Writer) error {
+	defer obs.lockAll()()
+
+	snapshot := booksSnapshot{
+		Version:  snapshotVersion,
+		Strict:   obs.strict,
+		GlobalID: obs.globalID,
+		Decimals: obs.decimals,
+		Symbols:  obs.symbols,
+		IDs:      obs.ids,
+	}
+	for _, symbol := range obs.sortedSymbols() {
+		ob := obs.books[symbol]
+		book := bookSnapshot{
+			Symbol:      symbol,
+			Trades:      ob.Trades,
+			Executions:  ob.Executions,
+			LastPrice:   ob.LastPrice,
+			NextTradeID: ob.nextTradeID,
+			Halted:      ob.halted,
+			InAuction:   ob.inAuction,
+		}
+		// priority order, so reloading in slice order keeps the queue of orders with equal timestamps
+		for _, side := range []string{"BUY", "SELL"} {
+			queue := ob.newRestingQueue(side)
+			for queue.Len() > 0 {
+				if order := heap.Pop(queue).(*Order); !order.Cancelled {
+					book.Orders = append(book.Orders, *order)
+				}
+			}
+		}
+		snapshot.Books = append(snapshot.Books, book)
+	}
+	return json.NewEncoder(w).Encode(snapshot)
+}
+
+// LoadOrderBooks reads books written by Save. The opts are applied to every book like NewOrderBooks does, followed by
+// the saved configuration of its symbol; the resting orders keep their saved priority. The resting orders are restored
+// as they were, without the insert checks (see validateRestored), and a halted book stays halted.
+func LoadOrderBooks(r io.Reader, opts ...OrderBookOption) (OrderBooks, error) {
+	var snapshot booksSnapshot
+	if err := json.NewDecoder(r).Decode(&snapshot); err != nil {
+		return OrderBooks{}, fmt.Errorf("decoding snapshot: %w", err)
+	}
+	if snapshot.Version != snapshotVersion {
+		return OrderBooks{}, fmt.Errorf("%w: %d", ErrSnapshotVersion, snapshot.Version)
+	}
+
+	obs := NewOrderBooks(opts...)
+	obs.strict, obs.globalID, obs.decimals = snapshot.Strict, snapshot.GlobalID, snapshot.Decimals
+	maps.Copy(obs.symbols, snapshot.Symbols)
+	maps.Copy(obs.ids, snapshot.IDs)
+	for _, book := range snapshot.Books {
+		orders := make([]*Order, len(book.Orders))
+		for i := range book.Orders {
+			orders[i] = &book.Orders[i]
+		}
+		// full slice expression: never append into the backing array of the shared defaults
+		bookOpts := append(obs.defaults[:len(obs.defaults):len(obs.defaults)], obs.symbols[book.Symbol].options()...)
+		ob, err := newOrderBookWithOrders(orders, validateRestored, bookOpts...)
+		if err != nil {
+			return OrderBooks{}, fmt.Errorf("loading %s: %w", book.Symbol, err)
+		}
+		ob.Trades = append(ob.Trades, book.Trades...)
+		ob.Executions = book.Executions
+		ob.LastPrice, ob.nextTradeID = book.LastPrice, book.NextTradeID
+		ob.halted, ob.inAuction = book.Halted, book.InAuction
+		obs.books[book.Symbol] = ob
+	}
+	return obs, nil
+}
+
+// lockAll takes the write lock of every book, in alphabetical order of their symbols so two concurrent callers can
+// never deadlock, and returns the function releasing them.
+func (obs OrderBooks) lockAll() (unlock func()) {
+	symbols := obs.sortedSymbols()
+	for _, symbol := range symbols {
+		obs.books[symbol].mu.Lock()
+	}
+	return func() {
+		for _, symbol := range symbols {
+			obs.books[symbol].mu.Unlock()
+		}
+	}
+}
+
+// RunMatchingEngineStream runs the matching engine like runMatchingEngine but writes to w instead of building the
+// whole output in memory: every trade is written as soon as it is executed, and the per symbol summaries are written
+// once all operations are applied. Since trades are flushed as they happen, the tape is strictly chronological across
+// all symbols (runMatchingEngine groups it by symbol). The first write error aborts the run.
+func RunMatchingEngineStream(operations []string, w io.Writer) error {
+	logger := engineLogger()
+
+	obs := NewOrderBooks(WithLogger(logger))
+	for _, operation := range operations {
+		ob, err := applyOperation(obs, operation)
+		if err != nil {
+			logger.Printf("Skipping operation %q: %v\n", operation, err)
+		}
+		if ob == nil {
+			continue
+		}
+		if err := writeLines(w, ob.Trades); err != nil {
+			return err
+		}
+		// the trades are on the wire, drop them while keeping the capacity for the next operation
+		ob.Trades = ob.Trades[:0]
+		if symbol, ok := printOperation(operation); ok {
+			if err := writeLines(w, ob.summaryLines(symbol)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, symbol := range obs.sortedSymbols() {
+		if err := writeLines(w, obs.books[symbol].summaryLines(symbol)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunMatchingEngineCtx is the long running counterpart of runMatchingEngine: it applies the operations received on ops
+// until ops is closed (returning nil) or ctx is cancelled (returning ctx.Err()), sending every executed trade to out.
+// An operation is always matched to completion before ctx is checked again, so a cancellation never leaves a book
+// half matched; the trades of that last operation are still delivered unless ctx is cancelled while sending them.
+// out is not closed.
+func RunMatchingEngineCtx(ctx context.Context, ops <-chan string, out chan<- Trade) error {
+	logger := engineLogger()
+
+	obs := NewOrderBooks(WithLogger(logger))
+	sent := make(map[*OrderBook]int) // number of Executions already sent, per book
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case operation, ok := <-ops:
+			if !ok {
+				return nil
+			}
+			ob, err := applyOperation(obs, operation)
+			if err != nil {
+				logger.Printf("Skipping operation %q: %v\n", operation, err)
+			}
+			if ob == nil {
+				continue
+			}
+			for _, trade := range ob.Executions[sent[ob]:] {
+				select {
+				case out <- trade:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			sent[ob] = len(ob.Executions)
+		}
+	}
+}
+
+// writeLines writes every line followed by a newline.
+func writeLines(w io.Writer, lines []string) error {
+	for _, line := range lines {
+		if _, err := io.WriteString(w, line+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sortedSymbols returns the symbols of all order books in alphabetical order.
+func (obs OrderBooks) sortedSymbols() []string {
+	symbols := make([]string, 0, len(obs.books))
+	for symbol := range obs.books {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+	return symbols
+}
+
+// summaryLines formats the levels of AskLevels and BidLevels in the expected output format: the "===<symbol>==="
+// separator, then the SELL levels, then the BUY levels. Hidden orders are left out.
+//
+// Only orders with remaining volume are aggregated and empty levels are dropped, so a price level exhausted by matching
+// never shows up as e.g. SELL,price,0.
+func (ob *OrderBook) summaryLines(symbol string) []string {
+	bids, asks := ob.bidLevels(), ob.askLevels()
+	// the asks are listed worst (highest) price first, unless configured otherwise
+	if ob.summaryOrder != AsksAscending {
+		slices.Reverse(asks)
+	}
+
+	summaries := make([]string, 0, 1+len(asks)+len(bids))
+	summaries = append(summaries, "==="+symbol+"===")
+
+	for _, orderSummary := range asks {
+		summaries = append(summaries, fmt.Sprintf("SELL,%s,%d", ob.formatPrice(orderSummary.Price), orderSummary.Volume))
+	}
+
+	for _, orderSummary := range bids {
+		summaries = append(summaries, fmt.Sprintf("BUY,%s,%d", ob.formatPrice(orderSummary.Price), orderSummary.Volume))
+	}
+	return summaries
+}
+
+// RenderTable renders the visible book as an aligned ladder for humans, e.g. when debugging from the CLI: the asks on
+// top (worst price first), a middle line with the mid price, then the bids (best price first). Every level shows its
+// price, its volume and the cumulative volume from the top of its side, so the cumulative column grows away from the
+// middle. It is for eyeballing only, the machine output stays the summary lines.
+func (ob *OrderBook) RenderTable() string {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "SIDE\tPRICE\tVOLUME\tCUMULATIVE\t")
+
+	bids, asks := ob.bidLevels(), ob.askLevels()
+	rows := make([]string, len(asks))
+	var cumulative int64
+	for i, level := range asks {
+		cumulative += level.Volume
+		// the asks are printed worst price first, the cumulative volume is still summed from the best one
+		rows[len(asks)-1-i] = fmt.Sprintf("SELL\t%s\t%d\t%d\t", ob.formatPrice(level.Price), level.Volume, cumulative)
+	}
+	for _, row := range rows {
+		fmt.Fprintln(w, row)
+	}
+
+	if len(bids) > 0 && len(asks) > 0 {
+		fmt.Fprintf(w, "---\tmid %s\t---\t---\t\n", ob.formatPrice((bids[0].Price+asks[0].Price)/2))
+	} else {
+		fmt.Fprintln(w, "---\t---\t---\t---\t")
+	}
+
+	cumulative = 0
+	for _, level := range bids {
+		cumulative += level.Volume
+		fmt.Fprintf(w, "BUY\t%s\t%d\t%d\t\n", ob.formatPrice(level.Price), level.Volume, cumulative)
+	}
+	w.Flush()
+	return b.String()
+}
+
+// priceEpsilon is the tolerance used when comparing two float prices for equality. Prices carry at most 4 decimals,
+// so anything below that precision is floating point noise (e.g. 0.1+0.2 vs 0.3) rather than a different price level.
+const priceEpsilon = 1e-9
+
+// samePrice reports whether two prices belong to the same price level.
+func samePrice(a, b float64) bool {
+	return math.Abs(a-b) < priceEpsilon
+}
+
+// VolumeAtPrice returns the total uncancelled resting volume for the given side (BUY or SELL) at a single price level.
+// It is the single-level counterpart of the aggregation done in runMatchingEngine, and is useful for smart order routers
+// deciding how much they can take at a level. Unknown sides return 0.
+func (ob *OrderBook) VolumeAtPrice(side string, price float64) int64 {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	var orders []*Order
+	switch side {
+	case "BUY":
+		orders = *ob.BuyOrders
+	case "SELL":
+		orders = *ob.SellOrders
+	default:
+		ob.log.Printf("Order side not recognized: %s\n", side)
+		return 0
+	}
+
+	var volume int64
+	for _, order := range orders {
+		if !order.Cancelled && samePrice(order.Price, price) {
+			volume += int64(order.Volume)
+		}
+	}
+	return volume
+}
+
+// TotalVolume returns the total uncancelled resting volume of a side (BUY or SELL), like VolumeAtPrice summed over every
+// level but without building the levels. Empty and unknown sides return 0.
+func (ob *OrderBook) TotalVolume(side string) int64 {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	var orders []*Order
+	switch side {
+	case "BUY":
+		orders = *ob.BuyOrders
+	case "SELL":
+		orders = *ob.SellOrders
+	default:
+		ob.log.Printf("Order side not recognized: %s\n", side)
+		return 0
+	}
+
+	var volume int64
+	for _, order := range orders {
+		if !order.Cancelled {
+			volume += int64(order.Volume)
+		}
+	}
+	return volume
+}
+
+// CostToFill answers "what average price would an order of side (BUY or SELL) for volume pay right now?": it walks the
+// opposite side of the book in priority order, best price first, accumulating until volume is reached or the liquidity
+// runs out. It returns the volume weighted average price of what could be filled, the filled volume, and whether the
+// whole volume could be filled. Hidden orders and iceberg reserves are counted since an aggressive order would trade
+// against them; limit prices, MinFill and self trade prevention are not considered. The book isn't modified, the walk
+// is done on a copy of the heap. Unknown sides and non-positive volumes return 0, 0, false.
+func (ob *OrderBook) CostToFill(side string, volume int) (avgPrice float64, filled int, ok bool) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	var queue *restingQueue
+	switch side {
+	case "BUY":
+		queue = ob.newRestingQueue("SELL")
+	case "SELL":
+		queue = ob.newRestingQueue("BUY")
+	default:
+		ob.log.Printf("Order side not recognized: %s\n", side)
+		return 0, 0, false
+	}
+	if volume <= 0 {
+		return 0, 0, false
+	}
+
+	notional := 0.0
+	for queue.Len() > 0 && filled < volume {
+		order := heap.Pop(queue).(*Order)
+		if order.Cancelled {
+			continue
+		}
+		quantity := min(order.Volume+order.Reserve, volume-filled)
+		notional += order.Price * float64(quantity)
+		filled += quantity
+	}
+	if filled == 0 {
+		return 0, 0, false
+	}
+	return notional / float64(filled), filled, filled == volume
+}
+
+// Depth returns the aggregated volume of the top levels price levels of each side, best price first: bids from the
+// highest price down, asks from the lowest price up. Like the summary, it leaves out hidden and cancelled orders. A
+// non-positive levels returns every level.
+func (ob *OrderBook) Depth(levels int) (bids, asks []OrderSummary) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	bids, asks = ob.bidLevels(), ob.askLevels()
+	if levels > 0 {
+		bids, asks = bids[:min(levels, len(bids))], asks[:min(levels, len(asks))]
+	}
+	return bids, asks
+}
+
+// BidLevels returns every visible bid price level, aggregated and sorted best (highest) price first: the structured
+// form of the BUY lines of the summary.
+func (ob *OrderBook) BidLevels() []OrderSummary {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+	return ob.bidLevels()
+}
+
+// AskLevels returns every visible ask price level, aggregated and sorted best (lowest) price first: the structured
+// form of the SELL lines of the summary, which lists them the other way around by default.
+func (ob *OrderBook) AskLevels() []OrderSummary {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+	return ob.askLevels()
+}
+
+// bidLevels is BidLevels without locking.
+func (ob *OrderBook) bidLevels() []OrderSummary {
+	return aggregateLevels(*ob.BuyOrders, func(a, b float64) bool { return a > b })
+}
+
+// askLevels is AskLevels without locking.
+func (ob *OrderBook) askLevels() []OrderSummary {
+	return aggregateLevels(*ob.SellOrders, func(a, b float64) bool { return a < b })
+}
+
+// aggregateLevels sums the visible (uncancelled, not hidden, non-empty) volume of orders per price level and sorts the
+// levels with better.
+func aggregateLevels(orders []*Order, better func(a, b float64) bool) []OrderSummary {
+	volumes := levelVolumes(orders)
+	summaries := make([]OrderSummary, 0, len(volumes))
+	for price, volume := range volumes {
+		summaries = append(summaries, OrderSummary{Price: price, Volume: volume})
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return better(summaries[i].Price, summaries[j].Price)
+	})
+	return summaries
+}
+
+// levelVolumes sums the visible (uncancelled, not hidden, non-empty) volume of orders per displayed price.
+func levelVolumes(orders []*Order) map[float64]int64 {
+	volumes := make(map[float64]int64)
+	for _, order := range orders {
+		if !order.Cancelled && !order.Hidden && order.Volume > 0 {
+			volumes[order.displayedPrice()] += int64(order.Volume)
+		}
+	}
+	return volumes
+}
+
+// LevelCount returns the number of visible price levels of each side, the levels Depth(0) would return, as a compact
+// book health metric. It only counts the aggregated levels, without sorting or materializing them.
+func (ob *OrderBook) LevelCount() (bidLevels, askLevels int) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+	return len(levelVolumes(*ob.BuyOrders)), len(levelVolumes(*ob.SellOrders))
+}
+
+// ChecksumLevels is the number of price levels of each side covered by Checksum.
+const ChecksumLevels = 10
+
+// Checksum returns a CRC32 (IEEE) of the visible top of the book, for market data consumers to check their local copy
+// hasn't missed an update. The checksummed string is built from the top ChecksumLevels levels of each side as returned
+// by Depth, interleaving bid and ask levels best first, each as "<price>:<volume>" with the price in the formatting
+// of the trade lines, all joined by ":" (e.g. "45:5:46:3:44.5:2" for two bids 45x5 and 44.5x2 and an ask 46x3). An
+// empty book checksums the empty string.
+func (ob *OrderBook) Checksum() uint32 {
+	bids, asks := ob.Depth(ChecksumLevels)
+
+	var fields []string
+	for i := 0; i < max(len(bids), len(asks)); i++ {
+		if i < len(bids) {
+			fields = append(fields, formatFloat(bids[i].Price), strconv.FormatInt(bids[i].Volume, 10))
+		}
+		if i < len(asks) {
+			fields = append(fields, formatFloat(asks[i].Price), strconv.FormatInt(asks[i].Volume, 10))
+		}
+	}
+	return crc32.ChecksumIEEE([]byte(strings.Join(fields, ":")))
+}
+
+// Imbalance returns the order flow imbalance (bidVolume - askVolume) / (bidVolume + askVolume) over the top levels
+// price levels of each side, as reported by Depth. The result is in [-1, 1]: +1 when only bids rest on the book, -1
+// when only asks do, and 0 for an empty book.
+func (ob *OrderBook) Imbalance(levels int) float64 {
+	bids, asks := ob.Depth(levels)
+
+	var bidVolume, askVolume int64
+	for _, level := range bids {
+		bidVolume += level.Volume
+	}
+	for _, level := range asks {
+		askVolume += level.Volume
+	}
+
+	if bidVolume+askVolume == 0 {
+		return 0
+	}
+	return float64(bidVolume-askVolume) / float64(bidVolume+askVolume)
+}
+
+// LevelChangeKind tells what happened to a price level in a LevelChange.
+type LevelChangeKind string
+
+const (
+	LevelAdded    LevelChangeKind = "ADD"    // the level appeared
+	LevelModified LevelChangeKind = "MODIFY" // the volume of the level changed
+	LevelRemoved  LevelChangeKind = "REMOVE" // the level is gone, Volume is 0
+)
+
+// LevelChange is an incremental update of the visible book: the new aggregated Volume of one price level, recorded
+// at the book sequence number Seq.
+type LevelChange struct {
+	Seq    int64
+	Side   string
+	Price  float64
+	Volume int64
+	Kind   LevelChangeKind
+}
+
+// levelKey identifies a price level of one side.
+type levelKey struct {
+	side  string
+	price float64
+}
+
+// WithLevelDiffs makes the book record the changes of its visible price levels, see DiffSince. Recording costs a walk
+// of the book after every state change, so it is disabled by default.
+func WithLevelDiffs() OrderBookOption {
+	return func(ob *OrderBook) {
+		ob.levelDiffs = true
+		ob.levels = make(map[levelKey]int64)
+	}
+}
+
+// Seq returns the book sequence number: the number of state changes that moved the visible price levels so far,
+// always 0 without WithLevelDiffs.
+func (ob *OrderBook) Seq() int64 {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+	return ob.seq
+}
+
+// DiffSince returns the price level changes recorded after the book sequence number seq, oldest first. Applying them in
+// order to the levels as of seq gives the current levels, so a market data feed only has to send them instead of the
+// whole book. The changes of one state change share their Seq, bids come before asks, each side best price first.
+// Without WithLevelDiffs nothing is recorded and DiffSince returns nil.
+func (ob *OrderBook) DiffSince(seq int64) []LevelChange {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	i := sort.Search(len(ob.levelChanges), func(i int) bool { return ob.levelChanges[i].Seq > seq })
+	if i == len(ob.levelChanges) {
+		return nil
+	}
+	return append([]LevelChange(nil), ob.levelChanges[i:]...)
+}
+
+// publishLevels records, under a new sequence number, how the visible price levels changed since the last call. The
+// exported methods changing the book defer it, it does nothing without WithLevelDiffs.
+func (ob *OrderBook) publishLevels() {
+	if !ob.levelDiffs {
+		return
+	}
+
+	current := make(map[levelKey]int64)
+	for _, orders := range [][]*Order{*ob.BuyOrders, *ob.SellOrders} {
+		for _, order := range orders {
+			if !order.Cancelled && !order.Hidden && order.Volume > 0 {
+				current[levelKey{order.Side, order.displayedPrice()}] += int64(order.Volume)
+			}
+		}
+	}
+
+	var changes []LevelChange
+	for key, volume := range current {
+		previous, existed := ob.levels[key]
+		if !existed {
+			changes = append(changes, LevelChange{Side: key.side, Price: key.price, Volume: volume, Kind: LevelAdded})
+		} else if previous != volume {
+			changes = append(changes, LevelChange{Side: key.side, Price: key.price, Volume: volume, Kind: LevelModified})
+		}
+	}
+	for key := range ob.levels {
+		if _, exists := current[key]; !exists {
+			changes = append(changes, LevelChange{Side: key.side, Price: key.price, Kind: LevelRemoved})
+		}
+	}
+	if len(changes) == 0 {
+		return
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Side != changes[j].Side {
+			return changes[i].Side == "BUY"
+		}
+		if changes[i].Side == "BUY" {
+			return changes[i].Price > changes[j].Price
+		}
+		return changes[i].Price < changes[j].Price
+	})
+	ob.seq++
+	for i := range changes {
+		changes[i].Seq = ob.seq
+	}
+	ob.levelChanges = append(ob.levelChanges, changes...)
+	ob.levels = current
+}
+
+// TradesInRange returns the executed trades whose price is within [minPrice, maxPrice], in execution order. Both
+// boundaries are inclusive up to priceEpsilon, so a boundary carrying floating point noise (e.g. 0.1+0.2) still matches
+// a trade at 0.3.
+func (ob *OrderBook) TradesInRange(minPrice, maxPrice float64) []Trade {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	var trades []Trade
+	for _, trade := range ob.Executions {
+		if trade.Price > minPrice-priceEpsilon && trade.Price < maxPrice+priceEpsilon {
+			trades = append(trades, trade)
+		}
+	}
+	return trades
+}
+
+var (
+	// ErrTradeNotFound is returned by BustTrade for unknown trade IDs.
+	ErrTradeNotFound = errors.New("trade not found")
+	// ErrTradeBusted is returned by BustTrade for trades that were already busted.
+	ErrTradeBusted = errors.New("trade already busted")
+)
+
+// BustTrade cancels an erroneous trade after the fact: the trade is marked Busted in Executions and stops counting in
+// Stats. Under WithBustReinstatement, its volume is also given back to the maker and the taker if they are still
+// resting (an order that left the book isn't brought back). The trade line already in Trades is left as is.
+func (ob *OrderBook) BustTrade(tradeID int) error {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	defer ob.publishLevels()
+
+	// trade IDs increase with the executions, the recent trades are the likely ones to be busted
+	for i := len(ob.Executions) - 1; i >= 0; i-- {
+		trade := &ob.Executions[i]
+		if trade.ID != tradeID {
+			continue
+		}
+		if trade.Busted {
+			return fmt.Errorf("%w: %d", ErrTradeBusted, tradeID)
+		}
+		trade.Busted = true
+		ob.log.Printf("Busted trade %d: %+v\n", tradeID, *trade)
+		if ob.bustReinstates {
+			ob.reinstate(trade.MakerID, trade.Volume)
+			ob.reinstate(trade.TakerID, trade.Volume)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: %d", ErrTradeNotFound, tradeID)
+}
+
+// reinstate gives volume back to the order orderID if it is still resting.
+func (ob *OrderBook) reinstate(orderID int, volume int) {
+	order, exists := ob.Orders[orderID]
+	if !exists || order.Cancelled || order.CancelReason != "" {
+		ob.log.Printf("Order %d no longer rests, %d not reinstated.\n", orderID, volume)
+		return
+	}
+	order.Volume += volume
+	// the volume is a sort key under VolumeFirst
+	ob.fixOrderInHeap(order)
+}
+
+// TradeStats summarizes the trades of a book that weren't busted.
+type TradeStats struct {
+	Count  int     // number of trades
+	Volume int64   // total traded volume
+	VWAP   float64 // volume weighted average price, 0 without trades
+}
+
+// Stats computes the TradeStats of the executed trades, leaving out the busted ones.
+func (ob *OrderBook) Stats() TradeStats {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	var stats TradeStats
+	notional := 0.0
+	for _, trade := range ob.Executions {
+		if trade.Busted {
+			continue
+		}
+		stats.Count++
+		stats.Volume += int64(trade.Volume)
+		notional += trade.Price * float64(trade.Volume)
+	}
+	if stats.Volume > 0 {
+		stats.VWAP = notional / float64(stats.Volume)
+	}
+	return stats
+}
+
+// formatPrice formats a price for the output lines, honoring DisplayPrecision when it is set.
+func (ob *OrderBook) formatPrice(price float64) string {
+	if ob.DisplayPrecision != nil {
+		return strconv.FormatFloat(price, 'f', *ob.DisplayPrecision, 64)
+	}
+	return formatFloat(price)
 }
 
 // formatFloat formats a float to a string with no decimal places if it's an integer, or with decimal places if it's a float.
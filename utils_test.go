@@ -1,11 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"container/heap"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"log"
+	"log/slog"
+	"math"
+	"math/rand"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -21,6 +30,17 @@ func setupOrderBook() (*OrderBook, []*Order) {
 	return ob, orders
 }
 
+// steppingClock is a fake clock for books under test: it starts at 2024-01-01 09:00 UTC and every reading is one
+// second later than the previous one, so consecutive orders get distinct, predictable timestamps.
+func steppingClock(t testing.TB) OrderBookOption {
+	t.Helper()
+	now := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	return WithClock(func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	})
+}
+
 func TestInsertOrderIntoHeap(t *testing.T) {
 	ob, orders := setupOrderBook()
 
@@ -77,12 +97,7 @@ func TestOrderReinsertionAfterUpdate(t *testing.T) {
 	}
 
 	// Further, verify that the heap maintains the correct order for all other orders
-	expectedOrderIDs := []int{1, 2, 3} // After update, the order by priority should be 1, 3, 2 based on price
-	for i, expectedID := range expectedOrderIDs {
-		if (*ob.BuyOrders)[i].ID != expectedID {
-			t.Errorf("At position %d, expected order ID %d, found ID %d", i, expectedID, (*ob.BuyOrders)[i].ID)
-		}
-	}
+	checkHeapOrder(t, ob, []int{1, 3, 2}, "After Update") // After update, the order by priority should be 1, 3, 2 based on price
 
 	// Optionally, verify that the heap size remains correct (no duplicate insertions)
 	if len(*ob.BuyOrders) != 3 {
@@ -99,13 +114,13 @@ func TestOrderReinsertionAfterUpdateDetailed(t *testing.T) {
 	ob.Insert(&Order{ID: 3, Symbol: "TEST", Side: "BUY", Price: 102.0, Volume: 10, Inserted: time.Now()})
 
 	// Check initial heap order
-	checkHeapOrder(t, ob.BuyOrders, []int{3, 1, 2}, "Initial")
+	checkHeapOrder(t, ob, []int{3, 2, 1}, "Initial")
 
 	// Update the price of the first order to be higher than the rest
 	ob.Update(1, 103.0, 10) // Increase price to 103.0
 
 	// Check heap order immediately after update
-	checkHeapOrder(t, ob.BuyOrders, []int{1, 2, 3}, "After Update")
+	checkHeapOrder(t, ob, []int{1, 3, 2}, "After Update")
 
 	// Optionally, verify that the heap size remains correct (no duplicate insertions)
 	if len(*ob.BuyOrders) != 3 {
@@ -113,12 +128,19 @@ func TestOrderReinsertionAfterUpdateDetailed(t *testing.T) {
 	}
 }
 
-// checkHeapOrder checks the order of orders in the heap against the expected order of IDs
-func checkHeapOrder(t *testing.T, heap *MaxHeap, expectedOrder []int, step string) {
-	for i, expectedID := range expectedOrder {
-		if (*heap)[i].ID != expectedID {
-			t.Errorf("%s heap check: At position %d, expected order ID %d, found ID %d", step, i, expectedID, (*heap)[i].ID)
-		}
+// checkHeapOrder checks that the buy heap is a valid heap and that its orders match in the expected order of IDs. It
+// doesn't pin the array layout, which depends on how the heap was re-sifted.
+func checkHeapOrder(t *testing.T, ob *OrderBook, expectedOrder []int, step string) {
+	if err := ob.Validate(); err != nil {
+		t.Errorf("%s heap check: %v", step, err)
+	}
+	var matchOrder []int
+	ob.ForEachResting("BUY", func(order OrderStatus) bool {
+		matchOrder = append(matchOrder, order.ID)
+		return true
+	})
+	if !reflect.DeepEqual(matchOrder, expectedOrder) {
+		t.Errorf("%s heap check: expected the match order %v, found %v", step, expectedOrder, matchOrder)
 	}
 }
 
@@ -341,6 +363,38 @@ func TestMinHeapLess(t *testing.T) {
 	}
 }
 
+// TestHeapPopOrdering pushes random orders, with many price ties, into both heaps and checks that popping them all
+// yields a monotonic priority: best price first and, within a price, earliest Inserted first.
+func TestHeapPopOrdering(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	start := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	buys, sells := &MaxHeap{}, &MinHeap{}
+	for i := 0; i < 1000; i++ {
+		inserted := start.Add(time.Duration(rng.Intn(1_000_000)) * time.Millisecond)
+		price := float64(40+rng.Intn(20)) + float64(rng.Intn(4))/4
+		heap.Push(buys, &Order{ID: i, Side: "BUY", Price: price, Volume: 1, Inserted: inserted})
+		heap.Push(sells, &Order{ID: i, Side: "SELL", Price: price, Volume: 1, Inserted: inserted})
+	}
+
+	check := func(side string, h heap.Interface, better func(a, b float64) bool) {
+		t.Helper()
+		previous := heap.Pop(h).(*Order)
+		for h.Len() > 0 {
+			order := heap.Pop(h).(*Order)
+			if better(order.Price, previous.Price) {
+				t.Fatalf("%s: order %d at %v popped after order %d at %v", side, order.ID, order.Price, previous.ID, previous.Price)
+			}
+			if order.Price == previous.Price && order.Inserted.Before(previous.Inserted) {
+				t.Fatalf("%s: order %d inserted at %v popped after order %d inserted at %v", side, order.ID,
+					order.Inserted, previous.ID, previous.Inserted)
+			}
+			previous = order
+		}
+	}
+	check("BUY", buys, func(a, b float64) bool { return a > b })
+	check("SELL", sells, func(a, b float64) bool { return a < b })
+}
+
 func TestComplexHeapOperations(t *testing.T) {
 	ob := NewOrderBook()
 
@@ -482,7 +536,8 @@ func TestComplexOrderFlowTestCase5(t *testing.T) { // failing
 	ob.Update(1, 45.95, 5) // Increase volume back of order 1, from 3 to 5 (5, 4, 3, 5). OrderID 1 will lose its priority
 
 	// When Order 7 is inserted, it matches with an existing BUY order.
-	// Order 3 should be the maker since it has the highest volume among the remaining BUY orders at the same price level (45.95).
+	// Order 3 should be the maker: order 1 lost its time priority when its volume increased, so order 3 is now the
+	// earliest BUY order at 45.95. This is plain time priority (TimeFirst), see TieBreak.
 
 	ob.Insert(&Order{ID: 7, Symbol: "FFLY", Side: "SELL", Price: 45.95, Volume: 1}) // the heap order should be 3, 1
 
@@ -628,3 +683,3252 @@ func verifyOrderBookState(t *testing.T, ob *OrderBook, expectedBuyOrderIDs, expe
 		}
 	}
 }
+
+func TestVolumeAtPrice(t *testing.T) {
+	ob := NewOrderBook()
+
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 23.45, Volume: 10})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 23.45, Volume: 5})
+	ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 23.40, Volume: 7})
+	ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "BUY", Price: 0.1 + 0.2, Volume: 3}) // 0.30000000000000004
+	ob.Insert(&Order{ID: 5, Symbol: "FFLY", Side: "BUY", Price: 0.3, Volume: 4})
+	ob.Insert(&Order{ID: 6, Symbol: "FFLY", Side: "SELL", Price: 23.50, Volume: 8})
+	ob.Insert(&Order{ID: 7, Symbol: "FFLY", Side: "SELL", Price: 23.50, Volume: 2})
+	ob.Cancel(2)
+
+	testCases := []struct {
+		side     string
+		price    float64
+		expected int64
+	}{
+		{"BUY", 23.45, 10}, // order 2 is cancelled and must not be counted
+		{"BUY", 23.40, 7},
+		{"BUY", 23.50, 0},
+		{"BUY", 0.3, 7}, // both orders belong to the same level despite float noise
+		{"SELL", 23.50, 10},
+		{"SELL", 23.45, 0},
+		{"HOLD", 23.45, 0},
+	}
+	for _, tc := range testCases {
+		if got := ob.VolumeAtPrice(tc.side, tc.price); got != tc.expected {
+			t.Errorf("VolumeAtPrice(%s, %v): expected %d, got %d", tc.side, tc.price, tc.expected, got)
+		}
+	}
+}
+
+func TestInvalidPrices(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		price float64
+	}{
+		{"NaN", math.NaN()},
+		{"+Inf", math.Inf(1)},
+		{"-Inf", math.Inf(-1)},
+		{"zero", 0},
+		{"negative", -3},
+	} {
+		ob := NewOrderBook(WithTickSize(0)) // without a tick, nothing else would catch them
+		if _, err := ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: tc.price, Volume: 5}); !errors.Is(err, ErrInvalidPrice) {
+			t.Errorf("%s: expected ErrInvalidPrice on insert, got %v", tc.name, err)
+		}
+
+		ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 10, Volume: 5})
+		if _, err := ob.Update(2, tc.price, 5); !errors.Is(err, ErrInvalidPrice) {
+			t.Errorf("%s: expected ErrInvalidPrice on update, got %v", tc.name, err)
+		}
+		if _, err := ob.Replace(2, &Order{ID: 3, Symbol: "FFLY", Side: "SELL", Price: tc.price, Volume: 5}); !errors.Is(err, ErrInvalidPrice) {
+			t.Errorf("%s: expected ErrInvalidPrice on replace, got %v", tc.name, err)
+		}
+		if buy, sell := ob.Len(); buy != 0 || sell != 1 || ob.Orders[2].Price != 10 {
+			t.Errorf("%s: expected only order 2 resting at 10, got %d bids, %d asks", tc.name, buy, sell)
+		}
+	}
+}
+
+func TestTickSizeValidation(t *testing.T) {
+	ob := NewOrderBook(WithTickSize(0.05))
+
+	if _, err := ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 12.23, Volume: 5}); !errors.Is(err, ErrInvalidTick) {
+		t.Errorf("Expected ErrInvalidTick for price 12.23 with tick 0.05, got %v", err)
+	}
+	if _, exists := ob.Orders[1]; exists || ob.BuyOrders.Len() != 0 {
+		t.Errorf("Rejected order must not reach the book")
+	}
+
+	if _, err := ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 12.25, Volume: 5}); err != nil {
+		t.Errorf("Expected price 12.25 with tick 0.05 to be accepted, got %v", err)
+	}
+
+	// an update moving the price off the grid is rejected and leaves the order as it was
+	if _, err := ob.Update(2, 12.27, 5); !errors.Is(err, ErrInvalidTick) {
+		t.Errorf("Expected ErrInvalidTick when updating to 12.27, got %v", err)
+	}
+	if ob.Orders[2].Price != 12.25 {
+		t.Errorf("Expected order 2 to keep price 12.25, got %v", ob.Orders[2].Price)
+	}
+
+	// the default tick follows the 4 decimals rule
+	ob = NewOrderBook()
+	if _, err := ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 2.1427, Volume: 1}); err != nil {
+		t.Errorf("Expected 2.1427 to be valid with the default tick, got %v", err)
+	}
+	if _, err := ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 2.14275, Volume: 1}); !errors.Is(err, ErrInvalidTick) {
+		t.Errorf("Expected 2.14275 to be rejected with the default tick, got %v", err)
+	}
+	if _, err := ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "HOLD", Price: 2.14, Volume: 1}); !errors.Is(err, ErrInvalidSide) {
+		t.Errorf("Expected ErrInvalidSide, got %v", err)
+	}
+	// found by FuzzRunMatchingEngine: empty orders used to trade zero volume
+	for id, volume := range map[int]int{4: 0, 5: -3} {
+		if _, err := ob.Insert(&Order{ID: id, Symbol: "FFLY", Side: "BUY", Price: 2.1427, Volume: volume}); !errors.Is(err, ErrVolumeOutOfRange) {
+			t.Errorf("Expected volume %d to be rejected, got %v", volume, err)
+		}
+	}
+}
+
+func TestSizeLimits(t *testing.T) {
+	ob := NewOrderBook(WithSizeLimits(5, 100))
+
+	testCases := []struct {
+		id      int
+		volume  int
+		wantErr bool
+	}{
+		{1, 4, true},    // below min
+		{2, 101, true},  // above max
+		{3, 5, false},   // min boundary
+		{4, 100, false}, // max boundary
+	}
+	for _, tc := range testCases {
+		_, err := ob.Insert(&Order{ID: tc.id, Symbol: "FFLY", Side: "BUY", Price: 10, Volume: tc.volume})
+		if tc.wantErr && !errors.Is(err, ErrVolumeOutOfRange) {
+			t.Errorf("Expected volume %d to be rejected, got %v", tc.volume, err)
+		}
+		if !tc.wantErr && err != nil {
+			t.Errorf("Expected volume %d to be accepted, got %v", tc.volume, err)
+		}
+	}
+	if ob.BuyOrders.Len() != 2 {
+		t.Errorf("Expected 2 resting orders, found %d", ob.BuyOrders.Len())
+	}
+
+	if _, err := ob.Update(3, 10, 101); !errors.Is(err, ErrVolumeOutOfRange) {
+		t.Errorf("Expected update above max to be rejected, got %v", err)
+	}
+	if _, err := ob.Update(3, 10, 4); !errors.Is(err, ErrVolumeOutOfRange) {
+		t.Errorf("Expected update below min to be rejected, got %v", err)
+	}
+	if ob.Orders[3].Volume != 5 {
+		t.Errorf("Expected order 3 to keep volume 5, got %d", ob.Orders[3].Volume)
+	}
+}
+
+func TestPriceBand(t *testing.T) {
+	ob := NewOrderBook(WithPriceBand(10))
+
+	// without a reference price, every price is accepted
+	if _, err := ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 100, Volume: 1}); err != nil {
+		t.Fatalf("Expected first order to be accepted, got %v", err)
+	}
+	if _, err := ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 100, Volume: 1}); err != nil {
+		t.Fatalf("Expected crossing order to be accepted, got %v", err)
+	}
+	if ob.LastPrice != 100 {
+		t.Fatalf("Expected last price 100, got %v", ob.LastPrice)
+	}
+
+	if _, err := ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "SELL", Price: 120, Volume: 1}); !errors.Is(err, ErrOutsidePriceBand) {
+		t.Errorf("Expected 120 to be rejected with a 10%% band around 100, got %v", err)
+	}
+	if _, err := ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "SELL", Price: 105, Volume: 1}); err != nil {
+		t.Errorf("Expected 105 to be accepted with a 10%% band around 100, got %v", err)
+	}
+	if _, err := ob.Insert(&Order{ID: 5, Symbol: "FFLY", Side: "BUY", Price: 90, Volume: 1}); err != nil {
+		t.Errorf("Expected 90 (band boundary) to be accepted, got %v", err)
+	}
+}
+
+func TestApplyOperationMalformed(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	obs := NewOrderBooks(WithLogger(logger))
+
+	for _, operation := range []string{"", "INSERT,1,FFLY,BUY", "INSERT,1,FFLY,BUY,10,5,", "UPDATE,x,10,5", "INSERT,1,FFLY,BUY,ten,5"} {
+		if _, err := applyOperation(obs, operation); !errors.Is(err, ErrMalformedOperation) {
+			t.Errorf("Expected ErrMalformedOperation for %q, got %v", operation, err)
+		}
+	}
+	if len(obs.sortedSymbols()) != 0 {
+		t.Errorf("Malformed operations must not create order books, found %v", obs.sortedSymbols())
+	}
+}
+
+func TestStartExpiry(t *testing.T) {
+	now := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	ob := NewOrderBook(WithClock(func() time.Time { return now }))
+
+	// replace the real ticker with a channel we tick by hand
+	ticks := make(chan time.Time)
+	tickerStopped := false
+	ob.newTicker = func(time.Duration) (<-chan time.Time, func()) {
+		return ticks, func() { tickerStopped = true }
+	}
+
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 10, Volume: 5, ExpiresAt: now.Add(time.Minute)})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 11, Volume: 5, ExpiresAt: now.Add(time.Hour)})
+	ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 9, Volume: 5}) // no expiry
+
+	stop := ob.StartExpiry(time.Second)
+	now = now.Add(2 * time.Minute)
+	ticks <- now
+	stop()
+	stop() // stopping twice is a no-op
+
+	if !tickerStopped {
+		t.Errorf("Expected the ticker to be stopped")
+	}
+	if !ob.Orders[1].Cancelled {
+		t.Errorf("Expected order 1 to be expired")
+	}
+	if ob.Orders[2].Cancelled || ob.Orders[3].Cancelled {
+		t.Errorf("Expected orders 2 and 3 to keep resting")
+	}
+	verifyOrderBookState(t, ob, []int{3}, []int{2})
+
+	if expired := ob.ExpireOrders(now.Add(time.Hour)); expired != 1 {
+		t.Errorf("Expected 1 order to expire at its ExpiresAt, got %d", expired)
+	}
+}
+
+func TestSummaryOrder(t *testing.T) {
+	orders := []*Order{
+		{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 25.56, Volume: 34},
+		{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 25.67, Volume: 102},
+		{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 25.43, Volume: 4},
+		{ID: 4, Symbol: "FFLY", Side: "BUY", Price: 25.52, Volume: 23},
+	}
+
+	testCases := []struct {
+		name     string
+		order    SummaryOrder
+		expected []string
+	}{
+		{
+			// the spec examples: one price ladder from the highest ask to the lowest bid
+			name:  "asks descending",
+			order: AsksDescending,
+			expected: []string{
+				"===FFLY===",
+				"SELL,25.67,102",
+				"SELL,25.56,34",
+				"BUY,25.52,23",
+				"BUY,25.43,4",
+			},
+		},
+		{
+			// both sides in price priority, best level first
+			name:  "asks ascending",
+			order: AsksAscending,
+			expected: []string{
+				"===FFLY===",
+				"SELL,25.56,34",
+				"SELL,25.67,102",
+				"BUY,25.52,23",
+				"BUY,25.43,4",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ob := NewOrderBook(WithSummaryOrder(tc.order))
+			for _, order := range orders {
+				o := *order
+				ob.Insert(&o)
+			}
+			if output := ob.summaryLines("FFLY"); !reflect.DeepEqual(output, tc.expected) {
+				t.Errorf("Expected %v, but got %v", tc.expected, output)
+			}
+		})
+	}
+}
+
+func TestVerboseTrades(t *testing.T) {
+	ob := NewOrderBook(WithVerboseTrades())
+
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 23.45, Volume: 10})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 23.45, Volume: 4})  // partial fill of the maker
+	ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "SELL", Price: 23.45, Volume: 10}) // partial fill of the taker
+
+	expected := []string{
+		"FFLY,23.45,4,2,1,0,6",
+		"FFLY,23.45,6,3,1,4,0",
+	}
+	if !reflect.DeepEqual(ob.Trades, expected) {
+		t.Errorf("Expected trades %v, got %v", expected, ob.Trades)
+	}
+
+	// the default format is unchanged
+	ob = NewOrderBook()
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 23.45, Volume: 10})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 23.45, Volume: 4})
+	if expected := []string{"FFLY,23.45,4,2,1"}; !reflect.DeepEqual(ob.Trades, expected) {
+		t.Errorf("Expected trades %v, got %v", expected, ob.Trades)
+	}
+}
+
+func TestOrderBooksDefaultOptions(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New(&buf, "engine: ", 0)
+	obs := NewOrderBooks(WithLogger(logger), WithTickSize(0.05))
+
+	if err := obs.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 12.25, Volume: 5}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := obs.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 12.23, Volume: 5}); !errors.Is(err, ErrInvalidTick) {
+		t.Errorf("Expected the FFLY book to inherit the 0.05 tick, got %v", err)
+	}
+
+	ob, exists := obs.Book("FFLY")
+	if !exists {
+		t.Fatalf("Expected the FFLY book to be created on first insert")
+	}
+	if ob.TickSize != 0.05 {
+		t.Errorf("Expected tick size 0.05, got %v", ob.TickSize)
+	}
+	if !strings.Contains(buf.String(), "engine: Inserting order") {
+		t.Errorf("Expected the FFLY book to log through the configured logger, got %q", buf.String())
+	}
+}
+
+func TestCancelReason(t *testing.T) {
+	now := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	ob := NewOrderBook(WithClock(func() time.Time { return now }))
+
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 10, Volume: 5})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 10, Volume: 5}) // fills order 1 completely
+	ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 9, Volume: 5, ExpiresAt: now})
+	ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "BUY", Price: 8, Volume: 5})
+	ob.ExpireOrders(now)
+
+	// cancelling twice only records the first cancel, and cancelling a filled or expired order changes nothing
+	ob.Cancel(4)
+	ob.Cancel(4)
+	ob.Cancel(1)
+	ob.Cancel(3)
+
+	expected := map[int]CancelReason{
+		1: FullyFilled,
+		2: FullyFilled,
+		3: Expired,
+		4: UserCancel,
+	}
+	for id, reason := range expected {
+		status, exists := ob.GetOrder(id)
+		if !exists {
+			t.Fatalf("Expected order %d to be found", id)
+		}
+		if status.CancelReason != reason {
+			t.Errorf("Expected order %d to have reason %s, got %s", id, reason, status.CancelReason)
+		}
+	}
+	if _, exists := ob.GetOrder(5); exists {
+		t.Errorf("Expected order 5 not to be found")
+	}
+
+	// the snapshot is a copy, mutating it doesn't touch the book
+	status, _ := ob.GetOrder(4)
+	status.Volume = 100
+	if ob.Orders[4].Volume != 5 {
+		t.Errorf("Expected GetOrder to return a copy of the order")
+	}
+}
+
+func TestReduceKeepsPriority(t *testing.T) {
+	ob := NewOrderBook(steppingClock(t))
+
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 10, Volume: 5})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 10, Volume: 5})
+	inserted := ob.Orders[1].Inserted
+
+	ob.Reduce(1, 3)
+	if ob.Orders[1].Volume != 2 || !ob.Orders[1].Inserted.Equal(inserted) {
+		t.Fatalf("Expected order 1 to have volume 2 and its original timestamp, got %+v", ob.Orders[1])
+	}
+
+	// order 1 is still first in the queue at 10, so it's the maker of the next sell
+	ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "SELL", Price: 10, Volume: 1})
+	if expected := []string{"FFLY,10,1,3,1"}; !reflect.DeepEqual(ob.Trades, expected) {
+		t.Errorf("Expected trades %v, got %v", expected, ob.Trades)
+	}
+
+	// reducing by the whole remaining volume cancels the order
+	ob.Reduce(1, 1)
+	if !ob.Orders[1].Cancelled || ob.Orders[1].CancelReason != UserCancel {
+		t.Errorf("Expected order 1 to be cancelled, got %+v", ob.Orders[1])
+	}
+	verifyOrderBookState(t, ob, []int{2}, []int{})
+
+	ob.Reduce(2, 0)
+	if ob.Orders[2].Volume != 5 {
+		t.Errorf("Expected a zero reduction to be ignored, got volume %d", ob.Orders[2].Volume)
+	}
+
+	// an iceberg is reduced out of its reserve first, and only cancelled once the reserve is gone too
+	ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "SELL", Price: 12, Volume: 30, Peak: 5})
+	ob.Reduce(4, 5)
+	if order := ob.Orders[4]; order.CancelReason != "" || order.Volume != 5 || order.Reserve != 20 {
+		t.Fatalf("Expected order 4 to show 5 with 20 in reserve, got %+v", order)
+	}
+	ob.Reduce(4, 22)
+	if order := ob.Orders[4]; order.CancelReason != "" || order.Volume != 3 || order.Reserve != 0 {
+		t.Fatalf("Expected order 4 to show 3 with an empty reserve, got %+v", order)
+	}
+	ob.Reduce(4, 3)
+	if ob.Orders[4].CancelReason != UserCancel {
+		t.Errorf("Expected order 4 to be cancelled, got %+v", ob.Orders[4])
+	}
+}
+
+func TestOrderCounts(t *testing.T) {
+	obs := NewOrderBooks()
+
+	obs.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 10, Volume: 5})
+	obs.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 9, Volume: 5})
+	obs.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "SELL", Price: 11, Volume: 5})
+	obs.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "SELL", Price: 10, Volume: 5}) // fully matches order 1
+	obs.Insert(&Order{ID: 5, Symbol: "FFLY", Side: "SELL", Price: 12, Volume: 5})
+	obs.Insert(&Order{ID: 6, Symbol: "ETH", Side: "SELL", Price: 400, Volume: 1})
+	obs.Cancel(5, "FFLY")
+
+	ob, _ := obs.Book("FFLY")
+	if buy, sell := ob.Len(); buy != 1 || sell != 1 {
+		t.Errorf("Expected 1 buy and 1 sell order, got %d and %d", buy, sell)
+	}
+	if total := obs.TotalOrders(); total != 3 {
+		t.Errorf("Expected 3 orders in total, got %d", total)
+	}
+}
+
+func TestNoOpUpdate(t *testing.T) {
+	ob := NewOrderBook(steppingClock(t))
+
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 10, Volume: 5})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 10, Volume: 5})
+	ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "SELL", Price: 11, Volume: 5})
+	before := append(MaxHeap{}, *ob.BuyOrders...)
+	inserted := ob.Orders[1].Inserted
+
+	ob.Update(1, 10, 5)
+
+	if len(ob.Trades) != 0 {
+		t.Errorf("Expected no trades, got %v", ob.Trades)
+	}
+	if !reflect.DeepEqual(*ob.BuyOrders, before) {
+		t.Errorf("Expected the buy heap to be untouched by a no-op update")
+	}
+	if !ob.Orders[1].Inserted.Equal(inserted) {
+		t.Errorf("Expected order 1 to keep its timestamp")
+	}
+}
+
+func TestHiddenOrders(t *testing.T) {
+	ob := NewOrderBook()
+
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 10, Volume: 5, Hidden: true})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 11, Volume: 5})
+	ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 9, Volume: 4, Hidden: true})
+
+	// the dark orders are invisible, the dark sell is still the best ask though
+	expected := []string{"===FFLY===", "SELL,11,5"}
+	if output := ob.summaryLines("FFLY"); !reflect.DeepEqual(output, expected) {
+		t.Errorf("Expected %v, but got %v", expected, output)
+	}
+
+	ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "BUY", Price: 10, Volume: 3})
+	if expected := []string{"FFLY,10,3,4,1"}; !reflect.DeepEqual(ob.Trades, expected) {
+		t.Errorf("Expected the hidden sell to fill the incoming buy, got %v", ob.Trades)
+	}
+	expected = []string{"===FFLY===", "SELL,11,5"}
+	if output := ob.summaryLines("FFLY"); !reflect.DeepEqual(output, expected) {
+		t.Errorf("Expected the partially filled hidden sell to stay out of the summary, got %v", output)
+	}
+}
+
+func TestTradeIDs(t *testing.T) {
+	ob := NewOrderBook()
+
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 10, Volume: 2})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 10.5, Volume: 2})
+	ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "SELL", Price: 11, Volume: 2})
+	ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "BUY", Price: 11, Volume: 5}) // three fills
+	ob.Insert(&Order{ID: 5, Symbol: "FFLY", Side: "BUY", Price: 11, Volume: 1}) // one more
+
+	if len(ob.Executions) != 4 {
+		t.Fatalf("Expected 4 trades, got %d", len(ob.Executions))
+	}
+	for i, trade := range ob.Executions {
+		if trade.ID != i+1 {
+			t.Errorf("Expected trade %d to have ID %d, got %d", i, i+1, trade.ID)
+		}
+	}
+}
+
+func TestNewOrderBookWithOrders(t *testing.T) {
+	base := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	orders := []*Order{
+		{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 10, Volume: 5, Inserted: base.Add(2 * time.Second)},
+		{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 10, Volume: 5, Inserted: base.Add(time.Second)},
+		{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 9, Volume: 5, Inserted: base},
+		{ID: 4, Symbol: "FFLY", Side: "SELL", Price: 11, Volume: 5, Inserted: base},
+	}
+	ob, err := NewOrderBookWithOrders(orders)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(ob.Orders) != 4 || ob.BuyOrders.Len() != 3 || ob.SellOrders.Len() != 1 {
+		t.Fatalf("Expected all the orders to be loaded, got %d orders", len(ob.Orders))
+	}
+
+	// snapshot priority is kept: order 2 is older than order 1 at the same price
+	ob.Insert(&Order{ID: 5, Symbol: "FFLY", Side: "SELL", Price: 10, Volume: 5})
+	if expected := []string{"FFLY,10,5,5,2"}; !reflect.DeepEqual(ob.Trades, expected) {
+		t.Errorf("Expected trades %v, got %v", expected, ob.Trades)
+	}
+
+	crossed := []*Order{
+		{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 11, Volume: 5},
+		{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 10.5, Volume: 5},
+	}
+	if _, err := NewOrderBookWithOrders(crossed); !errors.Is(err, ErrCrossedBook) {
+		t.Errorf("Expected ErrCrossedBook, got %v", err)
+	}
+	duplicated := []*Order{
+		{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 10, Volume: 5},
+		{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 11, Volume: 5},
+	}
+	if _, err := NewOrderBookWithOrders(duplicated); !errors.Is(err, ErrDuplicateOrder) {
+		t.Errorf("Expected ErrDuplicateOrder, got %v", err)
+	}
+}
+
+// snapshotOrders generates n non crossing resting orders, half of them bids below 100 and half asks above it.
+func snapshotOrders(n int) []*Order {
+	orders := make([]*Order, n)
+	for i := range orders {
+		if i%2 == 0 {
+			orders[i] = &Order{ID: i, Symbol: "FFLY", Side: "BUY", Price: 99 - float64(i%500)/100, Volume: 1 + i%10}
+		} else {
+			orders[i] = &Order{ID: i, Symbol: "FFLY", Side: "SELL", Price: 101 + float64(i%500)/100, Volume: 1 + i%10}
+		}
+	}
+	return orders
+}
+
+func BenchmarkNewOrderBookWithOrders(b *testing.B) {
+	logger := log.New(io.Discard, "", 0)
+	orders := snapshotOrders(100000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := NewOrderBookWithOrders(orders, WithLogger(logger)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPushOrders(b *testing.B) {
+	logger := log.New(io.Discard, "", 0)
+	orders := snapshotOrders(100000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ob := NewOrderBook(WithLogger(logger))
+		for _, order := range orders {
+			ob.Orders[order.ID] = order
+			ob.insertOrderIntoHeap(order)
+		}
+	}
+}
+
+func TestCancelMidHeapBuyKeepsOrdering(t *testing.T) {
+	ob := NewOrderBook(steppingClock(t))
+
+	prices := []float64{10, 12, 11, 15, 13, 14, 12, 9}
+	for i, price := range prices {
+		ob.Insert(&Order{ID: i + 1, Symbol: "FFLY", Side: "BUY", Price: price, Volume: 1})
+	}
+	// order 3 (11) sits in the middle of the heap
+	ob.Cancel(3)
+
+	// popping a copy of the heap must yield the remaining buys best first: by price, then by time
+	remaining := append(MaxHeap{}, *ob.BuyOrders...)
+	var ids []int
+	for remaining.Len() > 0 {
+		ids = append(ids, heap.Pop(&remaining).(*Order).ID)
+	}
+	if expected := []int{4, 6, 5, 2, 7, 1, 8}; !reflect.DeepEqual(ids, expected) {
+		t.Errorf("Expected buys in order %v, got %v", expected, ids)
+	}
+}
+
+func TestOrderBooksApply(t *testing.T) {
+	obs := NewOrderBooks()
+
+	errs := obs.Apply([]Operation{
+		{Type: OpInsert, ID: 1, Symbol: "FFLY", Side: "BUY", Price: 10, Volume: 5},
+		{Type: OpInsert, ID: 2, Symbol: "FFLY", Side: "BUY", Price: 10.00001, Volume: 5}, // off tick
+		{Type: OpInsert, ID: 3, Symbol: "FFLY", Side: "SELL", Price: 11, Volume: 5},
+		{Type: OpUpdate, ID: 3, Price: 10, Volume: 2}, // symbol resolved from the ID
+		{Type: OpCancel, ID: 9},
+		{Type: OpCancel, ID: 1, Symbol: "FFLY"},
+		{Type: "REPLACE", ID: 1},
+	})
+
+	expected := []error{nil, ErrInvalidTick, nil, nil, ErrOrderNotFound, nil, ErrUnknownOperation}
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %d errors, got %d", len(expected), len(errs))
+	}
+	for i, err := range errs {
+		if (expected[i] == nil && err != nil) || !errors.Is(err, expected[i]) {
+			t.Errorf("Operation %d: expected %v, got %v", i, expected[i], err)
+		}
+	}
+
+	ob, _ := obs.Book("FFLY")
+	if expected := []string{"FFLY,10,2,3,1"}; !reflect.DeepEqual(ob.Trades, expected) {
+		t.Errorf("Expected trades %v, got %v", expected, ob.Trades)
+	}
+	if !ob.Orders[1].Cancelled {
+		t.Errorf("Expected order 1 to be cancelled")
+	}
+}
+
+func TestFeeModel(t *testing.T) {
+	ob := NewOrderBook(WithFeeModel(FlatFees{MakerRate: 0.0005, TakerRate: 0.001}))
+
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 200, Volume: 10})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 200, Volume: 10})
+
+	// notional is 2000: 0.05% for the maker, 0.1% for the taker
+	trade := ob.Executions[0]
+	if math.Abs(trade.MakerFee-1) > 1e-9 || math.Abs(trade.TakerFee-2) > 1e-9 {
+		t.Errorf("Expected maker fee 1 and taker fee 2, got %v and %v", trade.MakerFee, trade.TakerFee)
+	}
+
+	// no fee model means no fees
+	ob = NewOrderBook()
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 200, Volume: 10})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 200, Volume: 10})
+	if trade := ob.Executions[0]; trade.MakerFee != 0 || trade.TakerFee != 0 {
+		t.Errorf("Expected no fees by default, got %v and %v", trade.MakerFee, trade.TakerFee)
+	}
+}
+
+func TestPriorityPolicy(t *testing.T) {
+	testCases := []struct {
+		name     string
+		policy   PriorityPolicy
+		expected string // the trade of the incoming sell, its maker is the head of the queue
+	}{
+		{"lose priority", LoseOnVolumeIncrease, "FFLY,10,1,3,2"},
+		{"keep priority", KeepOnVolumeIncrease, "FFLY,10,1,3,1"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ob := NewOrderBook(WithPriorityPolicy(tc.policy), steppingClock(t))
+
+			ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 10, Volume: 5})
+			ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 10, Volume: 5})
+			ob.Update(1, 10, 8) // volume bump of the head of the queue
+
+			ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "SELL", Price: 10, Volume: 1})
+			if !reflect.DeepEqual(ob.Trades, []string{tc.expected}) {
+				t.Errorf("Expected trades %v, got %v", []string{tc.expected}, ob.Trades)
+			}
+		})
+	}
+}
+
+func TestForEachResting(t *testing.T) {
+	ob := NewOrderBook(steppingClock(t))
+	for i, price := range []float64{11, 12, 11, 13, 12.5} {
+		ob.Insert(&Order{ID: i + 1, Symbol: "FFLY", Side: "SELL", Price: price, Volume: 1})
+	}
+	ob.Cancel(4)
+
+	var ids []int
+	ob.ForEachResting("SELL", func(order OrderStatus) bool {
+		ids = append(ids, order.ID)
+		return true
+	})
+	if expected := []int{1, 3, 2, 5}; !reflect.DeepEqual(ids, expected) {
+		t.Errorf("Expected sells in order %v, got %v", expected, ids)
+	}
+
+	ids = nil
+	ob.ForEachResting("SELL", func(order OrderStatus) bool {
+		ids = append(ids, order.ID)
+		return len(ids) < 2
+	})
+	if expected := []int{1, 3}; !reflect.DeepEqual(ids, expected) {
+		t.Errorf("Expected the walk to stop after 2 orders, got %v", ids)
+	}
+
+	// the walk doesn't disturb the book
+	if buys, sells := ob.Len(); buys != 0 || sells != 4 {
+		t.Errorf("Expected 0 buys and 4 sells after the walk, got %d and %d", buys, sells)
+	}
+	ob.ForEachResting("BUY", func(OrderStatus) bool {
+		t.Error("Expected no buy orders")
+		return true
+	})
+}
+
+func TestDisplayPrecision(t *testing.T) {
+	ob := NewOrderBook(WithDisplayPrecision(2))
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 46, Volume: 5})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 45.95, Volume: 3})
+	ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 46, Volume: 2})
+
+	if expected := []string{"FFLY,46.00,2,3,1"}; !reflect.DeepEqual(ob.Trades, expected) {
+		t.Errorf("Expected trades %v, got %v", expected, ob.Trades)
+	}
+	expected := []string{"===FFLY===", "SELL,46.00,3", "BUY,45.95,3"}
+	if lines := ob.summaryLines("FFLY"); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected summary %v, got %v", expected, lines)
+	}
+
+	// per symbol precision on a multi-symbol engine, other symbols keep the default formatting
+	obs := NewOrderBooks()
+	obs.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 46, Volume: 5})
+	obs.Insert(&Order{ID: 2, Symbol: "ETH", Side: "SELL", Price: 46, Volume: 5})
+	ffly, _ := obs.Book("FFLY")
+	precision := 4
+	ffly.DisplayPrecision = &precision
+	obs.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 46, Volume: 1})
+	obs.Insert(&Order{ID: 4, Symbol: "ETH", Side: "BUY", Price: 46, Volume: 1})
+
+	if expected := []string{"FFLY,46.0000,1,3,1"}; !reflect.DeepEqual(ffly.Trades, expected) {
+		t.Errorf("Expected FFLY trades %v, got %v", expected, ffly.Trades)
+	}
+	eth, _ := obs.Book("ETH")
+	if expected := []string{"ETH,46,1,4,2"}; !reflect.DeepEqual(eth.Trades, expected) {
+		t.Errorf("Expected ETH trades %v, got %v", expected, eth.Trades)
+	}
+}
+
+func TestDepth(t *testing.T) {
+	ob := NewOrderBook()
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 10})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 46, Volume: 5})
+	ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 4})
+	ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "BUY", Price: 44, Volume: 1})
+	ob.Insert(&Order{ID: 5, Symbol: "FFLY", Side: "SELL", Price: 48, Volume: 2})
+	ob.Insert(&Order{ID: 6, Symbol: "FFLY", Side: "SELL", Price: 47, Volume: 3})
+	ob.Insert(&Order{ID: 7, Symbol: "FFLY", Side: "SELL", Price: 47.5, Volume: 2, Hidden: true})
+
+	bids, asks := ob.Depth(2)
+	if expected := []OrderSummary{{46, 5}, {45, 14}}; !reflect.DeepEqual(bids, expected) {
+		t.Errorf("Expected bids %v, got %v", expected, bids)
+	}
+	if expected := []OrderSummary{{47, 3}, {48, 2}}; !reflect.DeepEqual(asks, expected) {
+		t.Errorf("Expected asks %v, got %v", expected, asks)
+	}
+
+	if bids, _ := ob.Depth(0); len(bids) != 3 {
+		t.Errorf("Expected all 3 bid levels, got %v", bids)
+	}
+}
+
+func TestImbalance(t *testing.T) {
+	ob := NewOrderBook()
+	if imbalance := ob.Imbalance(5); imbalance != 0 {
+		t.Errorf("Expected 0 for an empty book, got %v", imbalance)
+	}
+
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 46, Volume: 6})
+	if imbalance := ob.Imbalance(5); imbalance != 1 {
+		t.Errorf("Expected +1 with only bids, got %v", imbalance)
+	}
+
+	// skewed book: 6+2 bid against 2 ask in the top 2 levels, the third bid level is ignored
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 2})
+	ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 44, Volume: 100})
+	ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "SELL", Price: 47, Volume: 2})
+	if imbalance := ob.Imbalance(2); imbalance != 0.6 {
+		t.Errorf("Expected 0.6, got %v", imbalance)
+	}
+
+	asksOnly := NewOrderBook()
+	asksOnly.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 46, Volume: 6})
+	if imbalance := asksOnly.Imbalance(1); imbalance != -1 {
+		t.Errorf("Expected -1 with only asks, got %v", imbalance)
+	}
+}
+
+func TestTradesInRange(t *testing.T) {
+	ob := NewOrderBook()
+	for i, price := range []float64{0.3, 46, 46.5, 47} {
+		ob.Insert(&Order{ID: 2*i + 1, Symbol: "FFLY", Side: "SELL", Price: price, Volume: 1})
+		ob.Insert(&Order{ID: 2*i + 2, Symbol: "FFLY", Side: "BUY", Price: price, Volume: 1})
+	}
+
+	tradeIDs := func(trades []Trade) []int {
+		ids := []int{}
+		for _, trade := range trades {
+			ids = append(ids, trade.TakerID)
+		}
+		return ids
+	}
+
+	testCases := []struct {
+		name     string
+		min, max float64
+		expected []int
+	}{
+		{"inclusive boundaries", 46, 46.5, []int{4, 6}},
+		{"single price", 47, 47, []int{8}},
+		{"float noise at the boundary", 0.1 + 0.2, 0.1 + 0.2, []int{2}},
+		{"no trade in range", 10, 20, []int{}},
+		{"inverted range", 47, 46, []int{}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if ids := tradeIDs(ob.TradesInRange(tc.min, tc.max)); !reflect.DeepEqual(ids, tc.expected) {
+				t.Errorf("Expected trades of takers %v, got %v", tc.expected, ids)
+			}
+		})
+	}
+}
+
+func TestCancelledOrderIsNeverMatched(t *testing.T) {
+	ob := NewOrderBook()
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 1})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 46, Volume: 1})
+	ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "SELL", Price: 47, Volume: 1})
+	// reusing ID 2 leaves two heap entries for it, Cancel must remove both
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 46.5, Volume: 1})
+	ob.Cancel(2)
+
+	ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "BUY", Price: 48, Volume: 10})
+
+	for _, trade := range ob.Executions {
+		if trade.MakerID == 2 {
+			t.Errorf("Cancelled order 2 was matched: %v", trade)
+		}
+	}
+	// exactly two sells are left to match against, so they trade at their own price
+	if expected := []string{"FFLY,45,1,4,1", "FFLY,47,1,4,3"}; !reflect.DeepEqual(ob.Trades, expected) {
+		t.Errorf("Expected trades %v, got %v", expected, ob.Trades)
+	}
+	if ob.SellOrders.Len() != 0 {
+		t.Errorf("Expected no resting sells, got %d", ob.SellOrders.Len())
+	}
+}
+
+func TestPeek(t *testing.T) {
+	buys, sells := &MaxHeap{}, &MinHeap{}
+	if order, ok := buys.Peek(); ok || order != nil {
+		t.Errorf("Expected an empty MaxHeap to peek nothing, got %v", order)
+	}
+	if order, ok := sells.Peek(); ok || order != nil {
+		t.Errorf("Expected an empty MinHeap to peek nothing, got %v", order)
+	}
+
+	now := time.Now()
+	heap.Push(buys, &Order{ID: 1, Side: "BUY", Price: 45, Inserted: now})
+	heap.Push(buys, &Order{ID: 2, Side: "BUY", Price: 46, Inserted: now.Add(time.Second)})
+	heap.Push(sells, &Order{ID: 3, Side: "SELL", Price: 47, Inserted: now})
+	heap.Push(sells, &Order{ID: 4, Side: "SELL", Price: 47, Inserted: now.Add(time.Second)})
+
+	if order, ok := buys.Peek(); !ok || order.ID != 2 {
+		t.Errorf("Expected best bid 2, got %v", order)
+	}
+	if order, ok := sells.Peek(); !ok || order.ID != 3 {
+		t.Errorf("Expected best ask 3, got %v", order)
+	}
+	if buys.Len() != 2 || sells.Len() != 2 {
+		t.Error("Expected Peek to leave the heaps untouched")
+	}
+}
+
+func TestEndSession(t *testing.T) {
+	ob := NewOrderBook()
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 5, TimeInForce: DAY})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 44, Volume: 5, TimeInForce: GTC})
+	ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "SELL", Price: 47, Volume: 5, TimeInForce: DAY})
+	ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "SELL", Price: 48, Volume: 5}) // no time in force is GTC
+
+	ob.EndSession()
+
+	for _, id := range []int{1, 3} {
+		if status, _ := ob.GetOrder(id); status.CancelReason != Expired {
+			t.Errorf("Expected day order %d to expire, got reason %q", id, status.CancelReason)
+		}
+	}
+	for _, id := range []int{2, 4} {
+		if status, _ := ob.GetOrder(id); status.CancelReason != "" {
+			t.Errorf("Expected GTC order %d to keep resting, got reason %q", id, status.CancelReason)
+		}
+	}
+	expected := []string{"===FFLY===", "SELL,48,5", "BUY,44,5"}
+	if lines := ob.summaryLines("FFLY"); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected summary %v, got %v", expected, lines)
+	}
+}
+
+func TestRepriceAndResize(t *testing.T) {
+	ob := NewOrderBook()
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 5})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 47, Volume: 3})
+
+	if _, err := ob.Reprice(1, 45.5); err != nil {
+		t.Fatalf("Unexpected reprice error: %v", err)
+	}
+	if status, _ := ob.GetOrder(1); status.Price != 45.5 || status.Volume != 5 {
+		t.Errorf("Expected reprice to keep volume 5 at 45.5, got %v at %v", status.Volume, status.Price)
+	}
+
+	if _, err := ob.Resize(1, 8); err != nil {
+		t.Fatalf("Unexpected resize error: %v", err)
+	}
+	if status, _ := ob.GetOrder(1); status.Price != 45.5 || status.Volume != 8 {
+		t.Errorf("Expected resize to keep price 45.5 with volume 8, got %v at %v", status.Volume, status.Price)
+	}
+
+	// repricing into the ask trades the order's whole volume
+	if _, err := ob.Reprice(1, 47); err != nil {
+		t.Fatalf("Unexpected reprice error: %v", err)
+	}
+	if expected := []string{"FFLY,47,3,1,2"}; !reflect.DeepEqual(ob.Trades, expected) {
+		t.Errorf("Expected trades %v, got %v", expected, ob.Trades)
+	}
+
+	if _, err := ob.Reprice(1, 47.00001); !errors.Is(err, ErrInvalidTick) {
+		t.Errorf("Expected ErrInvalidTick, got %v", err)
+	}
+	if _, err := ob.Resize(99, 1); err != nil {
+		t.Errorf("Expected unknown orders to be ignored, got %v", err)
+	}
+}
+
+func TestInsertAndUpdateReturnTheirTrades(t *testing.T) {
+	ob := NewOrderBook()
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 46, Volume: 2})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 47, Volume: 2})
+	ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "SELL", Price: 48, Volume: 2})
+
+	result, err := ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "BUY", Price: 46, Volume: 1})
+	trades := result.Trades
+	if err != nil {
+		t.Fatalf("Unexpected insert error: %v", err)
+	}
+	if len(trades) != 1 || trades[0].MakerID != 1 || trades[0].Volume != 1 {
+		t.Errorf("Expected the insert to return its single fill against order 1, got %v", trades)
+	}
+
+	result, _ = ob.Insert(&Order{ID: 5, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 1})
+	trades = result.Trades
+	if trades != nil {
+		t.Errorf("Expected no trades for a non crossing insert, got %v", trades)
+	}
+
+	// the update crosses two levels, and only returns its own fills, not the earlier one
+	trades, err = ob.Update(5, 47, 3)
+	if err != nil {
+		t.Fatalf("Unexpected update error: %v", err)
+	}
+	var makers []int
+	for _, trade := range trades {
+		if trade.TakerID != 5 {
+			t.Errorf("Expected order 5 to be the taker, got %v", trade)
+		}
+		makers = append(makers, trade.MakerID)
+	}
+	if expected := []int{1, 2}; !reflect.DeepEqual(makers, expected) {
+		t.Errorf("Expected fills against %v, got %v", expected, makers)
+	}
+
+	if len(ob.Trades) != 3 || len(ob.Executions) != 3 {
+		t.Errorf("Expected the cumulative log to keep all 3 trades, got %d lines and %d executions", len(ob.Trades), len(ob.Executions))
+	}
+}
+
+func TestTieBreak(t *testing.T) {
+	clock := steppingClock(t)
+
+	testCases := []struct {
+		name     string
+		tieBreak TieBreak
+		makers   []int
+	}{
+		{"time first", TimeFirst, []int{1, 1, 2, 2}},
+		// order 2 is the largest, it's partially filled down to 5 and then ties with order 1 (earlier) on volume
+		{"volume first", VolumeFirst, []int{2, 2, 1}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ob := NewOrderBook(clock, WithTieBreak(tc.tieBreak))
+			ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 45.95, Volume: 5})
+			ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 45.95, Volume: 12})
+			ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 45.90, Volume: 20})
+
+			var makers []int
+			for id, volume := range []int{4, 3, 1} {
+				result, _ := ob.Insert(&Order{ID: 10 + id, Symbol: "FFLY", Side: "SELL", Price: 45.95, Volume: volume})
+				trades := result.Trades
+				for _, trade := range trades {
+					makers = append(makers, trade.MakerID)
+				}
+			}
+			if !reflect.DeepEqual(makers, tc.makers) {
+				t.Errorf("Expected makers %v, got %v", tc.makers, makers)
+			}
+		})
+	}
+}
+
+func TestSimulateInsert(t *testing.T) {
+	ob := NewOrderBook()
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 46, Volume: 2})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 47, Volume: 2})
+	ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "SELL", Price: 48, Volume: 2})
+	ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 2})
+	before := ob.summaryLines("FFLY")
+
+	order := &Order{ID: 5, Symbol: "FFLY", Side: "BUY", Price: 47, Volume: 3}
+	trades := ob.SimulateInsert(order)
+
+	var makers []int
+	for _, trade := range trades {
+		makers = append(makers, trade.MakerID)
+	}
+	if expected := []int{1, 2}; !reflect.DeepEqual(makers, expected) {
+		t.Errorf("Expected simulated fills against %v, got %v", expected, trades)
+	}
+
+	// the real book, its orders and the simulated order are untouched
+	if after := ob.summaryLines("FFLY"); !reflect.DeepEqual(after, before) {
+		t.Errorf("Expected the book to stay %v, got %v", before, after)
+	}
+	if len(ob.Trades) != 0 || len(ob.Executions) != 0 {
+		t.Errorf("Expected no trades on the real book, got %v", ob.Trades)
+	}
+	if status, _ := ob.GetOrder(1); status.Volume != 2 || status.CancelReason != "" {
+		t.Errorf("Expected order 1 to keep resting with volume 2, got %+v", status)
+	}
+	if _, exists := ob.GetOrder(5); exists {
+		t.Error("Expected the simulated order not to be added to the book")
+	}
+	if order.Volume != 3 || !order.Inserted.IsZero() {
+		t.Errorf("Expected the simulated order to be left untouched, got %+v", order)
+	}
+
+	// inserting for real gives the same trades as the simulation
+	result, _ := ob.Insert(order)
+	inserted := result.Trades
+	if !reflect.DeepEqual(inserted, trades) {
+		t.Errorf("Expected the real insert to trade like the simulation, got %v and %v", inserted, trades)
+	}
+}
+
+func TestRegisterSymbol(t *testing.T) {
+	t.Run("strict mode rejects unregistered symbols", func(t *testing.T) {
+		obs := NewOrderBooks().WithStrictSymbols()
+		obs.RegisterSymbol("FFLY", SymbolConfig{TickSize: 0.05, LotSize: 10})
+
+		if err := obs.Insert(&Order{ID: 1, Symbol: "ETH", Side: "BUY", Price: 400, Volume: 10}); !errors.Is(err, ErrUnknownSymbol) {
+			t.Errorf("Expected ErrUnknownSymbol, got %v", err)
+		}
+		if _, exists := obs.Book("ETH"); exists {
+			t.Error("Expected no book for a rejected symbol")
+		}
+
+		if err := obs.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 12.25, Volume: 20}); err != nil {
+			t.Errorf("Unexpected error for a registered symbol: %v", err)
+		}
+		if err := obs.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 12.23, Volume: 20}); !errors.Is(err, ErrInvalidTick) {
+			t.Errorf("Expected the symbol tick size to apply, got %v", err)
+		}
+		if err := obs.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "BUY", Price: 12.25, Volume: 15}); !errors.Is(err, ErrInvalidLot) {
+			t.Errorf("Expected the symbol lot size to apply, got %v", err)
+		}
+	})
+
+	t.Run("lenient mode auto creates books", func(t *testing.T) {
+		obs := NewOrderBooks(WithTickSize(0.01))
+		obs.RegisterSymbol("FFLY", SymbolConfig{TickSize: 0.05})
+
+		if err := obs.Insert(&Order{ID: 1, Symbol: "ETH", Side: "BUY", Price: 400.01, Volume: 7}); err != nil {
+			t.Errorf("Expected an unregistered symbol to be auto created, got %v", err)
+		}
+		if err := obs.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 12.01, Volume: 1}); !errors.Is(err, ErrInvalidTick) {
+			t.Errorf("Expected the registered tick size to override the default, got %v", err)
+		}
+
+		// registering a symbol that already trades reconfigures its book
+		obs.RegisterSymbol("ETH", SymbolConfig{LotSize: 5})
+		if err := obs.Insert(&Order{ID: 3, Symbol: "ETH", Side: "BUY", Price: 400.01, Volume: 7}); !errors.Is(err, ErrInvalidLot) {
+			t.Errorf("Expected ErrInvalidLot after registering ETH, got %v", err)
+		}
+	})
+}
+
+// checkHeapIndices checks that every order of both heaps knows its position.
+func checkHeapIndices(t *testing.T, ob *OrderBook) {
+	t.Helper()
+	for i, order := range *ob.BuyOrders {
+		if order.HeapIndex != i {
+			t.Errorf("Buy order %d is at %d but has HeapIndex %d", order.ID, i, order.HeapIndex)
+		}
+	}
+	for i, order := range *ob.SellOrders {
+		if order.HeapIndex != i {
+			t.Errorf("Sell order %d is at %d but has HeapIndex %d", order.ID, i, order.HeapIndex)
+		}
+	}
+}
+
+func TestHeapIndex(t *testing.T) {
+	ob := NewOrderBook(steppingClock(t))
+	for i := 1; i <= 8; i++ {
+		ob.Insert(&Order{ID: i, Symbol: "FFLY", Side: "BUY", Price: float64(40 + i%4), Volume: 10})
+		ob.Insert(&Order{ID: 100 + i, Symbol: "FFLY", Side: "SELL", Price: float64(50 + i%3), Volume: 10})
+	}
+	checkHeapIndices(t, ob)
+
+	ob.Update(2, 42, 20) // volume increase, re-sifted with heap.Fix
+	ob.Update(3, 42, 5)  // reprice from 43 with a volume decrease, keeps its time priority
+	ob.Update(5, 44, 5)  // reprice
+	ob.Cancel(104)
+	ob.Insert(&Order{ID: 200, Symbol: "FFLY", Side: "SELL", Price: 43, Volume: 15}) // crosses and partially fills
+	checkHeapIndices(t, ob)
+
+	// order 2 lost its time priority to the other 42 bids, order 3 kept its own
+	var ids []int
+	ob.ForEachResting("BUY", func(order OrderStatus) bool {
+		if order.Price == 42 {
+			ids = append(ids, order.ID)
+		}
+		return true
+	})
+	if expected := []int{3, 6, 2}; !reflect.DeepEqual(ids, expected) {
+		t.Errorf("Expected bids at 42 in order %v, got %v", expected, ids)
+	}
+
+	for _, order := range ob.Orders {
+		if order.CancelReason != "" && order.HeapIndex != -1 {
+			t.Errorf("Expected removed order %d to have HeapIndex -1, got %d", order.ID, order.HeapIndex)
+		}
+	}
+}
+
+// repricedBook builds a book of n bids (and no asks, so reprices never trade) to benchmark repeated reprices on.
+func repricedBook(b *testing.B, n int) *OrderBook {
+	ob := NewOrderBook(WithLogger(log.New(io.Discard, "", 0)))
+	for i := 0; i < n; i++ {
+		if _, err := ob.Insert(&Order{ID: i, Symbol: "FFLY", Side: "BUY", Price: float64(1 + i%100), Volume: 10}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return ob
+}
+
+// benchmarkReprice moves every order of a repricedBook by one price level in turn through Update. With a stale
+// HeapIndex, Update falls back to remove and reinsert, which is what the heap.Fix path is compared against.
+func benchmarkReprice(b *testing.B, staleIndex bool) {
+	const n = 10000
+	ob := repricedBook(b, n)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		order := ob.Orders[i%n]
+		if staleIndex {
+			order.HeapIndex = -1
+		}
+		if _, err := ob.Update(order.ID, float64(1+int(order.Price)%100), order.Volume); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRepriceHeapFix(b *testing.B) { benchmarkReprice(b, false) }
+
+func BenchmarkRepriceRemovePush(b *testing.B) { benchmarkReprice(b, true) }
+
+func TestReplace(t *testing.T) {
+	ob := NewOrderBook(steppingClock(t))
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 5})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 5})
+
+	// a rejected new order leaves the old one resting
+	if _, err := ob.Replace(1, &Order{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 45.00001, Volume: 5}); !errors.Is(err, ErrInvalidTick) {
+		t.Errorf("Expected ErrInvalidTick, got %v", err)
+	}
+	if status, _ := ob.GetOrder(1); status.CancelReason != "" {
+		t.Errorf("Expected order 1 to keep resting after a rejected replace, got %q", status.CancelReason)
+	}
+
+	// so does a new order insert rejects after the old one was taken out, and the old one keeps its place
+	layout := append([]*Order(nil), *ob.BuyOrders...)
+	if _, err := ob.Replace(1, &Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 5}); !errors.Is(err, ErrDuplicateOrder) {
+		t.Errorf("Expected ErrDuplicateOrder, got %v", err)
+	}
+	if status, _ := ob.GetOrder(1); status.CancelReason != "" || status.Cancelled {
+		t.Errorf("Expected order 1 to keep resting after a duplicate replace, got %+v", status)
+	}
+	for i, order := range *ob.BuyOrders {
+		if order != layout[i] {
+			t.Errorf("Expected order %d at index %d after a rejected replace, got order %d", layout[i].ID, i, order.ID)
+		}
+	}
+	if err := ob.Validate(); err != nil {
+		t.Errorf("Unexpected invalid book: %v", err)
+	}
+
+	old, _ := ob.GetOrder(1)
+	if _, err := ob.Replace(1, &Order{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 5}); err != nil {
+		t.Fatalf("Unexpected replace error: %v", err)
+	}
+	if status, _ := ob.GetOrder(1); status.CancelReason != Replaced {
+		t.Errorf("Expected order 1 to be replaced, got %q", status.CancelReason)
+	}
+	replacement, _ := ob.GetOrder(3)
+	if !replacement.Inserted.After(old.Inserted) {
+		t.Errorf("Expected the replacement to get a fresh timestamp, got %v (old %v)", replacement.Inserted, old.Inserted)
+	}
+
+	// the replacement queues behind order 2, and trades are returned
+	trades, _ := ob.Replace(99, &Order{ID: 4, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 6})
+	var makers []int
+	for _, trade := range trades {
+		makers = append(makers, trade.MakerID)
+	}
+	if expected := []int{2, 3}; !reflect.DeepEqual(makers, expected) {
+		t.Errorf("Expected fills against %v, got %v", expected, makers)
+	}
+
+	// a replace rejected by the halt leaves the old order first in its queue
+	halted := NewOrderBook(WithHaltMode(RejectDuringHalt))
+	halted.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 5})
+	halted.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 5})
+	halted.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "SELL", Price: 47, Volume: 5})
+	halted.Halt()
+	if _, err := halted.Replace(1, &Order{ID: 4, Symbol: "FFLY", Side: "BUY", Price: 47, Volume: 5}); !errors.Is(err, ErrHalted) {
+		t.Errorf("Expected ErrHalted, got %v", err)
+	}
+	if status, _ := halted.GetOrder(1); status.CancelReason != "" || status.Cancelled {
+		t.Errorf("Expected order 1 to keep resting after a halted replace, got %+v", status)
+	}
+	halted.Resume()
+	result, _ := halted.Insert(&Order{ID: 5, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 1})
+	if len(result.Trades) != 1 || result.Trades[0].MakerID != 1 {
+		t.Errorf("Expected order 1 to keep its priority, got %+v", result.Trades)
+	}
+}
+
+func TestSelfTradePrevention(t *testing.T) {
+	// alice's buy of 8 meets her own ask of 5 at 45 before bob's ask of 5 at 46
+	testCases := []struct {
+		mode      SelfTradeMode
+		cancelled []int // the orders cancelled with SelfTradePrevention
+		traded    int   // volume traded with bob
+		remaining map[int]int
+	}{
+		{CancelNewest, []int{3}, 0, map[int]int{1: 5, 2: 5}},
+		{CancelOldest, []int{1}, 5, map[int]int{3: 3}},
+		{DecrementAndCancel, []int{1}, 3, map[int]int{2: 2}},
+	}
+	for _, tc := range testCases {
+		ob := NewOrderBook(WithSelfTradeMode(tc.mode), WithLogger(log.New(io.Discard, "", 0)))
+		ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 5, Account: "alice"})
+		ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 46, Volume: 5, Account: "bob"})
+		result, err := ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 46, Volume: 8, Account: "alice"})
+		if err != nil {
+			t.Fatalf("mode %d: unexpected error %v", tc.mode, err)
+		}
+
+		traded := 0
+		for _, trade := range result.Trades {
+			if trade.MakerID != 2 || trade.IsWash {
+				t.Errorf("mode %d: expected trades with bob only, got %+v", tc.mode, trade)
+			}
+			traded += trade.Volume
+		}
+		if traded != tc.traded {
+			t.Errorf("mode %d: expected %d traded with bob, got %d", tc.mode, tc.traded, traded)
+		}
+		for _, id := range tc.cancelled {
+			if order, _ := ob.GetOrder(id); order.CancelReason != SelfTradePrevention {
+				t.Errorf("mode %d: expected order %d cancelled by self trade prevention, got %q", tc.mode, id, order.CancelReason)
+			}
+		}
+		for id, volume := range tc.remaining {
+			if order, _ := ob.GetOrder(id); order.CancelReason != "" || order.Volume != volume {
+				t.Errorf("mode %d: expected order %d resting with %d, got %+v", tc.mode, id, volume, order)
+			}
+		}
+		if err := ob.Validate(); err != nil {
+			t.Errorf("mode %d: %v", tc.mode, err)
+		}
+	}
+}
+
+func TestSelfTradeMode(t *testing.T) {
+	ob := NewOrderBook(WithSelfTradeMode(RejectIncoming))
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 46, Volume: 5, Account: "alice"})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 47, Volume: 5, Account: "bob"})
+
+	_, err := ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 46, Volume: 5, Account: "alice"})
+	if !errors.Is(err, ErrSelfCross) {
+		t.Errorf("Expected ErrSelfCross for a same account crossing insert, got %v", err)
+	}
+	if _, exists := ob.GetOrder(3); exists {
+		t.Error("Expected the rejected order not to reach the book")
+	}
+
+	// below its own ask, alice can still bid
+	if _, err := ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 1, Account: "alice"}); err != nil {
+		t.Errorf("Unexpected error for a non crossing order: %v", err)
+	}
+
+	result, err := ob.Insert(&Order{ID: 5, Symbol: "FFLY", Side: "BUY", Price: 46, Volume: 5, Account: "carol"})
+	trades := result.Trades
+	if err != nil || len(trades) != 1 || trades[0].MakerID != 1 {
+		t.Errorf("Expected another account to match order 1, got %v (%v)", trades, err)
+	}
+
+	// once alice's ask is filled she can take bob's
+	if _, err := ob.Insert(&Order{ID: 6, Symbol: "FFLY", Side: "BUY", Price: 47, Volume: 1, Account: "alice"}); err != nil {
+		t.Errorf("Expected no self cross once the resting order left the book, got %v", err)
+	}
+
+	// the default mode lets an account trade against itself
+	allow := NewOrderBook()
+	allow.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 46, Volume: 5, Account: "alice"})
+	if result, err := allow.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 46, Volume: 5, Account: "alice"}); err != nil || len(result.Trades) != 1 {
+		t.Errorf("Expected a self trade under AllowSelfTrade, got %v (%v)", result.Trades, err)
+	}
+}
+
+func TestTradeJournal(t *testing.T) {
+	var journal bytes.Buffer
+	ob := NewOrderBook(WithTradeJournal(&journal), WithVerboseTrades(), steppingClock(t))
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 46, Volume: 2})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 46.5, Volume: 2})
+	ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "SELL", Price: 47, Volume: 2})
+	ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "BUY", Price: 47, Volume: 5})
+
+	lines := strings.Split(strings.TrimSuffix(journal.String(), "\n"), "\n")
+	if len(lines) != len(ob.Trades) {
+		t.Fatalf("Expected %d journal lines, got %d: %q", len(ob.Trades), len(lines), journal.String())
+	}
+	for i, line := range lines {
+		fields := strings.SplitN(line, ",", 3)
+		if len(fields) != 3 {
+			t.Fatalf("Malformed journal line %q", line)
+		}
+		if fields[0] != strconv.Itoa(i+1) {
+			t.Errorf("Expected trade ID %d, got %s", i+1, fields[0])
+		}
+		if _, err := time.Parse(time.RFC3339Nano, fields[1]); err != nil {
+			t.Errorf("Expected an RFC 3339 timestamp, got %q: %v", fields[1], err)
+		}
+		if fields[2] != ob.Trades[i] {
+			t.Errorf("Expected journal line %d to be %q, got %q", i, ob.Trades[i], fields[2])
+		}
+	}
+}
+
+func TestHaltAndResume(t *testing.T) {
+	ob := NewOrderBook(steppingClock(t))
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 46, Volume: 5})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 47, Volume: 5})
+
+	ob.Halt()
+	if !ob.IsHalted() {
+		t.Fatal("Expected the book to be halted")
+	}
+	ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 48, Volume: 4})
+	ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "BUY", Price: 47, Volume: 4})
+	ob.Insert(&Order{ID: 5, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 2})
+	if len(ob.Trades) != 0 {
+		t.Fatalf("Expected no trades during the halt, got %v", ob.Trades)
+	}
+
+	// 47 trades the most: 8 bids against 12 asks
+	trades := ob.Resume()
+	expected := []string{"FFLY,47,2,5,3", "FFLY,47,2,3,1", "FFLY,47,3,4,1", "FFLY,47,1,4,2"}
+	if !reflect.DeepEqual(ob.Trades, expected) {
+		t.Errorf("Expected auction trades %v, got %v", expected, ob.Trades)
+	}
+	if len(trades) != len(expected) {
+		t.Errorf("Expected Resume to return %d trades, got %d", len(expected), len(trades))
+	}
+	if ob.IsHalted() {
+		t.Error("Expected trading to resume")
+	}
+	if lines := ob.summaryLines("FFLY"); !reflect.DeepEqual(lines, []string{"===FFLY===", "SELL,47,4"}) {
+		t.Errorf("Expected an uncrossed book, got %v", lines)
+	}
+
+	// continuous matching is back
+	if result, _ := ob.Insert(&Order{ID: 6, Symbol: "FFLY", Side: "BUY", Price: 47, Volume: 1}); len(result.Trades) != 1 {
+		t.Errorf("Expected a trade after resume, got %v", result.Trades)
+	}
+}
+
+func TestHaltRejectMode(t *testing.T) {
+	ob := NewOrderBook(WithHaltMode(RejectDuringHalt))
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 46, Volume: 5})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 44, Volume: 5})
+	ob.Halt()
+
+	if _, err := ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 46, Volume: 1}); !errors.Is(err, ErrHalted) {
+		t.Errorf("Expected a crossing insert to be rejected with ErrHalted, got %v", err)
+	}
+	if _, err := ob.Update(2, 46, 5); !errors.Is(err, ErrHalted) {
+		t.Errorf("Expected a crossing update to be rejected with ErrHalted, got %v", err)
+	}
+	if _, err := ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 1}); err != nil {
+		t.Errorf("Expected a non crossing insert to be accepted, got %v", err)
+	}
+	if trades := ob.Resume(); trades != nil {
+		t.Errorf("Expected no auction trades for an uncrossed book, got %v", trades)
+	}
+
+	// a price within the tolerance of the ask crosses it
+	ob = NewOrderBook(WithHaltMode(RejectDuringHalt), WithTickSize(0.01))
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 10.000000001, Volume: 5})
+	ob.Halt()
+	if _, err := ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 10, Volume: 5}); !errors.Is(err, ErrHalted) {
+		t.Errorf("Expected a buy at the ask within the tolerance to be rejected with ErrHalted, got %v", err)
+	}
+}
+
+func TestUncross(t *testing.T) {
+	ob := NewOrderBook(WithHaltMode(RejectDuringHalt))
+	ob.StartAuction()
+
+	orders := []*Order{
+		{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 20.10, Volume: 300},
+		{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 20.05, Volume: 200},
+		{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 20.00, Volume: 500},
+		{ID: 4, Symbol: "FFLY", Side: "SELL", Price: 19.95, Volume: 200},
+		{ID: 5, Symbol: "FFLY", Side: "SELL", Price: 20.00, Volume: 300},
+		{ID: 6, Symbol: "FFLY", Side: "SELL", Price: 20.05, Volume: 400},
+	}
+	for _, order := range orders {
+		// the auction collects crossing orders even under RejectDuringHalt
+		if _, err := ob.Insert(order); err != nil {
+			t.Fatalf("Unexpected error collecting order %d: %v", order.ID, err)
+		}
+	}
+	if len(ob.Trades) != 0 {
+		t.Fatalf("Expected no continuous matching during the auction, got %v", ob.Trades)
+	}
+
+	// 20.00 and 20.05 both match 500, 20.05 leaves the smaller imbalance (400 vs 500)
+	trades := ob.Uncross()
+	volume := 0
+	for _, trade := range trades {
+		if trade.Price != 20.05 {
+			t.Errorf("Expected every trade at the clearing price 20.05, got %v", trade)
+		}
+		volume += trade.Volume
+	}
+	if volume != 500 {
+		t.Errorf("Expected 500 matched, got %d", volume)
+	}
+	expected := []string{"===FFLY===", "SELL,20.05,400", "BUY,20,500"}
+	if lines := ob.summaryLines("FFLY"); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected summary %v, got %v", expected, lines)
+	}
+	if ob.IsHalted() {
+		t.Error("Expected continuous trading after the uncross")
+	}
+}
+
+func TestTotalVolume(t *testing.T) {
+	ob := NewOrderBook()
+	if volume := ob.TotalVolume("BUY"); volume != 0 {
+		t.Errorf("Expected 0 for an empty side, got %d", volume)
+	}
+
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 10})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 44, Volume: 5})
+	ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 44, Volume: 7})
+	ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "SELL", Price: 47, Volume: 3})
+	ob.Insert(&Order{ID: 5, Symbol: "FFLY", Side: "SELL", Price: 48, Volume: 8})
+	ob.Insert(&Order{ID: 6, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 4}) // fills 4 of order 1
+	ob.Cancel(3)
+
+	if volume := ob.TotalVolume("BUY"); volume != 11 {
+		t.Errorf("Expected 11 bid volume, got %d", volume)
+	}
+	if volume := ob.TotalVolume("SELL"); volume != 11 {
+		t.Errorf("Expected 11 ask volume, got %d", volume)
+	}
+	if volume := ob.TotalVolume("HOLD"); volume != 0 {
+		t.Errorf("Expected 0 for an invalid side, got %d", volume)
+	}
+}
+
+func TestMaxOrders(t *testing.T) {
+	ob := NewOrderBook(WithMaxOrders(3))
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 46, Volume: 5})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 47, Volume: 5})
+	if _, err := ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 44, Volume: 5}); err != nil {
+		t.Fatalf("Unexpected error below capacity: %v", err)
+	}
+
+	if _, err := ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "BUY", Price: 43, Volume: 5}); !errors.Is(err, ErrBookFull) {
+		t.Errorf("Expected the 4th resting order to be rejected with ErrBookFull, got %v", err)
+	}
+	// would take 5 at 46 and rest the other 2
+	if _, err := ob.Insert(&Order{ID: 5, Symbol: "FFLY", Side: "BUY", Price: 46, Volume: 7}); !errors.Is(err, ErrBookFull) {
+		t.Errorf("Expected a partially resting order to be rejected with ErrBookFull, got %v", err)
+	}
+
+	result, err := ob.Insert(&Order{ID: 6, Symbol: "FFLY", Side: "BUY", Price: 47, Volume: 7})
+	trades := result.Trades
+	if err != nil {
+		t.Fatalf("Expected a fully matching taker to execute at capacity, got %v", err)
+	}
+	if len(trades) != 2 {
+		t.Errorf("Expected 2 fills, got %v", trades)
+	}
+	if status, _ := ob.GetOrder(6); status.CancelReason != FullyFilled {
+		t.Errorf("Expected order 6 to be fully filled, got %+v", status)
+	}
+
+	// room was freed by the fills
+	if _, err := ob.Insert(&Order{ID: 7, Symbol: "FFLY", Side: "BUY", Price: 43, Volume: 5}); err != nil {
+		t.Errorf("Expected an insert to succeed once room is freed, got %v", err)
+	}
+
+	// float noise within the price tolerance still counts as crossing
+	ob = NewOrderBook(WithMaxOrders(1), WithTickSize(0.01))
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 10.000000001, Volume: 5})
+	if result, err := ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 10, Volume: 5}); err != nil || len(result.Trades) != 1 {
+		t.Errorf("Expected a fully matching taker at capacity, got %v (%v)", result.Trades, err)
+	}
+}
+
+func TestGlobalUniqueIDs(t *testing.T) {
+	obs := NewOrderBooks().WithGlobalUniqueIDs()
+	if err := obs.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 5}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := obs.Insert(&Order{ID: 1, Symbol: "ETH", Side: "BUY", Price: 400, Volume: 5}); !errors.Is(err, ErrDuplicateOrder) {
+		t.Errorf("Expected ErrDuplicateOrder for an ID reused in another symbol, got %v", err)
+	}
+	if _, exists := obs.Book("ETH"); exists {
+		t.Error("Expected no book to be created for the rejected order")
+	}
+	// a rejected insert doesn't use up its ID
+	if err := obs.Insert(&Order{ID: 2, Symbol: "ETH", Side: "HOLD", Price: 400, Volume: 5}); !errors.Is(err, ErrInvalidSide) {
+		t.Errorf("Expected ErrInvalidSide, got %v", err)
+	}
+	if err := obs.Insert(&Order{ID: 2, Symbol: "ETH", Side: "BUY", Price: 400, Volume: 5}); err != nil {
+		t.Errorf("Expected ID 2 to still be free, got %v", err)
+	}
+
+	lenient := NewOrderBooks()
+	lenient.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 5})
+	if err := lenient.Insert(&Order{ID: 1, Symbol: "ETH", Side: "BUY", Price: 400, Volume: 5}); err != nil {
+		t.Errorf("Expected IDs to be unique per symbol only by default, got %v", err)
+	}
+}
+
+// recordingLogger is a Logger keeping every message.
+type recordingLogger struct {
+	messages []string
+}
+
+func (l *recordingLogger) Printf(format string, v ...any) {
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+}
+
+func (l *recordingLogger) Println(v ...any) {
+	l.messages = append(l.messages, fmt.Sprintln(v...))
+}
+
+func TestCustomLogger(t *testing.T) {
+	logger := &recordingLogger{}
+	ob := NewOrderBook(WithLogger(logger))
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "HOLD", Price: 45, Volume: 5})
+	ob.Cancel(42)
+
+	expected := []string{
+		"Rejected order 1: " + ErrInvalidSide.Error() + ": \"HOLD\"\n",
+		"Order not found. Unable to cancel.\n",
+	}
+	for _, message := range expected {
+		found := false
+		for _, logged := range logger.messages {
+			found = found || logged == message
+		}
+		if !found {
+			t.Errorf("Expected %q to be logged, got %q", message, logger.messages)
+		}
+	}
+
+	var buf bytes.Buffer
+	ob = NewOrderBook(WithLogger(SlogLogger{slog.New(slog.NewTextHandler(&buf, nil))}))
+	ob.Cancel(42)
+	if !strings.Contains(buf.String(), `level=INFO msg="Order not found. Unable to cancel."`) {
+		t.Errorf("Expected a structured log record, got %q", buf.String())
+	}
+}
+
+func TestAggressorSide(t *testing.T) {
+	ob := NewOrderBook()
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 46, Volume: 5})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 44, Volume: 5})
+
+	result, _ := ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 46, Volume: 1})
+	trades := result.Trades
+	if len(trades) != 1 || trades[0].AggressorSide != "BUY" {
+		t.Errorf("Expected a buyer initiated trade, got %+v", trades)
+	}
+
+	result, _ = ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "SELL", Price: 44, Volume: 1})
+	trades = result.Trades
+	if len(trades) != 1 || trades[0].AggressorSide != "SELL" {
+		t.Errorf("Expected a seller initiated trade, got %+v", trades)
+	}
+
+	// an update crossing the book makes the updated order the aggressor
+	trades, _ = ob.Update(2, 46, 5)
+	if len(trades) != 1 || trades[0].AggressorSide != "BUY" || trades[0].TakerID != 2 {
+		t.Errorf("Expected order 2 to be the buying aggressor, got %+v", trades)
+	}
+}
+
+func TestProRata(t *testing.T) {
+	tests := []struct {
+		name     string
+		rounding RoundingMode
+		resting  []int
+		incoming int
+		expected map[int]int // maker ID to traded volume
+	}{
+		{"floor residual goes to the earliest order", RoundDown, []int{5, 3, 2}, 7, map[int]int{1: 4, 2: 2, 3: 1}},
+		{"half up", RoundHalfUp, []int{5, 3, 2}, 7, map[int]int{1: 4, 2: 2, 3: 1}},
+		{"floor of equal orders", RoundDown, []int{1, 1, 1}, 2, map[int]int{1: 1, 2: 1}},
+		{"half up over allocation is taken from the latest order", RoundHalfUp, []int{1, 1}, 1, map[int]int{1: 1}},
+		{"whole level", RoundDown, []int{2, 3}, 9, map[int]int{1: 2, 2: 3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ob := NewOrderBook(WithProRata(tt.rounding))
+			for i, volume := range tt.resting {
+				ob.Insert(&Order{ID: i + 1, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: volume})
+			}
+			result, _ := ob.Insert(&Order{ID: 99, Symbol: "FFLY", Side: "BUY", Price: 46, Volume: tt.incoming})
+			trades := result.Trades
+
+			traded := make(map[int]int)
+			for _, trade := range trades {
+				if trade.TakerID != 99 || trade.Price != 45 {
+					t.Errorf("Unexpected trade %+v", trade)
+				}
+				traded[trade.MakerID] += trade.Volume
+			}
+			if !reflect.DeepEqual(traded, tt.expected) {
+				t.Errorf("Expected allocation %v, got %v", tt.expected, traded)
+			}
+			checkHeapIndices(t, ob)
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	ob := NewOrderBook()
+	for i := 1; i <= 6; i++ {
+		ob.Insert(&Order{ID: i, Symbol: "FFLY", Side: "BUY", Price: float64(40 + i%3), Volume: 10})
+	}
+	ob.Insert(&Order{ID: 7, Symbol: "FFLY", Side: "SELL", Price: 50, Volume: 10})
+	if err := ob.Validate(); err != nil {
+		t.Fatalf("Expected a valid book, got %v", err)
+	}
+
+	// found by FuzzValidate: a second live order 7 used to leave the first one stranded in the heap
+	if _, err := ob.Insert(&Order{ID: 7, Symbol: "FFLY", Side: "SELL", Price: 51, Volume: 1}); !errors.Is(err, ErrDuplicateOrder) {
+		t.Errorf("Expected ErrDuplicateOrder for a resting ID, got %v", err)
+	}
+
+	ob.Orders[7].Cancelled = true
+	if err := ob.Validate(); err == nil || !strings.Contains(err.Error(), "order 7 left the book") {
+		t.Errorf("Expected a cancelled resting order to be reported, got %v", err)
+	}
+	ob.Orders[7].Cancelled = false
+
+	(*ob.BuyOrders)[0].Price = 1
+	if err := ob.Validate(); err == nil || !strings.Contains(err.Error(), "comes before its parent") {
+		t.Errorf("Expected a broken heap to be reported, got %v", err)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	var logs strings.Builder
+	ob := NewOrderBook(WithLogger(log.New(&logs, "", 0)))
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 5})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 46, Volume: 5})
+	ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 47, Volume: 5})
+	ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "SELL", Price: 50, Volume: 5})
+	ob.Insert(&Order{ID: 5, Symbol: "FFLY", Side: "SELL", Price: 49, Volume: 5})
+
+	// a consistent book is left alone
+	logs.Reset()
+	ob.Reconcile()
+	if strings.Contains(logs.String(), "Reconcile:") {
+		t.Errorf("Expected nothing to fix, got %q", logs.String())
+	}
+
+	// desync the book: order 2 in the map only, an unknown order 9 in the sell heap only, and order 5 removed from the
+	// book but still resting
+	heap.Remove(ob.BuyOrders, ob.Orders[2].HeapIndex)
+	heap.Push(ob.SellOrders, &Order{ID: 9, Symbol: "FFLY", Side: "SELL", Price: 48, Volume: 5})
+	ob.Orders[5].Cancelled, ob.Orders[5].CancelReason = true, UserCancel
+	if err := ob.Validate(); err == nil {
+		t.Fatal("Expected the desynced book to be invalid")
+	}
+
+	logs.Reset()
+	ob.Reconcile()
+	if err := ob.Validate(); err != nil {
+		t.Fatalf("Expected a valid book after Reconcile, got %v", err)
+	}
+	for _, fix := range []string{"order 2 is live but in no heap", "order 9, unknown by its ID", "order 5, which left the book"} {
+		if !strings.Contains(logs.String(), fix) {
+			t.Errorf("Expected the log to report %q, got %q", fix, logs.String())
+		}
+	}
+	if _, exists := ob.Orders[2]; exists {
+		t.Error("Expected order 2 to be forgotten")
+	}
+	bids, asks := ob.Depth(0)
+	if len(bids) != 2 || bids[0].Price != 47 || bids[1].Price != 45 || len(asks) != 1 || asks[0].Price != 50 {
+		t.Errorf("Expected bids 47, 45 and the ask 50, got %+v and %+v", bids, asks)
+	}
+
+	// matching only sees the reconciled orders
+	result, _ := ob.Insert(&Order{ID: 6, Symbol: "FFLY", Side: "BUY", Price: 50, Volume: 10})
+	if len(result.Trades) != 1 || result.Trades[0].MakerID != 4 || result.Trades[0].Volume != 5 {
+		t.Errorf("Expected one trade with order 4, got %+v", result.Trades)
+	}
+}
+
+// FuzzValidate applies random sequences of operations to a book and checks its consistency after each one. Every
+// 4 bytes of the input make an operation: its kind, order ID, price and volume.
+func FuzzValidate(f *testing.F) {
+	f.Add([]byte{0, 1, 45, 5, 0, 2, 44, 3, 0, 3, 45, 2})
+	f.Add([]byte{0, 1, 45, 5, 1, 2, 46, 3, 2, 1, 0, 0, 3, 2, 0, 1})
+	f.Add([]byte{0, 1, 45, 5, 0, 2, 45, 5, 4, 3, 45, 7, 1, 1, 44, 9})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ob := NewOrderBook(WithLogger(log.New(io.Discard, "", 0)))
+		for i := 0; i+4 <= len(data); i += 4 {
+			kind, id, price, volume := data[i]%5, int(data[i+1]%16), float64(40+data[i+2]%10), int(data[i+3]%10)
+			side := "BUY"
+			if id%2 == 1 {
+				side = "SELL"
+			}
+			switch kind {
+			case 0:
+				ob.Insert(&Order{ID: id, Symbol: "FFLY", Side: side, Price: price, Volume: volume})
+			case 1:
+				ob.Update(id, price, volume)
+			case 2:
+				ob.Cancel(id)
+			case 3:
+				ob.Reduce(id, volume)
+			case 4:
+				ob.Replace(id, &Order{ID: id + 16, Symbol: "FFLY", Side: side, Price: price, Volume: volume})
+			}
+			if err := ob.Validate(); err != nil {
+				t.Fatalf("operation %d: %v", i/4, err)
+			}
+		}
+	})
+}
+
+func TestDiffSince(t *testing.T) {
+	ob := NewOrderBook(WithLevelDiffs())
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 5})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 47, Volume: 3})
+	seq := ob.Seq()
+	ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 2})
+	ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 7}) // takes the whole bid level
+	ob.Cancel(2)
+	ob.Cancel(42) // changes nothing, no sequence number
+
+	expected := []LevelChange{
+		{Seq: 3, Side: "BUY", Price: 45, Volume: 7, Kind: LevelModified},
+		{Seq: 4, Side: "BUY", Price: 45, Kind: LevelRemoved},
+		{Seq: 5, Side: "SELL", Price: 47, Kind: LevelRemoved},
+	}
+	if seq != 2 || ob.Seq() != 5 {
+		t.Errorf("Expected sequence numbers 2 and 5, got %d and %d", seq, ob.Seq())
+	}
+	if changes := ob.DiffSince(seq); !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Expected changes %+v, got %+v", expected, changes)
+	}
+	if changes := ob.DiffSince(ob.Seq()); changes != nil {
+		t.Errorf("Expected no changes since the last sequence number, got %+v", changes)
+	}
+
+	ob.Insert(&Order{ID: 5, Symbol: "FFLY", Side: "SELL", Price: 46, Volume: 1})
+	expected = []LevelChange{{Seq: 6, Side: "SELL", Price: 46, Volume: 1, Kind: LevelAdded}}
+	if changes := ob.DiffSince(5); !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Expected changes %+v, got %+v", expected, changes)
+	}
+
+	if changes := NewOrderBook().DiffSince(0); changes != nil {
+		t.Errorf("Expected nothing recorded without WithLevelDiffs, got %+v", changes)
+	}
+}
+
+func TestReservePolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy  ReservePolicy
+		makers  []int // maker of each of the three buys
+		reserve int
+	}{
+		{LosePriority, []int{1, 2, 1}, 2}, // the refilled iceberg queues behind order 2
+		{KeepPriority, []int{1, 1, 1}, 0}, // the refilled reserve order stays at the front of 45
+	} {
+		ob := NewOrderBook(steppingClock(t))
+		ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 8, Peak: 2, ReservePolicy: tc.policy})
+		ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 2})
+		if ob.TotalVolume("SELL") != 4 || ob.Orders[1].Reserve != 6 {
+			t.Errorf("Expected only the peak of order 1 to be displayed, got %+v", ob.Orders[1])
+		}
+
+		var makers []int
+		for i := 0; i < 3; i++ {
+			result, _ := ob.Insert(&Order{ID: 10 + i, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 2})
+			trades := result.Trades
+			for _, trade := range trades {
+				makers = append(makers, trade.MakerID)
+			}
+		}
+		if !reflect.DeepEqual(makers, tc.makers) {
+			t.Errorf("policy %d: expected makers %v, got %v", tc.policy, tc.makers, makers)
+		}
+		if order := ob.Orders[1]; order.Volume != 2 || order.Reserve != tc.reserve {
+			t.Errorf("policy %d: expected order 1 to show 2 with %d in reserve, got %+v", tc.policy, tc.reserve, order)
+		}
+		if err := ob.Validate(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestOrdersOlderThan(t *testing.T) {
+	now := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	ob := NewOrderBook(WithClock(func() time.Time {
+		now = now.Add(time.Minute)
+		return now
+	}))
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 44, Volume: 5})  // 9:01
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 47, Volume: 5}) // 9:02
+	ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 5})  // 9:03
+	ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "SELL", Price: 46, Volume: 5}) // 9:04
+	ob.Cancel(1)
+
+	var ids []int
+	for _, order := range ob.OrdersOlderThan(90*time.Second, now) { // older than 9:02:30
+		ids = append(ids, order.ID)
+	}
+	if !reflect.DeepEqual(ids, []int{2}) {
+		t.Errorf("Expected only order 2 to be stale, got %v", ids)
+	}
+	if stale := ob.OrdersOlderThan(time.Hour, now); len(stale) != 0 {
+		t.Errorf("Expected no order older than an hour, got %v", stale)
+	}
+	if stale := ob.OrdersOlderThan(0, now.Add(time.Second)); len(stale) != 3 {
+		t.Errorf("Expected every live order to be stale, got %v", stale)
+	}
+}
+
+func TestPriceTolerance(t *testing.T) {
+	drifted := 0.1 + 0.2 // 0.30000000000000004
+
+	ob := NewOrderBook()
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: drifted, Volume: 5})
+	if result, _ := ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 0.3, Volume: 2}); len(result.Trades) != 1 || result.Trades[0].Volume != 2 {
+		t.Errorf("Expected 0.3 to cross %v, got %+v", drifted, result.Trades)
+	}
+
+	// the drifted bid is at the same level as 0.3, so time priority decides
+	ob = NewOrderBook()
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 0.3, Volume: 5})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: drifted, Volume: 5})
+	if result, _ := ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "SELL", Price: 0.3, Volume: 1}); len(result.Trades) != 1 || result.Trades[0].MakerID != 1 {
+		t.Errorf("Expected the earlier bid to be matched first, got %+v", result.Trades)
+	}
+
+	// a whole tick apart is still a different price
+	ob = NewOrderBook(WithTickSize(0.05))
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 23.5, Volume: 5})
+	if result, _ := ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 23.45, Volume: 5}); len(result.Trades) != 0 {
+		t.Errorf("Expected 23.45 not to cross 23.5, got %+v", result.Trades)
+	}
+}
+
+func TestNonPositiveUpdateIsDiscarded(t *testing.T) {
+	ob := NewOrderBook()
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 47, Volume: 5})
+
+	for _, volume := range []int{-1, 0} {
+		if _, err := ob.Update(1, 47, volume); !errors.Is(err, ErrVolumeOutOfRange) {
+			t.Errorf("Expected volume %d to be rejected, got %v", volume, err)
+		}
+		if order := ob.Orders[1]; order.Volume != 5 || order.CancelReason != "" {
+			t.Errorf("Expected volume %d to leave order 1 untouched, got %+v", volume, order)
+		}
+	}
+
+	// the explicit way to take volume off
+	ob.Reduce(1, 1)
+	if ob.Orders[1].Volume != 4 {
+		t.Errorf("Expected Reduce to leave 4, got %d", ob.Orders[1].Volume)
+	}
+}
+
+func TestLatencyRecorder(t *testing.T) {
+	var ops []string
+	ob := NewOrderBook(WithLatencyRecorder(func(op string, d time.Duration) {
+		if d <= 0 {
+			t.Errorf("Expected a positive duration for %s, got %v", op, d)
+		}
+		ops = append(ops, op)
+	}))
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 5})
+	ob.Update(1, 46, 5)
+	ob.Cancel(1)
+	ob.Reduce(1, 1) // not timed
+
+	if expected := []string{"INSERT", "UPDATE", "CANCEL"}; !reflect.DeepEqual(ops, expected) {
+		t.Errorf("Expected %v to be recorded, got %v", expected, ops)
+	}
+}
+
+func TestOrdersAtLevel(t *testing.T) {
+	ob := NewOrderBook(steppingClock(t))
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 46, Volume: 5})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 5})
+	ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "SELL", Price: 46, Volume: 1})
+	ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "SELL", Price: 47, Volume: 5})
+	ob.Insert(&Order{ID: 5, Symbol: "FFLY", Side: "SELL", Price: 46, Volume: 3, Hidden: true})
+	ob.Insert(&Order{ID: 6, Symbol: "FFLY", Side: "SELL", Price: 46, Volume: 2})
+	ob.Cancel(3)
+
+	var ids []int
+	for _, order := range ob.OrdersAtLevel("SELL", 46) {
+		ids = append(ids, order.ID)
+	}
+	if !reflect.DeepEqual(ids, []int{1, 5, 6}) {
+		t.Errorf("Expected orders [1 5 6] at 46 by time, got %v", ids)
+	}
+	if orders := ob.OrdersAtLevel("BUY", 46); orders != nil {
+		t.Errorf("Expected no bids at 46, got %v", orders)
+	}
+	if orders := ob.OrdersAtLevel("HOLD", 46); orders != nil {
+		t.Errorf("Expected nothing for an unknown side, got %v", orders)
+	}
+}
+
+func TestInsertOCO(t *testing.T) {
+	// a take profit and a stop loss style pair of sells around a resting bid
+	newBook := func(opts ...OrderBookOption) *OrderBook {
+		ob := NewOrderBook(opts...)
+		if err := ob.InsertOCO(
+			&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 50, Volume: 5},
+			&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 40, Volume: 5},
+		); err != nil {
+			t.Fatalf("InsertOCO returned %v", err)
+		}
+		return ob
+	}
+
+	// a partial fill of leg 2 cancels leg 1
+	ob := newBook()
+	ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 40, Volume: 1})
+	if ob.Orders[2].Volume != 4 {
+		t.Errorf("Expected leg 2 to trade, got %+v", ob.Orders[2])
+	}
+	if reason := ob.Orders[1].CancelReason; reason != OneCancelsOther {
+		t.Errorf("Expected leg 1 to be cancelled by leg 2, got %q", reason)
+	}
+
+	// and the other way around
+	ob = newBook()
+	ob.Update(2, 55, 5) // leg B now above leg A
+	ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 50, Volume: 1})
+	if reason := ob.Orders[2].CancelReason; reason != OneCancelsOther {
+		t.Errorf("Expected leg 2 to be cancelled by leg 1, got %q", reason)
+	}
+
+	// under OCOOnFullFill a partial fill keeps the other leg
+	ob = newBook(WithOCOTrigger(OCOOnFullFill))
+	ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 40, Volume: 1})
+	if reason := ob.Orders[1].CancelReason; reason != "" {
+		t.Errorf("Expected leg 1 to keep resting after a partial fill, got %q", reason)
+	}
+	ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "BUY", Price: 40, Volume: 4})
+	if reason := ob.Orders[1].CancelReason; reason != OneCancelsOther {
+		t.Errorf("Expected leg 1 to be cancelled once leg 2 filled, got %q", reason)
+	}
+
+	// a leg trading on insertion keeps the other one out of the book
+	ob = NewOrderBook()
+	ob.Insert(&Order{ID: 5, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 1})
+	ob.InsertOCO(&Order{ID: 6, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 1}, &Order{ID: 7, Symbol: "FFLY", Side: "SELL", Price: 50, Volume: 1})
+	if buy, sell := ob.Len(); buy != 0 || sell != 0 || ob.Orders[7].CancelReason != OneCancelsOther {
+		t.Errorf("Expected an empty book and leg 7 cancelled, got %d/%d and %+v", buy, sell, ob.Orders[7])
+	}
+	if err := ob.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	run := func(ob *OrderBook) []string {
+		ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 5})
+		ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 46, Volume: 5})
+		ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 46, Volume: 7})
+		return append(ob.Trades, ob.summaryLines("FFLY")...)
+	}
+	expected := run(NewOrderBook(WithLevelDiffs()))
+
+	ob := NewOrderBook(WithLevelDiffs())
+	run(ob)
+	ob.Halt()
+	ob.Reset()
+	if buy, sell := ob.Len(); buy != 0 || sell != 0 || len(ob.Orders) != 0 || len(ob.Trades) != 0 || len(ob.Executions) != 0 {
+		t.Fatalf("Expected an empty book after Reset, got %d/%d resting, %d orders, %d trades", buy, sell, len(ob.Orders), len(ob.Trades))
+	}
+	if ob.IsHalted() || ob.LastPrice != 0 || ob.Seq() != 0 {
+		t.Errorf("Expected the trading state to be reset, got halted %v, last price %v, seq %d", ob.IsHalted(), ob.LastPrice, ob.Seq())
+	}
+
+	if output := run(ob); !reflect.DeepEqual(output, expected) {
+		t.Errorf("Expected a reset book to behave like a fresh one: %v, got %v", expected, output)
+	}
+	if trades := ob.Executions; trades[0].ID != 1 {
+		t.Errorf("Expected trade IDs to restart at 1, got %d", trades[0].ID)
+	}
+}
+
+func TestPeggedOrders(t *testing.T) {
+	ob := NewOrderBook()
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 44, Volume: 5})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 48, Volume: 5})
+	ob.Insert(&Order{ID: 10, Symbol: "FFLY", Side: "BUY", Price: 40, Volume: 1, Peg: BestBid})
+	ob.Insert(&Order{ID: 11, Symbol: "FFLY", Side: "SELL", Price: 50, Volume: 1, Peg: Mid, PegOffset: 0.5})
+
+	expectPrices := func(step string, bid, mid float64) {
+		t.Helper()
+		if price := ob.Orders[10].Price; price != bid {
+			t.Errorf("%s: expected the bid pegged order at %v, got %v", step, bid, price)
+		}
+		if price := ob.Orders[11].Price; price != mid {
+			t.Errorf("%s: expected the mid pegged order at %v, got %v", step, mid, price)
+		}
+		if err := ob.Validate(); err != nil {
+			t.Errorf("%s: %v", step, err)
+		}
+	}
+	expectPrices("insert", 44, 46.5)
+
+	ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 5})
+	expectPrices("better bid", 45, 47)
+
+	ob.Update(2, 47.25, 5)
+	expectPrices("better ask", 45, 46.625)
+
+	ob.Cancel(3)
+	expectPrices("cancelled bid", 44, 46.125)
+
+	// the pegged bid joined the 44 level last, so order 1 is matched first
+	result, _ := ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "SELL", Price: 44, Volume: 5})
+	trades := result.Trades
+	if len(trades) != 1 || trades[0].MakerID != 1 {
+		t.Errorf("Expected order 1 to be matched before the pegged bid, got %+v", trades)
+	}
+	// no bid left but the pegged one: both pegged orders keep their price
+	expectPrices("no bid", 44, 46.125)
+
+	// mid prices off the tick grid are rounded away from the other side
+	ob = NewOrderBook(WithTickSize(0.05))
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 5})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 45.15, Volume: 5})
+	ob.Insert(&Order{ID: 10, Symbol: "FFLY", Side: "BUY", Price: 40, Volume: 1, Peg: Mid})
+	ob.Insert(&Order{ID: 11, Symbol: "FFLY", Side: "SELL", Price: 50, Volume: 1, Peg: Mid})
+	expectPrices("tick", 45.05, 45.1)
+}
+
+func TestInsertResult(t *testing.T) {
+	ob := NewOrderBook()
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 5})
+
+	testCases := []struct {
+		name     string
+		order    *Order
+		expected InsertResult // Trades are only counted
+		trades   int
+	}{
+		{"full fill", &Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 2}, InsertResult{FilledVolume: 2}, 1},
+		{"partial fill then rest", &Order{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 4}, InsertResult{Resting: true, FilledVolume: 3, RemainingVolume: 1}, 1},
+		{"no fill then rest", &Order{ID: 4, Symbol: "FFLY", Side: "BUY", Price: 44, Volume: 6}, InsertResult{Resting: true, RemainingVolume: 6}, 0},
+	}
+	for _, tc := range testCases {
+		result, err := ob.Insert(tc.order)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", tc.name, err)
+		}
+		if len(result.Trades) != tc.trades {
+			t.Errorf("%s: expected %d trades, got %v", tc.name, tc.trades, result.Trades)
+		}
+		result.Trades = nil
+		if !reflect.DeepEqual(result, tc.expected) {
+			t.Errorf("%s: expected %+v, got %+v", tc.name, tc.expected, result)
+		}
+	}
+}
+
+func TestCancelByAccount(t *testing.T) {
+	ob := NewOrderBook()
+	accounts := []string{"alice", "bob", "alice", "", "bob", "alice"}
+	for i, account := range accounts {
+		side, price := "BUY", float64(40+i)
+		if i%2 == 1 {
+			side, price = "SELL", float64(50+i)
+		}
+		ob.Insert(&Order{ID: i + 1, Symbol: "FFLY", Side: side, Price: price, Volume: 5, Account: account})
+	}
+	ob.Cancel(3) // already gone, not counted again
+
+	if cancelled := ob.CancelByAccount("alice"); cancelled != 2 {
+		t.Errorf("Expected 2 orders of alice to be cancelled, got %d", cancelled)
+	}
+	for id, account := range accounts {
+		order := ob.Orders[id+1]
+		if account == "alice" && order.CancelReason == "" {
+			t.Errorf("Expected order %d of alice to be cancelled", order.ID)
+		}
+		if account != "alice" && order.CancelReason != "" {
+			t.Errorf("Expected order %d of %q to keep resting, got %q", order.ID, account, order.CancelReason)
+		}
+	}
+	if cancelled := ob.CancelByAccount("alice"); cancelled != 0 {
+		t.Errorf("Expected nothing left to cancel, got %d", cancelled)
+	}
+	if cancelled := ob.CancelByAccount(""); cancelled != 0 {
+		t.Errorf("Expected anonymous orders to be left alone, got %d", cancelled)
+	}
+	if err := ob.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPriceImprovement(t *testing.T) {
+	testCases := []struct {
+		name     string
+		opts     []OrderBookOption
+		sell     float64
+		buy      float64
+		expected float64
+	}{
+		{"default", nil, 45, 47, 47},
+		{"midpoint of a wide spread", []OrderBookOption{WithPriceImprovement()}, 45, 47, 46},
+		{"no room", []OrderBookOption{WithPriceImprovement()}, 45, 45, 45},
+		{"off the grid, towards the maker", []OrderBookOption{WithPriceImprovement(), WithTickSize(1)}, 45, 48, 46},
+	}
+	for _, tc := range testCases {
+		ob := NewOrderBook(tc.opts...)
+		ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: tc.sell, Volume: 5})
+		result, _ := ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: tc.buy, Volume: 5})
+		if len(result.Trades) != 1 || result.Trades[0].Price != tc.expected {
+			t.Errorf("%s: expected a trade at %v, got %+v", tc.name, tc.expected, result.Trades)
+		}
+	}
+
+	// a resting bid lifted by an incoming ask is rounded up, towards the bid
+	ob := NewOrderBook(WithPriceImprovement(), WithTickSize(1))
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 48, Volume: 5})
+	result, _ := ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 5})
+	if len(result.Trades) != 1 || result.Trades[0].Price != 47 {
+		t.Errorf("Expected a trade at 47, got %+v", result.Trades)
+	}
+}
+
+func TestExecutionPrice(t *testing.T) {
+	// the same crossing pair, 47 against 45, with the bid resting and then with the ask resting
+	testCases := []struct {
+		policy     ExecutionPrice
+		bidResting float64
+		askResting float64
+	}{
+		{LegacyPrice, 47, 47},
+		{MakerPrice, 47, 45},
+		{TakerPrice, 45, 47},
+		{MidPrice, 46, 46},
+	}
+	for _, tc := range testCases {
+		ob := NewOrderBook(WithExecutionPrice(tc.policy))
+		ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 47, Volume: 5})
+		result, _ := ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 5})
+		if len(result.Trades) != 1 || result.Trades[0].Price != tc.bidResting {
+			t.Errorf("policy %d, resting bid: expected a trade at %v, got %+v", tc.policy, tc.bidResting, result.Trades)
+		}
+
+		ob = NewOrderBook(WithExecutionPrice(tc.policy))
+		ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 5})
+		result, _ = ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 47, Volume: 5})
+		if len(result.Trades) != 1 || result.Trades[0].Price != tc.askResting {
+			t.Errorf("policy %d, resting ask: expected a trade at %v, got %+v", tc.policy, tc.askResting, result.Trades)
+		}
+	}
+
+	// the default is LegacyPrice
+	ob := NewOrderBook()
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 5})
+	result, _ := ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 47, Volume: 5})
+	if len(result.Trades) != 1 || result.Trades[0].Price != 47 {
+		t.Errorf("Expected a trade at 47 by default, got %+v", result.Trades)
+	}
+}
+
+func TestMinFill(t *testing.T) {
+	newBook := func() *OrderBook {
+		ob := NewOrderBook()
+		ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 2})
+		ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 46, Volume: 1})
+		ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "SELL", Price: 47, Volume: 4})
+		return ob
+	}
+
+	// only 3 available up to 46
+	ob := newBook()
+	result, _ := ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "BUY", Price: 46, Volume: 6, MinFill: 5})
+	if len(result.Trades) != 0 || !result.Resting || result.RemainingVolume != 6 {
+		t.Errorf("Expected no trade and the order to rest, got %+v", result)
+	}
+
+	ob = newBook()
+	result, _ = ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "BUY", Price: 46, Volume: 6, MinFill: 5, TimeInForce: IOC})
+	if len(result.Trades) != 0 || result.Resting || ob.Orders[4].CancelReason != Expired {
+		t.Errorf("Expected no trade and the IOC order to be cancelled, got %+v", result)
+	}
+
+	// 7 available up to 47
+	ob = newBook()
+	result, _ = ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "BUY", Price: 47, Volume: 6, MinFill: 5})
+	if result.FilledVolume != 6 {
+		t.Errorf("Expected the order to fill, got %+v", result)
+	}
+}
+
+func TestBidAndAskLevels(t *testing.T) {
+	ob := NewOrderBook()
+	for i, order := range []struct {
+		side   string
+		price  float64
+		volume int
+	}{
+		{"SELL", 47, 2}, {"BUY", 44, 1}, {"SELL", 46, 3}, {"BUY", 45, 4}, {"SELL", 47, 5}, {"BUY", 44, 6},
+	} {
+		ob.Insert(&Order{ID: i + 1, Symbol: "FFLY", Side: order.side, Price: order.price, Volume: order.volume})
+	}
+	ob.Insert(&Order{ID: 7, Symbol: "FFLY", Side: "BUY", Price: 43, Volume: 9, Hidden: true})
+
+	bids, asks := ob.BidLevels(), ob.AskLevels()
+	if expected := []OrderSummary{{45, 4}, {44, 7}}; !reflect.DeepEqual(bids, expected) {
+		t.Errorf("Expected bids %v, got %v", expected, bids)
+	}
+	if expected := []OrderSummary{{46, 3}, {47, 7}}; !reflect.DeepEqual(asks, expected) {
+		t.Errorf("Expected asks %v, got %v", expected, asks)
+	}
+
+	// the CLI summary lists the same levels, asks worst first
+	expected := []string{"===FFLY===", "SELL,47,7", "SELL,46,3", "BUY,45,4", "BUY,44,7"}
+	if summary := ob.summaryLines("FFLY"); !reflect.DeepEqual(summary, expected) {
+		t.Errorf("Expected summary %v, got %v", expected, summary)
+	}
+}
+
+func TestWashTrades(t *testing.T) {
+	ob := NewOrderBook()
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 1, Account: "alice"})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 1, Account: "bob"})
+	ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 1})
+	ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 3, Account: "alice"})
+	ob.Insert(&Order{ID: 5, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 1})
+	ob.Insert(&Order{ID: 6, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 1})
+
+	var washes []bool
+	for _, trade := range ob.Executions {
+		washes = append(washes, trade.IsWash)
+	}
+	// alice against alice, then against bob and an anonymous order, then two anonymous orders
+	if expected := []bool{true, false, false, false}; !reflect.DeepEqual(washes, expected) {
+		t.Errorf("Expected wash flags %v, got %v", expected, washes)
+	}
+}
+
+func TestSummarySnapshot(t *testing.T) {
+	obs := NewOrderBooks(WithLogger(log.New(io.Discard, "", 0)))
+	symbols := []string{"GOOG", "AAPL", "FFLY"}
+	// books must exist before trading concurrently
+	for i, symbol := range symbols {
+		obs.Insert(&Order{ID: i, Symbol: symbol, Side: "SELL", Price: 50, Volume: 1})
+	}
+
+	var wg sync.WaitGroup
+	for i, symbol := range symbols {
+		wg.Add(1)
+		go func(base int, symbol string) {
+			defer wg.Done()
+			for id := base; id < base+100; id++ {
+				obs.Insert(&Order{ID: id, Symbol: symbol, Side: "BUY", Price: 45, Volume: 1})
+			}
+		}(100*(i+1), symbol)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			var headers []string
+			for _, line := range obs.SummarySnapshot() {
+				if strings.HasPrefix(line, "===") {
+					headers = append(headers, line)
+				}
+			}
+			if expected := []string{"===AAPL===", "===FFLY===", "===GOOG==="}; !reflect.DeepEqual(headers, expected) {
+				t.Errorf("Expected headers %v, got %v", expected, headers)
+			}
+		}
+	}()
+	wg.Wait()
+
+	expected := []string{
+		"===AAPL===", "SELL,50,1", "BUY,45,100",
+		"===FFLY===", "SELL,50,1", "BUY,45,100",
+		"===GOOG===", "SELL,50,1", "BUY,45,100",
+	}
+	if output := obs.SummarySnapshot(); !reflect.DeepEqual(output, expected) {
+		t.Errorf("Expected %v, got %v", expected, output)
+	}
+}
+
+func TestUpdateDecreaseInPlace(t *testing.T) {
+	ob := NewOrderBook(steppingClock(t))
+	for id, price := range []float64{45, 46, 44, 46, 45, 43} {
+		ob.Insert(&Order{ID: id, Symbol: "FFLY", Side: "BUY", Price: price, Volume: 10})
+	}
+	ob.Insert(&Order{ID: 10, Symbol: "FFLY", Side: "SELL", Price: 47, Volume: 10})
+
+	layout := append([]*Order(nil), *ob.BuyOrders...)
+	inserted := ob.Orders[4].Inserted
+	if _, err := ob.Update(4, 45, 3); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// no swap happened: every order is still at the same index of the heap array
+	for i, order := range *ob.BuyOrders {
+		if order != layout[i] || order.HeapIndex != i {
+			t.Errorf("Expected order %d at index %d, got order %d (HeapIndex %d)", layout[i].ID, i, order.ID, order.HeapIndex)
+		}
+	}
+	if order := ob.Orders[4]; order.Volume != 3 || !order.Inserted.Equal(inserted) {
+		t.Errorf("Expected volume 3 inserted at %v, got %d at %v", inserted, order.Volume, order.Inserted)
+	}
+	if err := ob.Validate(); err != nil {
+		t.Errorf("Unexpected invalid book: %v", err)
+	}
+
+	// under VolumeFirst the volume is part of the priority, so the decreased order moves behind the larger one
+	ob = NewOrderBook(WithTieBreak(VolumeFirst))
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 10})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 8})
+	if _, err := ob.Update(1, 45, 3); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := ob.Validate(); err != nil {
+		t.Errorf("Unexpected invalid book: %v", err)
+	}
+	result, _ := ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 1})
+	if len(result.Trades) != 1 || result.Trades[0].MakerID != 2 {
+		t.Errorf("Expected the larger order 2 to match first, got %+v", result.Trades)
+	}
+}
+
+func TestCostToFill(t *testing.T) {
+	ob := NewOrderBook()
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 46, Volume: 5})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 10})
+	ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "SELL", Price: 47, Volume: 5, Hidden: true})
+	ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "BUY", Price: 44, Volume: 4})
+	ob.Insert(&Order{ID: 5, Symbol: "FFLY", Side: "BUY", Price: 43, Volume: 4})
+	bids, asks := ob.Depth(0)
+
+	tests := []struct {
+		side     string
+		volume   int
+		avgPrice float64
+		filled   int
+		ok       bool
+	}{
+		{"BUY", 10, 45, 10, true},
+		{"BUY", 14, (10*45 + 4*46) / 14.0, 14, true},
+		{"BUY", 20, (10*45 + 5*46 + 5*47) / 20.0, 20, true},
+		{"BUY", 30, (10*45 + 5*46 + 5*47) / 20.0, 20, false}, // more than the whole book
+		{"SELL", 6, (4*44 + 2*43) / 6.0, 6, true},
+		{"SELL", 0, 0, 0, false},
+		{"HOLD", 5, 0, 0, false},
+	}
+	for _, tt := range tests {
+		avgPrice, filled, ok := ob.CostToFill(tt.side, tt.volume)
+		if math.Abs(avgPrice-tt.avgPrice) > priceEpsilon || filled != tt.filled || ok != tt.ok {
+			t.Errorf("CostToFill(%s, %d): expected %v, %d, %v, got %v, %d, %v", tt.side, tt.volume, tt.avgPrice, tt.filled, tt.ok, avgPrice, filled, ok)
+		}
+	}
+
+	if afterBids, afterAsks := ob.Depth(0); !reflect.DeepEqual(afterBids, bids) || !reflect.DeepEqual(afterAsks, asks) {
+		t.Errorf("Expected the book to be untouched %v %v, got %v %v", bids, asks, afterBids, afterAsks)
+	}
+	if err := ob.Validate(); err != nil {
+		t.Errorf("Unexpected invalid book: %v", err)
+	}
+}
+
+func TestClone(t *testing.T) {
+	ob := NewOrderBook(WithLotSize(1))
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 10})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 44, Volume: 10})
+	ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "SELL", Price: 46, Volume: 10})
+
+	clone := ob.Clone()
+	clone.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 10})
+	clone.Orders[2].Volume = 1
+	clone.Insert(&Order{ID: 5, Symbol: "FFLY", Side: "BUY", Price: 46, Volume: 5})
+
+	if bids, _ := ob.Depth(1); len(bids) != 1 || bids[0] != (OrderSummary{Price: 45, Volume: 10}) {
+		t.Errorf("Expected the original best bid 45x10, got %v", bids)
+	}
+	if volume := ob.Orders[2].Volume; volume != 10 {
+		t.Errorf("Expected the original order 2 to keep its volume 10, got %d", volume)
+	}
+	if len(ob.Executions) != 0 || len(ob.Trades) != 0 {
+		t.Errorf("Expected no trade on the original, got %v", ob.Trades)
+	}
+	if err := ob.Validate(); err != nil {
+		t.Errorf("Unexpected invalid original: %v", err)
+	}
+
+	// the clone traded on its own
+	if bids, _ := clone.Depth(1); len(bids) != 1 || bids[0] != (OrderSummary{Price: 44, Volume: 1}) {
+		t.Errorf("Expected the clone best bid 44x1, got %v", bids)
+	}
+	if expected := []string{"FFLY,45,10,4,1", "FFLY,46,5,5,3"}; !reflect.DeepEqual(clone.Trades, expected) {
+		t.Errorf("Expected clone trades %v, got %v", expected, clone.Trades)
+	}
+	if clone.LotSize != ob.LotSize {
+		t.Errorf("Expected the clone to keep the lot size %d, got %d", ob.LotSize, clone.LotSize)
+	}
+}
+
+func TestLevelCount(t *testing.T) {
+	ob := NewOrderBook()
+	if bids, asks := ob.LevelCount(); bids != 0 || asks != 0 {
+		t.Errorf("Expected no level on an empty book, got %d bid and %d ask levels", bids, asks)
+	}
+
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 1})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 2})
+	ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 44, Volume: 3})
+	ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "BUY", Price: 43, Volume: 3, Hidden: true})
+	ob.Insert(&Order{ID: 5, Symbol: "FFLY", Side: "SELL", Price: 47, Volume: 1})
+	ob.Insert(&Order{ID: 6, Symbol: "FFLY", Side: "SELL", Price: 47, Volume: 1})
+	ob.Insert(&Order{ID: 7, Symbol: "FFLY", Side: "SELL", Price: 47, Volume: 1})
+	ob.Insert(&Order{ID: 8, Symbol: "FFLY", Side: "SELL", Price: 48, Volume: 1})
+	ob.Cancel(8)
+
+	if bids, asks := ob.LevelCount(); bids != 2 || asks != 1 {
+		t.Errorf("Expected 2 bid and 1 ask levels, got %d and %d", bids, asks)
+	}
+	if bids, asks := ob.Depth(0); len(bids) != 2 || len(asks) != 1 {
+		t.Errorf("Expected LevelCount to agree with Depth, got %v and %v", bids, asks)
+	}
+}
+
+func TestLargeVolumesDontOverflow(t *testing.T) {
+	ob := NewOrderBook(WithLevelDiffs())
+	for id := 1; id <= 3; id++ {
+		ob.Insert(&Order{ID: id, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: math.MaxInt32})
+	}
+	expected := 3 * int64(math.MaxInt32) // past the int range of 32-bit builds
+
+	if _, asks := ob.Depth(0); len(asks) != 1 || asks[0].Volume != expected {
+		t.Errorf("Expected a single level of %d, got %v", expected, asks)
+	}
+	if volume := ob.TotalVolume("SELL"); volume != expected {
+		t.Errorf("Expected a total volume of %d, got %d", expected, volume)
+	}
+	if volume := ob.VolumeAtPrice("SELL", 45); volume != expected {
+		t.Errorf("Expected %d at 45, got %d", expected, volume)
+	}
+	if changes := ob.DiffSince(0); len(changes) == 0 || changes[len(changes)-1].Volume != expected {
+		t.Errorf("Expected the last level change to carry %d, got %v", expected, changes)
+	}
+	if summary := ob.summaryLines("FFLY"); !reflect.DeepEqual(summary, []string{"===FFLY===", "SELL,45,6442450941"}) {
+		t.Errorf("Unexpected summary %v", summary)
+	}
+
+	// pro-rata shares multiply volumes together
+	shares := allocateProRata([]*Order{{Volume: math.MaxInt32}, {Volume: math.MaxInt32}}, math.MaxInt32-1, RoundHalfUp)
+	if expected := []int{math.MaxInt32 / 2, math.MaxInt32 / 2}; !reflect.DeepEqual(shares, expected) {
+		t.Errorf("Expected shares %v, got %v", expected, shares)
+	}
+}
+
+func TestDisplayPrice(t *testing.T) {
+	display := func(price float64) *float64 { return &price }
+
+	ob := NewOrderBook(WithTickSize(0.01), WithPriceBand(1))
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 5, DisplayPrice: display(45.2)})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 45.2, Volume: 1})
+	ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 44, Volume: 2})
+
+	if summary := ob.summaryLines("FFLY"); !reflect.DeepEqual(summary, []string{"===FFLY===", "SELL,45.2,6", "BUY,44,2"}) {
+		t.Errorf("Expected order 1 shown at 45.2, got %v", summary)
+	}
+
+	// matching uses the true price: 45 is hit first, at 45
+	result, _ := ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "BUY", Price: 45.1, Volume: 3})
+	if len(result.Trades) != 1 || result.Trades[0].MakerID != 1 || result.Trades[0].Price != 45 {
+		t.Errorf("Expected a single trade against order 1, got %v", result.Trades)
+	}
+	if summary := ob.summaryLines("FFLY"); !reflect.DeepEqual(summary, []string{"===FFLY===", "SELL,45.2,3", "BUY,44,2"}) {
+		t.Errorf("Expected the remainder of order 1 still shown at 45.2, got %v", summary)
+	}
+
+	for _, price := range []float64{46, 45.005, 0, 45.2} {
+		_, err := ob.Insert(&Order{ID: 5, Symbol: "FFLY", Side: "SELL", Price: 45.3, Volume: 1, DisplayPrice: display(price)})
+		if !errors.Is(err, ErrInvalidDisplayPrice) {
+			t.Errorf("Expected display price %v to be rejected, got %v", price, err)
+		}
+	}
+
+	// without a band, the tick and the order's own side still apply
+	ob = NewOrderBook(WithTickSize(0.01))
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 50, Volume: 5})
+	for _, tc := range []struct {
+		side           string
+		price, display float64
+		valid          bool
+	}{
+		{"BUY", 44, 43, true},
+		{"BUY", 44, 44.005, false}, // off the tick
+		{"BUY", 44, 51, false},     // among the asks
+		{"BUY", 44, math.NaN(), false},
+		{"SELL", 52, 60, true},
+		{"SELL", 52, 40, false}, // below its own price, among the bids
+	} {
+		_, err := ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: tc.side, Price: tc.price, Volume: 1, DisplayPrice: display(tc.display)})
+		if tc.valid != (err == nil) || (err != nil && !errors.Is(err, ErrInvalidDisplayPrice)) {
+			t.Errorf("%s at %v shown at %v: expected valid %v, got %v", tc.side, tc.price, tc.display, tc.valid, err)
+		}
+		ob.Cancel(2)
+	}
+}
+
+func TestQueuePosition(t *testing.T) {
+	ob := NewOrderBook(steppingClock(t))
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 1})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 46, Volume: 1})
+	ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 1})
+	ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 1})
+	ob.Insert(&Order{ID: 5, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 1}) // trades with order 2
+	ob.Insert(&Order{ID: 6, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 1})
+	ob.Cancel(3)
+
+	tests := []struct {
+		id         int
+		position   int
+		levelCount int
+		ok         bool
+	}{
+		{1, 0, 3, true},
+		{4, 1, 3, true},
+		{6, 2, 3, true},
+		{2, 0, 0, false}, // filled
+		{3, 0, 0, false}, // cancelled
+		{9, 0, 0, false}, // unknown
+	}
+	for _, tt := range tests {
+		position, levelCount, ok := ob.QueuePosition(tt.id)
+		if position != tt.position || levelCount != tt.levelCount || ok != tt.ok {
+			t.Errorf("QueuePosition(%d): expected %d, %d, %v, got %d, %d, %v", tt.id, tt.position, tt.levelCount, tt.ok, position, levelCount, ok)
+		}
+	}
+
+	// a volume increase sends order 1 to the back of the level
+	ob.Update(1, 45, 2)
+	if position, levelCount, _ := ob.QueuePosition(1); position != 2 || levelCount != 3 {
+		t.Errorf("Expected order 1 last of 3 after its increase, got %d of %d", position, levelCount)
+	}
+}
+
+func TestRouter(t *testing.T) {
+	router := NewRouter(3, WithLogger(log.New(io.Discard, "", 0)))
+	symbols := []string{"FFLY", "AAPL", "GOOG", "MSFT", "TSLA", "AMZN"}
+
+	var operations []string
+	id := 0
+	for _, symbol := range symbols {
+		for i, side := range []string{"SELL", "BUY", "BUY", "SELL"} {
+			id++
+			price := 45 + float64(i%2)
+			router.Insert(&Order{ID: id, Symbol: symbol, Side: side, Price: price, Volume: i + 1})
+			operations = append(operations, fmt.Sprintf("INSERT,%d,%s,%s,%s,%d", id, symbol, side, formatFloat(price), i+1))
+		}
+		router.Update(&Order{ID: id - 2, Symbol: symbol, Price: 46, Volume: 5})
+		operations = append(operations, fmt.Sprintf("UPDATE,%d,46,5", id-2))
+		router.Cancel(id, symbol)
+		operations = append(operations, fmt.Sprintf("CANCEL,%d", id))
+	}
+
+	for _, symbol := range symbols {
+		owner := router.shard(symbol)
+		for i, obs := range router.shards {
+			if _, exists := obs.Book(symbol); exists != (i == owner) {
+				t.Errorf("Expected %s only on shard %d, found it on shard %d", symbol, owner, i)
+			}
+		}
+		if router.shard(symbol) != owner {
+			t.Errorf("Expected %s to always be routed to shard %d", symbol, owner)
+		}
+	}
+
+	expected := runMatchingEngine(operations)
+	if output := router.SummarySnapshot(); !reflect.DeepEqual(output, expected) {
+		t.Errorf("Expected the single book output %v, got %v", expected, output)
+	}
+}
+
+func TestUnknownSymbol(t *testing.T) {
+	obs := NewOrderBooks()
+	obs.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 5})
+
+	// GOOG never had a book: no panic, an error
+	if err := obs.Cancel(1, "GOOG"); !errors.Is(err, ErrUnknownSymbol) {
+		t.Errorf("Expected ErrUnknownSymbol from Cancel, got %v", err)
+	}
+	if err := obs.Update(&Order{ID: 1, Symbol: "GOOG", Side: "BUY", Price: 46, Volume: 5}); !errors.Is(err, ErrUnknownSymbol) {
+		t.Errorf("Expected ErrUnknownSymbol from Update, got %v", err)
+	}
+	if err := obs.Cancel(1, "FFLY"); err != nil {
+		t.Errorf("Unexpected error cancelling on a known symbol: %v", err)
+	}
+	if total := obs.TotalOrders(); total != 0 {
+		t.Errorf("Expected order 1 cancelled, got %d orders", total)
+	}
+}
+
+func TestBustTrade(t *testing.T) {
+	ob := NewOrderBook(WithBustReinstatement())
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 5})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 46, Volume: 5})
+	ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 2}) // trade 1: 2 at 45
+	ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "BUY", Price: 46, Volume: 4}) // trade 2: 3 at 45, trade 3: 1 at 46
+
+	if stats := ob.Stats(); stats.Count != 3 || stats.Volume != 6 || math.Abs(stats.VWAP-(5*45+1*46)/6.0) > priceEpsilon {
+		t.Fatalf("Unexpected stats before the bust: %+v", stats)
+	}
+
+	if err := ob.BustTrade(3); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if stats := ob.Stats(); stats.Count != 2 || stats.Volume != 5 || math.Abs(stats.VWAP-45) > priceEpsilon {
+		t.Errorf("Unexpected stats after the bust: %+v", stats)
+	}
+	if !ob.Executions[2].Busted || ob.Executions[0].Busted || ob.Executions[1].Busted {
+		t.Errorf("Expected only trade 3 busted, got %v", ob.Executions)
+	}
+	// order 2 still rests and gets its volume back, the filled taker 4 isn't brought back
+	if volume := ob.Orders[2].Volume; volume != 5 {
+		t.Errorf("Expected order 2 reinstated to 5, got %d", volume)
+	}
+	if buy, _ := ob.Len(); buy != 0 {
+		t.Errorf("Expected no buy order back on the book, got %d", buy)
+	}
+
+	if err := ob.BustTrade(2); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if volume := ob.Orders[1].Volume; volume != 0 {
+		t.Errorf("Expected filled order 1 left alone, got %d", volume)
+	}
+	if stats := ob.Stats(); stats.Count != 1 || stats.Volume != 2 || math.Abs(stats.VWAP-45) > priceEpsilon {
+		t.Errorf("Unexpected stats after the second bust: %+v", stats)
+	}
+
+	if err := ob.BustTrade(2); !errors.Is(err, ErrTradeBusted) {
+		t.Errorf("Expected ErrTradeBusted, got %v", err)
+	}
+	if err := ob.BustTrade(9); !errors.Is(err, ErrTradeNotFound) {
+		t.Errorf("Expected ErrTradeNotFound, got %v", err)
+	}
+
+	// without reinstatement the orders are left as they are
+	ob = NewOrderBook()
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 5})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 2})
+	ob.BustTrade(1)
+	if volume := ob.Orders[1].Volume; volume != 3 {
+		t.Errorf("Expected order 1 left at 3, got %d", volume)
+	}
+	if stats := ob.Stats(); stats != (TradeStats{}) {
+		t.Errorf("Expected empty stats, got %+v", stats)
+	}
+}
+
+func TestPriceDecimals(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	obs := NewOrderBooks(WithLogger(logger))
+
+	tests := []struct {
+		operation string
+		valid     bool
+	}{
+		{"INSERT,1,FFLY,BUY,2.14275,5", false}, // the documented counterexample
+		{"INSERT,1,FFLY,BUY,2.1427,5", true},
+		{"INSERT,2,FFLY,BUY,33.42000,5", true}, // trailing zeros don't count
+		{"UPDATE,1,2.14271,5", false},
+		{"UPDATE,1,2.1426,5", true},
+		// ParseFloat accepts these, the csv input doesn't
+		{"INSERT,3,FFLY,BUY,NaN,5", false},
+		{"INSERT,3,FFLY,BUY,Inf,5", false},
+		{"INSERT,3,FFLY,BUY,1e-9,5", false},
+		{"INSERT,3,FFLY,BUY,0x1p-2,5", false},
+		{"UPDATE,1,1e1,5", false},
+	}
+	for _, tt := range tests {
+		if _, err := applyOperation(obs, tt.operation); (err == nil) != tt.valid {
+			t.Errorf("%s: expected valid %v, got %v", tt.operation, tt.valid, err)
+		} else if err != nil && !errors.Is(err, ErrMalformedOperation) {
+			t.Errorf("%s: expected ErrMalformedOperation, got %v", tt.operation, err)
+		}
+	}
+	if total := obs.TotalOrders(); total != 2 {
+		t.Errorf("Expected 2 orders, got %d", total)
+	}
+
+	obs = NewOrderBooks(WithLogger(logger)).WithPriceDecimals(2)
+	if _, err := applyOperation(obs, "INSERT,1,FFLY,BUY,2.143,5"); !errors.Is(err, ErrMalformedOperation) {
+		t.Errorf("Expected 3 decimals to be rejected, got %v", err)
+	}
+	if _, err := applyOperation(obs, "INSERT,1,FFLY,BUY,2.14,5"); err != nil {
+		t.Errorf("Expected 2 decimals to be accepted, got %v", err)
+	}
+}
+
+func TestRenderTable(t *testing.T) {
+	ob := NewOrderBook(WithLogger(log.New(io.Discard, "", 0)))
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 47, Volume: 3})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 46.5, Volume: 10})
+	ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "SELL", Price: 46.5, Volume: 2})
+	ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 2})
+	ob.Insert(&Order{ID: 5, Symbol: "FFLY", Side: "BUY", Price: 44.25, Volume: 100})
+
+	expected := "" +
+		"  SIDE      PRICE  VOLUME  CUMULATIVE\n" +
+		"  SELL         47       3          15\n" +
+		"  SELL       46.5      12          12\n" +
+		"   ---  mid 45.75     ---         ---\n" +
+		"   BUY         45       2           2\n" +
+		"   BUY      44.25     100         102\n"
+	if table := ob.RenderTable(); table != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, table)
+	}
+
+	// one sided books have no mid price
+	ob = NewOrderBook(WithLogger(log.New(io.Discard, "", 0)))
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 2})
+	expected = "" +
+		"  SIDE  PRICE  VOLUME  CUMULATIVE\n" +
+		"   ---    ---     ---         ---\n" +
+		"   BUY     45       2           2\n"
+	if table := ob.RenderTable(); table != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, table)
+	}
+}
+
+func TestTopOfBookOnly(t *testing.T) {
+	ob := NewOrderBook()
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 5})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 50, Volume: 5})
+
+	testCases := []struct {
+		order   *Order
+		resting bool
+	}{
+		{&Order{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 44, Volume: 5, TopOfBookOnly: true}, false},  // behind the best bid
+		{&Order{ID: 4, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 5, TopOfBookOnly: true}, false},  // only joins it
+		{&Order{ID: 5, Symbol: "FFLY", Side: "BUY", Price: 46, Volume: 5, TopOfBookOnly: true}, true},   // improves it
+		{&Order{ID: 6, Symbol: "FFLY", Side: "SELL", Price: 51, Volume: 5, TopOfBookOnly: true}, false}, // behind the best ask
+		{&Order{ID: 9, Symbol: "FFLY", Side: "SELL", Price: 50, Volume: 5, TopOfBookOnly: true}, false}, // only joins it
+		{&Order{ID: 7, Symbol: "FFLY", Side: "SELL", Price: 49, Volume: 5, TopOfBookOnly: true}, true},  // improves it
+		{&Order{ID: 8, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 5}, true},                        // a plain order rests anyway
+	}
+	for _, tc := range testCases {
+		result, err := ob.Insert(tc.order)
+		if err != nil || result.Resting != tc.resting {
+			t.Errorf("order %d: expected resting %v, got %+v, %v", tc.order.ID, tc.resting, result, err)
+		}
+		if order, _ := ob.GetOrder(tc.order.ID); !tc.resting && order.CancelReason != Expired {
+			t.Errorf("order %d: expected it cancelled as Expired, got %q", tc.order.ID, order.CancelReason)
+		}
+	}
+	if buy, sell := ob.Len(); buy != 3 || sell != 2 {
+		t.Errorf("Expected 3 bids and 2 asks, got %d and %d", buy, sell)
+	}
+	if err := ob.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	// on an empty side any price is the new best
+	empty := NewOrderBook()
+	if result, _ := empty.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 50, Volume: 5, TopOfBookOnly: true}); !result.Resting {
+		t.Errorf("Expected the first ask to rest, got %+v", result)
+	}
+}
+
+func TestReduceOnly(t *testing.T) {
+	ob := NewOrderBook()
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 3})
+	result, _ := ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 5, ReduceOnly: true})
+
+	if result.FilledVolume != 3 || result.Resting {
+		t.Errorf("Expected 3 filled and nothing resting, got %+v", result)
+	}
+	if order, _ := ob.GetOrder(2); order.CancelReason != Expired {
+		t.Errorf("Expected the remainder cancelled as Expired, got %q", order.CancelReason)
+	}
+	if buy, _ := ob.Len(); buy != 0 {
+		t.Errorf("Expected no resting buy, got %d", buy)
+	}
+
+	// the position checker sees the remainder and decides whether it rests
+	var checked []int
+	ob = NewOrderBook(WithPositionChecker(func(order OrderStatus) bool {
+		checked = append(checked, order.ID)
+		return order.Volume <= 2
+	}))
+	ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 3})
+	ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 5, ReduceOnly: true}) // 2 left, may rest
+	ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 44, Volume: 4, ReduceOnly: true}) // vetoed
+	ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "BUY", Price: 44, Volume: 4})                   // not reduce-only
+
+	if !reflect.DeepEqual(checked, []int{2, 3}) {
+		t.Errorf("Expected the checker called for orders 2 and 3, got %v", checked)
+	}
+	if order, _ := ob.GetOrder(2); order.CancelReason != "" || order.Volume != 2 {
+		t.Errorf("Expected order 2 resting with 2, got %+v", order)
+	}
+	if order, _ := ob.GetOrder(3); order.CancelReason != Expired {
+		t.Errorf("Expected order 3 vetoed, got %q", order.CancelReason)
+	}
+	if buy, _ := ob.Len(); buy != 2 {
+		t.Errorf("Expected orders 2 and 4 resting, got %d", buy)
+	}
+}
+
+func TestEqualTimestampsAreDeterministic(t *testing.T) {
+	// every order shares the same timestamp, like consecutive inserts within one tick of a coarse clock
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	expected := []string{
+		"FFLY,46,3,2,4",
+		"FFLY,45.95,1,5,1",
+		"FFLY,45.95,1,6,1",
+		"FFLY,45.95,1,7,3",
+	}
+
+	for run := 0; run < 100; run++ {
+		ob := NewOrderBook(WithLogger(log.New(io.Discard, "", 0)), WithClock(func() time.Time { return now }))
+		ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 45.95, Volume: 5})
+		ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 45.95, Volume: 6})
+		ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "BUY", Price: 45.95, Volume: 12})
+		ob.Insert(&Order{ID: 4, Symbol: "FFLY", Side: "SELL", Price: 46, Volume: 8})
+		ob.Update(2, 46, 3)
+		ob.Insert(&Order{ID: 5, Symbol: "FFLY", Side: "SELL", Price: 45.95, Volume: 1})
+		ob.Update(1, 45.95, 3)
+		ob.Insert(&Order{ID: 6, Symbol: "FFLY", Side: "SELL", Price: 45.95, Volume: 1})
+		ob.Update(1, 45.95, 5) // loses its priority even though the clock didn't move
+		ob.Insert(&Order{ID: 7, Symbol: "FFLY", Side: "SELL", Price: 45.95, Volume: 1})
+
+		if !reflect.DeepEqual(ob.Trades, expected) {
+			t.Fatalf("Run %d: expected %v, got %v", run, expected, ob.Trades)
+		}
+	}
+}
+
+func TestMaxFillsPerMatch(t *testing.T) {
+	build := func(opts ...OrderBookOption) *OrderBook {
+		ob := NewOrderBook(opts...)
+		for id := 1; id <= 5; id++ {
+			ob.Insert(&Order{ID: id, Symbol: "FFLY", Side: "SELL", Price: float64(44 + id), Volume: 1})
+		}
+		ob.Insert(&Order{ID: 6, Symbol: "FFLY", Side: "BUY", Price: 44, Volume: 10})
+		return ob
+	}
+
+	uncapped := build()
+	expected, _ := uncapped.Update(6, 50, 10)
+
+	ob := build(WithMaxFillsPerMatch(2))
+	trades, _ := ob.Update(6, 50, 10) // reprices into the 5 asks
+	if len(trades) != 2 {
+		t.Fatalf("Expected the update to stop after 2 fills, got %v", trades)
+	}
+	if _, sell := ob.Len(); sell != 3 {
+		t.Errorf("Expected 3 asks left after the capped match, got %d", sell)
+	}
+
+	for _, size := range []int{2, 1} {
+		more := ob.ContinueMatching()
+		if len(more) != size {
+			t.Errorf("Expected %d more fills, got %v", size, more)
+		}
+		trades = append(trades, more...)
+	}
+	if more := ob.ContinueMatching(); more != nil {
+		t.Errorf("Expected nothing left to match, got %v", more)
+	}
+
+	if !reflect.DeepEqual(trades, expected) {
+		t.Errorf("Expected the capped batches to add up to %v, got %v", expected, trades)
+	}
+	if order, _ := ob.GetOrder(6); order.Volume != 5 {
+		t.Errorf("Expected 5 left on order 6, got %d", order.Volume)
+	}
+}
+
+func TestPairSpread(t *testing.T) {
+	obs := NewOrderBooks(WithLogger(log.New(io.Discard, "", 0)))
+	obs.Insert(&Order{ID: 1, Symbol: "AAA", Side: "BUY", Price: 100, Volume: 1})
+	obs.Insert(&Order{ID: 2, Symbol: "AAA", Side: "SELL", Price: 102, Volume: 1})
+	obs.Insert(&Order{ID: 3, Symbol: "AAA", Side: "SELL", Price: 106, Volume: 1})
+	obs.Insert(&Order{ID: 1, Symbol: "BBB", Side: "BUY", Price: 90, Volume: 1})
+	obs.Insert(&Order{ID: 2, Symbol: "BBB", Side: "SELL", Price: 92, Volume: 1})
+	obs.Insert(&Order{ID: 1, Symbol: "CCC", Side: "BUY", Price: 50, Volume: 1})
+
+	if spread, ok := obs.PairSpread("AAA", "BBB"); !ok || spread != 10 {
+		t.Errorf("Expected a spread of 10, got %v, %v", spread, ok)
+	}
+	if spread, ok := obs.PairSpread("BBB", "AAA"); !ok || spread != -10 {
+		t.Errorf("Expected a spread of -10, got %v, %v", spread, ok)
+	}
+	for _, pair := range [][2]string{{"AAA", "CCC"}, {"AAA", "DDD"}} {
+		if _, ok := obs.PairSpread(pair[0], pair[1]); ok {
+			t.Errorf("Expected no spread for %v", pair)
+		}
+	}
+
+	// buy BBB once AAA trades 12 above it
+	trigger := SpreadTrigger{A: "AAA", B: "BBB", Threshold: 12, Above: true}
+	if err := obs.InsertContingent(&Order{ID: 3, Symbol: "BBB", Side: "BUY", Price: 92, Volume: 1}, trigger); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	bbb, _ := obs.Book("BBB")
+	if len(bbb.Executions) != 0 {
+		t.Fatalf("Expected the contingent order held back, got %v", bbb.Trades)
+	}
+
+	// lifting the 102 ask moves the AAA mid to 103, the spread to 12
+	obs.Insert(&Order{ID: 4, Symbol: "AAA", Side: "BUY", Price: 102, Volume: 1})
+	if expected := []string{"BBB,92,1,3,2"}; !reflect.DeepEqual(bbb.Trades, expected) {
+		t.Errorf("Expected the contingent order to fill %v, got %v", expected, bbb.Trades)
+	}
+	if len(obs.contingent) != 0 {
+		t.Errorf("Expected no contingent order left, got %v", obs.contingent)
+	}
+}
+
+func TestContingentCSV(t *testing.T) {
+	obs := NewOrderBooks(WithLogger(log.New(io.Discard, "", 0)))
+	for _, operation := range []string{
+		"INSERT,1,AAA,BUY,100,1",
+		"INSERT,2,AAA,SELL,102,1",
+		"INSERT,3,AAA,SELL,110,1",
+		"INSERT,1,BBB,BUY,90,1",
+		"INSERT,2,BBB,SELL,92,1",
+		"INSERT,3,BBB,SELL,93,1",
+	} {
+		if _, err := applyOperation(obs, operation); err != nil {
+			t.Fatalf("Unexpected error applying %s: %v", operation, err)
+		}
+	}
+	bbb, _ := obs.Book("BBB")
+
+	// buy BBB once AAA trades 12 above it: cancelling the 102 ask moves the AAA mid to 105, the spread to 14
+	trigger := SpreadTrigger{A: "AAA", B: "BBB", Threshold: 12, Above: true}
+	obs.InsertContingent(&Order{ID: 4, Symbol: "BBB", Side: "BUY", Price: 92, Volume: 1}, trigger)
+	if _, err := applyOperation(obs, "CANCEL,2"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := []string{"BBB,92,1,4,2"}; !reflect.DeepEqual(bbb.Trades, expected) {
+		t.Errorf("Expected a CANCEL to fire the contingent order, got %v", bbb.Trades)
+	}
+
+	// the BBB mid is now 91.5: replacing the 110 ask by a 104 one moves the AAA mid to 102, the spread to 10.5
+	trigger = SpreadTrigger{A: "AAA", B: "BBB", Threshold: 12, Above: false}
+	obs.InsertContingent(&Order{ID: 5, Symbol: "BBB", Side: "SELL", Price: 90, Volume: 1}, trigger)
+	if _, err := applyOperation(obs, "CXR,3,4,104,1"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := []string{"BBB,92,1,4,2", "BBB,90,1,5,1"}; !reflect.DeepEqual(bbb.Trades, expected) {
+		t.Errorf("Expected a CXR to fire the contingent order, got %v", bbb.Trades)
+	}
+	if len(obs.contingent) != 0 {
+		t.Errorf("Expected no contingent order left, got %v", obs.contingent)
+	}
+}
+
+func TestSaveAndLoadOrderBooks(t *testing.T) {
+	// a frozen clock: the queue priority only survives the round trip through the saved order
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	opts := []OrderBookOption{WithLogger(log.New(io.Discard, "", 0)), WithClock(func() time.Time { return now })}
+	obs := NewOrderBooks(opts...)
+	id := 0
+	for _, symbol := range []string{"GOOG", "FFLY", "AAPL"} {
+		for i := 0; i < 6; i++ {
+			id++
+			obs.Insert(&Order{ID: id, Symbol: symbol, Side: "BUY", Price: float64(45 + i%2), Volume: i + 1})
+			id++
+			obs.Insert(&Order{ID: id, Symbol: symbol, Side: "SELL", Price: float64(48 + i%2), Volume: i + 1})
+		}
+		id++
+		obs.Insert(&Order{ID: id, Symbol: symbol, Side: "SELL", Price: 46, Volume: 2}) // trades
+	}
+
+	var buf bytes.Buffer
+	if err := obs.Save(&buf); err != nil {
+		t.Fatalf("Unexpected error saving: %v", err)
+	}
+	loaded, err := LoadOrderBooks(&buf, opts...)
+	if err != nil {
+		t.Fatalf("Unexpected error loading: %v", err)
+	}
+
+	queue := func(ob *OrderBook) []int {
+		var ids []int
+		for _, side := range []string{"BUY", "SELL"} {
+			ob.ForEachResting(side, func(order OrderStatus) bool {
+				ids = append(ids, order.ID)
+				return true
+			})
+		}
+		return ids
+	}
+	for _, symbol := range []string{"AAPL", "FFLY", "GOOG"} {
+		original, _ := obs.Book(symbol)
+		reloaded, exists := loaded.Book(symbol)
+		if !exists {
+			t.Fatalf("Expected %s to be loaded", symbol)
+		}
+		if !reflect.DeepEqual(queue(reloaded), queue(original)) {
+			t.Errorf("%s: expected the priority %v, got %v", symbol, queue(original), queue(reloaded))
+		}
+		if !reflect.DeepEqual(reloaded.Executions, original.Executions) {
+			t.Errorf("%s: expected trades %v, got %v", symbol, original.Executions, reloaded.Executions)
+		}
+		if err := reloaded.Validate(); err != nil {
+			t.Errorf("%s: unexpected invalid book: %v", symbol, err)
+		}
+	}
+	if output, expected := loaded.SummarySnapshot(), obs.SummarySnapshot(); !reflect.DeepEqual(output, expected) {
+		t.Errorf("Expected the output %v, got %v", expected, output)
+	}
+
+	// both keep matching the same way
+	obs.Insert(&Order{ID: 100, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 30})
+	loaded.Insert(&Order{ID: 100, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 30})
+	if output, expected := loaded.SummarySnapshot(), obs.SummarySnapshot(); !reflect.DeepEqual(output, expected) {
+		t.Errorf("Expected the output %v after matching, got %v", expected, output)
+	}
+
+	if _, err := LoadOrderBooks(strings.NewReader(`{"Version": 99}`)); !errors.Is(err, ErrSnapshotVersion) {
+		t.Errorf("Expected ErrSnapshotVersion, got %v", err)
+	}
+}
+
+func TestSaveAndLoadBookState(t *testing.T) {
+	opts := []OrderBookOption{WithLogger(log.New(io.Discard, "", 0)), WithSizeLimits(10, 0)}
+	roundTrip := func(obs OrderBooks) OrderBooks {
+		t.Helper()
+		var buf bytes.Buffer
+		if err := obs.Save(&buf); err != nil {
+			t.Fatalf("Unexpected error saving: %v", err)
+		}
+		loaded, err := LoadOrderBooks(&buf, opts...)
+		if err != nil {
+			t.Fatalf("Unexpected error loading: %v", err)
+		}
+		return loaded
+	}
+	resting := func(obs OrderBooks) []string {
+		ob, _ := obs.Book("FFLY")
+		var orders []string
+		for _, side := range []string{"BUY", "SELL"} {
+			ob.ForEachResting(side, func(order OrderStatus) bool {
+				orders = append(orders, fmt.Sprintf("%d:%d", order.ID, order.Volume))
+				return true
+			})
+		}
+		return orders
+	}
+
+	// a partial fill leaves order 1 below the minimum size
+	obs := NewOrderBooks(opts...)
+	obs.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 13})
+	obs.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 10})
+	obs.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "SELL", Price: 46, Volume: 10})
+	if expected, got := []string{"1:3", "3:10"}, resting(roundTrip(obs)); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected the partially filled order restored, got %v", got)
+	}
+
+	// the MinFill ask crossing the bid stays on the book
+	obs = NewOrderBooks(opts...)
+	obs.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 10})
+	obs.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 45, Volume: 20, MinFill: 20})
+	if expected, got := []string{"1:10", "2:20"}, resting(roundTrip(obs)); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected the crossed book restored, got %v", got)
+	}
+
+	// a halted book is restored halted, with its queued crossing orders
+	obs = NewOrderBooks(opts...)
+	obs.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 10})
+	ob, _ := obs.Book("FFLY")
+	ob.Halt()
+	obs.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "SELL", Price: 44, Volume: 10})
+	loaded := roundTrip(obs)
+	reloaded, _ := loaded.Book("FFLY")
+	if !reloaded.IsHalted() {
+		t.Fatalf("Expected the book restored halted")
+	}
+	if expected, got := []string{"1:10", "2:10"}, resting(loaded); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected the queued orders restored, got %v", got)
+	}
+	if trades := reloaded.Resume(); len(trades) != 1 || trades[0].Volume != 10 {
+		t.Errorf("Expected the restored book to uncross on resume, got %v", trades)
+	}
+}
+
+func TestPrintLeavesTradesAlone(t *testing.T) {
+	var journal bytes.Buffer
+	opts := []OrderBookOption{WithLogger(log.New(io.Discard, "", 0)), WithTradeJournal(&journal)}
+	obs := NewOrderBooks(opts...)
+	var output []string
+	for _, operation := range []string{
+		"INSERT,1,FFLY,SELL,48,3",
+		"INSERT,2,GOOG,SELL,10,3",
+		"INSERT,3,FFLY,BUY,48,1",
+		"PRINT,FFLY",
+		"INSERT,4,GOOG,BUY,10,1",
+		"PRINT,GOOG",
+		"INSERT,5,FFLY,BUY,48,1",
+	} {
+		var err error
+		if output, err = applyOperationOutput(obs, operation, OutputBoth, output); err != nil {
+			t.Fatalf("Unexpected error for %q: %v", operation, err)
+		}
+	}
+
+	// each summary comes out where it was printed, between the trades before and after it
+	expected := []string{
+		"FFLY,48,1,3,1",
+		"===FFLY===",
+		"SELL,48,2",
+		"GOOG,10,1,4,2",
+		"===GOOG===",
+		"SELL,10,2",
+	}
+	if !reflect.DeepEqual(output, expected) {
+		t.Errorf("Expected the output %v, got %v", expected, output)
+	}
+
+	// the books only hold the trade not printed yet, and the journal only trades
+	ffly, _ := obs.Book("FFLY")
+	goog, _ := obs.Book("GOOG")
+	if !reflect.DeepEqual(ffly.Trades, []string{"FFLY,48,1,5,1"}) || len(goog.Trades) != 0 {
+		t.Errorf("Expected only the pending FFLY trade, got %v and %v", ffly.Trades, goog.Trades)
+	}
+	lines := strings.Split(strings.TrimSpace(journal.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 journaled trades, got %q", journal.String())
+	}
+	for _, line := range lines {
+		if fields := strings.Split(line, ","); len(fields) != 7 {
+			t.Errorf("Expected a journaled trade, got %q", line)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := obs.Save(&buf); err != nil {
+		t.Fatalf("Unexpected error saving: %v", err)
+	}
+	loaded, err := LoadOrderBooks(&buf, opts[0])
+	if err != nil {
+		t.Fatalf("Unexpected error loading: %v", err)
+	}
+	if reloaded, _ := loaded.Book("FFLY"); !reflect.DeepEqual(reloaded.Trades, ffly.Trades) {
+		t.Errorf("Expected the saved trades %v, got %v", ffly.Trades, reloaded.Trades)
+	}
+	if output, expected := loaded.SummarySnapshot(), obs.SummarySnapshot(); !reflect.DeepEqual(output, expected) {
+		t.Errorf("Expected the output %v, got %v", expected, output)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	build := func(volume int) *OrderBook {
+		ob := NewOrderBook(WithLogger(log.New(io.Discard, "", 0)))
+		ob.Insert(&Order{ID: 1, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 5})
+		ob.Insert(&Order{ID: 2, Symbol: "FFLY", Side: "BUY", Price: 44.5, Volume: 2})
+		ob.Insert(&Order{ID: 3, Symbol: "FFLY", Side: "SELL", Price: 46, Volume: volume})
+		return ob
+	}
+
+	ob := build(3)
+	if checksum, expected := ob.Checksum(), crc32.ChecksumIEEE([]byte("45:5:46:3:44.5:2")); checksum != expected {
+		t.Errorf("Expected the checksum of the documented string %d, got %d", expected, checksum)
+	}
+
+	// the same levels built from different orders checksum the same
+	other := NewOrderBook(WithLogger(log.New(io.Discard, "", 0)))
+	other.Insert(&Order{ID: 7, Symbol: "FFLY", Side: "SELL", Price: 46, Volume: 1})
+	other.Insert(&Order{ID: 8, Symbol: "FFLY", Side: "SELL", Price: 46, Volume: 2})
+	other.Insert(&Order{ID: 9, Symbol: "FFLY", Side: "BUY", Price: 44.5, Volume: 2})
+	other.Insert(&Order{ID: 10, Symbol: "FFLY", Side: "BUY", Price: 45, Volume: 5})
+	if ob.Checksum() != other.Checksum() {
+		t.Errorf("Expected identical books to checksum the same, got %d and %d", ob.Checksum(), other.Checksum())
+	}
+
+	if changed := build(4); changed.Checksum() == ob.Checksum() {
+		t.Errorf("Expected a changed level to change the checksum")
+	}
+	// levels past ChecksumLevels don't count
+	other.Insert(&Order{ID: 11, Symbol: "FFLY", Side: "BUY", Price: 30, Volume: 1})
+	for i := 0; i < ChecksumLevels; i++ {
+		ob.Insert(&Order{ID: 20 + i, Symbol: "FFLY", Side: "BUY", Price: float64(44 - i), Volume: 1})
+		other.Insert(&Order{ID: 20 + i, Symbol: "FFLY", Side: "BUY", Price: float64(44 - i), Volume: 1})
+	}
+	if ob.Checksum() != other.Checksum() {
+		t.Errorf("Expected levels past the top %d to be ignored", ChecksumLevels)
+	}
+}